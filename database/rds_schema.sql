@@ -40,7 +40,6 @@ CREATE TABLE users (
     instagram VARCHAR(30),
     snapchat VARCHAR(30),
     phone_number VARCHAR(15),
-    picture_s3_url VARCHAR(2000),
     interest_1 VARCHAR(20),
     interest_2 VARCHAR(20),
     interest_3 VARCHAR(20),
@@ -75,16 +74,248 @@ CREATE TABLE elos (
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+/*
+   transactional outbox of match updates from match-service. handlers only
+   write here; a relay publishes rows to SQS, retrying with backoff until
+   published_at is set, or failed_at after 10 attempts, which is logged and
+   needs an operator. updates that pick or withdraw a crush, including
+   returning or declining someone else's, also set crush_email and
+   crush_week, with crush_target NULL for a withdrawal;
+   match-service counts them as the user's crush until their key is in
+   processed_messages, unless they failed.
+*/
+
+CREATE TABLE match_outbox (
+    id SERIAL PRIMARY KEY,
+    idempotency_key VARCHAR(100) NOT NULL UNIQUE,
+    body TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    published_at TIMESTAMP,
+    failed_at TIMESTAMP,
+    crush_email VARCHAR(50),
+    crush_week DATE,
+    crush_target VARCHAR(50)
+);
+
+CREATE INDEX idx_match_outbox_due ON match_outbox (next_attempt_at) WHERE published_at IS NULL AND failed_at IS NULL;
+CREATE INDEX idx_match_outbox_crush ON match_outbox (crush_email, crush_week) WHERE crush_email IS NOT NULL;
+
+/*
+   idempotency keys of the match updates sqs-consumer has applied, written in
+   the same transaction as the update so redelivered messages are skipped.
+   dead lettered messages are recorded too. rows older than both the queue's
+   retention period and a week can be deleted.
+*/
+
+CREATE TABLE processed_messages (
+    idempotency_key VARCHAR(100) PRIMARY KEY,
+    processed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_processed_messages_processed_at ON processed_messages (processed_at);
+
+/*
+   match update messages sqs-consumer rejected as permanently invalid, with the
+   reason. they are removed from the queue and kept here for inspection.
+*/
+
+CREATE TABLE dead_letters (
+    message_id VARCHAR(100) PRIMARY KEY,
+    body TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+/*
+   first interest decision each rater made on each rated user per week; only
+   that decision moves elos (see sqs-consumer/elo.go)
+*/
+
+CREATE TABLE elo_decisions (
+    rater_email VARCHAR(50) REFERENCES users(email),
+    rated_email VARCHAR(50) REFERENCES users(email),
+    week TIMESTAMP NOT NULL,
+    wanted BOOLEAN NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (rater_email, rated_email, week)
+);
+
+/*
+   one row per match generator run. seed, scorer_config, and the generation
+   options (capacity, candidates, scan_window, workers, with defaults applied)
+   reproduce the run's matches from the same users and history_weeks of match
+   history (0 for every earlier week); input_hash fingerprints those users and
+   the match history so a reproduction can tell whether they have changed since.
+*/
+
+CREATE TABLE match_runs (
+    id SERIAL PRIMARY KEY,
+    week TIMESTAMP NOT NULL,
+    seed BIGINT NOT NULL,
+    scorer_config JSONB NOT NULL,
+    capacity INT NOT NULL,
+    candidates INT NOT NULL,
+    scan_window INT NOT NULL,
+    workers INT NOT NULL,
+    history_weeks INT NOT NULL,
+    user_count INT NOT NULL,
+    pair_count INT NOT NULL,
+    input_hash VARCHAR(64) NOT NULL,
+    started_at TIMESTAMP NOT NULL,
+    finished_at TIMESTAMP NOT NULL
+);
+
 CREATE TABLE matches (
     user1_email VARCHAR(50) REFERENCES users(email),
     user2_email VARCHAR(50) REFERENCES users(email),
     user1_interested BOOLEAN NOT NULL DEFAULT FALSE,
     user2_interested BOOLEAN NOT NULL DEFAULT FALSE,
     server_generated BOOLEAN NOT NULL DEFAULT FALSE,
+    run_id INT REFERENCES match_runs(id), -- null for user generated matches
     week TIMESTAMP NOT NULL, 
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    PRIMARY KEY (user1_email, user2_email)
+    -- week is part of the key so a pair can appear again in a later week
+    PRIMARY KEY (user1_email, user2_email, week)
+);
+
+/*
+   outbox of user notifications, written by sqs-consumer in the same
+   transaction that makes a match mutual and delivered by its notifier
+   (see sqs-consumer/notifier). status is pending, sent, skipped (the user
+   turned off notif_pref), or failed. a dispatcher claims a pending row by
+   counting the attempt and moving next_attempt_at past its claim timeout,
+   sends it outside of any transaction, and then records the outcome; failed
+   sends are retried with exponential backoff until attempts runs out.
+*/
+
+CREATE TABLE notifications (
+    id SERIAL PRIMARY KEY,
+    email VARCHAR(50) REFERENCES users(email),
+    partner_email VARCHAR(50) REFERENCES users(email),
+    kind VARCHAR(30) NOT NULL,
+    week TIMESTAMP NOT NULL,
+    status VARCHAR(10) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    sent_at TIMESTAMP,
+    UNIQUE (email, partner_email, kind, week)
+);
+
+CREATE INDEX idx_notifications_pending ON notifications (next_attempt_at) WHERE status = 'pending';
+
+/*
+   why each generated pair was matched, from each side, computed by the match
+   generator at generation time (see match-generator/engine/explain.go).
+   explanation never holds answers or any question's exact share of the
+   distance, which together with a user's own answer would give away the
+   partner's. questions only holds low/medium/high levels, relative to the
+   pair's total answer distance.
+*/
+
+CREATE TABLE match_explanations (
+    run_id INT NOT NULL REFERENCES match_runs(id),
+    email VARCHAR(50) REFERENCES users(email),
+    partner_email VARCHAR(50) REFERENCES users(email),
+    explanation JSONB NOT NULL,
+    PRIMARY KEY (run_id, email, partner_email)
+);
+
+/*
+   users a user never wants to hear from again. a block works both ways: the
+   pair is never generated as a match, can't pick each other as a crush, and
+   is filtered out of each other's search results.
+*/
+
+CREATE TABLE blocks (
+    blocker_email VARCHAR(50) REFERENCES users(email),
+    blocked_email VARCHAR(50) REFERENCES users(email),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (blocker_email, blocked_email),
+    CHECK (blocker_email <> blocked_email)
+);
+
+CREATE INDEX idx_blocks_blocked ON blocks (blocked_email);
+
+/*
+   reports of a user's behavior for moderators to review. reason is one of
+   harassment, spam, fake_profile, inappropriate, underage, or other; status
+   is open until a moderator marks it reviewed or dismissed.
+*/
+
+CREATE TABLE reports (
+    id SERIAL PRIMARY KEY,
+    reporter_email VARCHAR(50) REFERENCES users(email),
+    reported_email VARCHAR(50) REFERENCES users(email),
+    reason VARCHAR(20) NOT NULL,
+    details VARCHAR(1000),
+    status VARCHAR(10) NOT NULL DEFAULT 'open',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_reports_open ON reports (created_at) WHERE status = 'open';
+
+/*
+   a user's processed profile photos, named by their upload id, in display
+   order. the photo at position 0 is the primary one. the bucket is private:
+   the user-service hands out presigned URLs of these keys to viewers allowed
+   to see the user. positions stay contiguous from 0 and are only unique at
+   commit, so a reorder can move every photo in one statement.
+*/
+
+CREATE TABLE user_photos (
+    id VARCHAR(32) PRIMARY KEY,
+    email VARCHAR(50) NOT NULL REFERENCES users(email) ON DELETE CASCADE,
+    s3_key VARCHAR(200) NOT NULL,
+    thumbnail_s3_key VARCHAR(200) NOT NULL,
+    position INT NOT NULL CHECK (position >= 0),
+    width INT NOT NULL,
+    height INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (email, position) DEFERRABLE INITIALLY DEFERRED
+);
+
+/*
+   scoring setup for the match generator; config holds the same JSON document as
+   SCORER_CONFIG_PATH (see match-generator/engine/config.go). the newest active
+   row is used, so weights can be tuned without redeploying the lambda.
+*/
+
+CREATE TABLE scorer_configs (
+    id SERIAL PRIMARY KEY,
+    config JSONB NOT NULL,
+    is_active BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+/*
+   emails whose search documents are out of date, queued by the
+   queue_search_change trigger below and drained in id order by the
+   user-service's indexer (see user-service/searchindex/indexer.go). only the
+   email is queued; the indexer rebuilds the document from the current row.
+*/
+
+CREATE TABLE search_changes (
+    id BIGSERIAL PRIMARY KEY,
+    email VARCHAR(50) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+/*
+   how far each consumer of search_changes has got; applied counts every
+   change it has drained.
+*/
+
+CREATE TABLE search_checkpoints (
+    name VARCHAR(30) PRIMARY KEY,
+    last_change_id BIGINT NOT NULL,
+    applied BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
 CREATE OR REPLACE FUNCTION create_answers_row()
@@ -141,8 +372,39 @@ BEFORE UPDATE ON matches
 FOR EACH ROW
 EXECUTE FUNCTION update_updated_at_column();
 
+-- only the columns in the search document (see user-service/searchindex/document.go)
+-- queue a change, so contact info, preference, and answer updates never touch the index
+CREATE OR REPLACE FUNCTION queue_search_change()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND
+        (OLD.email, OLD.is_active, OLD.name, OLD.residential_college, OLD.graduating_year,
+         OLD.interest_1, OLD.interest_2, OLD.interest_3, OLD.interest_4, OLD.interest_5)
+        IS NOT DISTINCT FROM
+        (NEW.email, NEW.is_active, NEW.name, NEW.residential_college, NEW.graduating_year,
+         NEW.interest_1, NEW.interest_2, NEW.interest_3, NEW.interest_4, NEW.interest_5)
+    THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        INSERT INTO search_changes (email) VALUES (OLD.email);
+    END IF;
+    IF TG_OP = 'INSERT' OR (TG_OP = 'UPDATE' AND NEW.email <> OLD.email) THEN
+        INSERT INTO search_changes (email) VALUES (NEW.email);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER queue_search_change
+AFTER INSERT OR UPDATE OR DELETE ON users
+FOR EACH ROW
+EXECUTE FUNCTION queue_search_change();
+
 CREATE INDEX idx_matches_week ON matches (week);
 
+CREATE INDEX idx_matches_run_id ON matches (run_id);
+
 
 
 
@@ -0,0 +1,124 @@
+// simulate runs the match generation pipeline without writing anything, either
+// against the database (same env vars as the lambda) or a JSON/CSV fixture:
+//
+//	go run ./cmd/simulate -fixture users.csv -config scorer.json
+//	go run ./cmd/simulate -week 2025-01-05
+//	go run ./cmd/simulate -run 42
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/sebaraj/crush/match-generator/engine"
+)
+
+func main() {
+	fixturePath := flag.String("fixture", "", "JSON or CSV fixture of users and answers; reads the database when empty")
+	configPath := flag.String("config", "", "scorer config JSON; defaults to the active scorer_configs row (or unweighted manhattan for fixtures)")
+	capacity := flag.Int("capacity", 3, "matches per user")
+	candidates := flag.Int("candidates", engine.DefaultCandidates, "candidates kept per user")
+	window := flag.Int("window", engine.DefaultWindow, "neighbours scanned per projection when generating candidates")
+	workers := flag.Int("workers", 0, "goroutines used to generate candidates; defaults to GOMAXPROCS")
+	historyWeeks := flag.Int("history-weeks", 0, "weeks of match history the rematch policy sees; defaults to every earlier week")
+	weekFlag := flag.String("week", "", "any date in the week to simulate (YYYY-MM-DD); defaults to this week")
+	seed := flag.Int64("seed", 0, "seed for tie-breaking and proposal order")
+	runID := flag.Int("run", 0, "reproduce a recorded match_runs row, using its week, seed, scorer config, and options")
+	flag.Parse()
+
+	if *runID != 0 {
+		if err := reproduce(*runID); err != nil {
+			log.Fatalf("Failed to reproduce run %d: %v", *runID, err)
+		}
+		return
+	}
+
+	week := engine.WeekOf(time.Now())
+	if *weekFlag != "" {
+		parsed, err := time.Parse("2006-01-02", *weekFlag)
+		if err != nil {
+			log.Fatalf("Invalid week %q: %v", *weekFlag, err)
+		}
+		week = engine.SundayOf(parsed)
+	}
+
+	var input *engine.Input
+	var err error
+	if *fixturePath != "" {
+		input, err = engine.LoadFixture(*fixturePath)
+		if err == nil && *configPath != "" {
+			input.Config, err = engine.LoadScorerConfigFile(*configPath)
+		}
+	} else {
+		input, err = loadFromDB(week, *historyWeeks, *configPath)
+	}
+	if err != nil {
+		log.Fatalf("Failed to load input: %v", err)
+	}
+
+	start := time.Now()
+	result, err := input.Generate(engine.Options{Capacity: *capacity, Candidates: *candidates, Window: *window, Workers: *workers, Seed: *seed})
+	if err != nil {
+		log.Fatalf("Failed to generate matches: %v", err)
+	}
+	log.Printf("Generated matches for %d users with seed %d in %s", len(input.Users), *seed, time.Since(start))
+
+	if err := engine.WriteReport(os.Stdout, input.Users, result); err != nil {
+		log.Fatalf("Failed to write report: %v", err)
+	}
+}
+
+// reproduce reruns a recorded run against the database and reports its matches.
+// every input comes from the run, so the other flags don't apply here.
+func reproduce(id int) error {
+	ctx := context.Background()
+	db := engine.ConnectToDB()
+	defer db.Close()
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	run, err := engine.LoadRun(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	input, err := engine.LoadInput(ctx, tx, run.Week, run.HistoryWeeks, "")
+	if err != nil {
+		return err
+	}
+	input.Config = run.Config
+	if hash := input.Hash(); hash != run.InputHash {
+		log.Printf("Users or match history changed since run %d (%d users then, %d now); matches may differ",
+			run.ID, run.UserCount, len(input.Users))
+	}
+
+	result, err := input.Generate(run.Options())
+	if err != nil {
+		return err
+	}
+	log.Printf("Reproduced run %d for week of %s with seed %d: %d pairs (recorded %d)",
+		run.ID, run.Week.Format("2006-01-02"), run.Seed, len(result.Pairs()), run.PairCount)
+	return engine.WriteReport(os.Stdout, input.Users, result)
+}
+
+// loadFromDB reads in a read-only transaction that is always rolled back
+func loadFromDB(week time.Time, historyWeeks int, configPath string) (*engine.Input, error) {
+	ctx := context.Background()
+	db := engine.ConnectToDB()
+	defer db.Close()
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return engine.LoadInput(ctx, tx, week, historyWeeks, configPath)
+}
@@ -0,0 +1,40 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+)
+
+// Blocks holds every pair where either user has blocked the other. blocked
+// pairs are never matched, whatever the rematch policy.
+type Blocks map[[2]string]bool
+
+func (b Blocks) Add(a, c string) {
+	b[pairKey(a, c)] = true
+}
+
+func (b Blocks) Blocked(a, c string) bool {
+	return b[pairKey(a, c)]
+}
+
+// loadBlocks reads the blocks table, in either direction
+func loadBlocks(ctx context.Context, q Querier) (Blocks, error) {
+	rows, err := q.QueryContext(ctx, `SELECT blocker_email, blocked_email FROM blocks`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query blocks: %w", err)
+	}
+	defer rows.Close()
+
+	blocks := Blocks{}
+	for rows.Next() {
+		var blocker, blocked string
+		if scanErr := rows.Scan(&blocker, &blocked); scanErr != nil {
+			return nil, fmt.Errorf("failed to scan block: %w", scanErr)
+		}
+		blocks.Add(blocker, blocked)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate blocks: %w", err)
+	}
+	return blocks, nil
+}
@@ -0,0 +1,264 @@
+package engine
+
+import (
+	"container/heap"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	DefaultCandidates = 30
+	DefaultWindow     = 32
+)
+
+// Candidate is another user and their distance from the list's owner
+type Candidate struct {
+	User int32
+	Dist float64
+	// seeded hash of the pair, used to break distance ties
+	tie uint64
+}
+
+// better orders candidates by distance, breaking ties by the seeded pair hash
+// so that the order never depends on row order or on how they were found
+func better(a, b Candidate) bool {
+	if a.Dist != b.Dist {
+		return a.Dist < b.Dist
+	}
+	if a.tie != b.tie {
+		return a.tie < b.tie
+	}
+	return a.User < b.User
+}
+
+// pairTie is symmetric, so both sides of a pair see the same tie-breaker
+func pairTie(a, b *User) uint64 {
+	return mix64(a.key ^ b.key)
+}
+
+// projections are fixed, mutually orthogonal directions in answer space.
+// users that are close in answer space are close along every projection, so
+// scanning a window around a user in each sorted projection finds most of
+// their nearest neighbours without comparing against everyone.
+var projections = [...][AnswerCount]float64{
+	{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+	{1, -1, 1, -1, 1, -1, 1, -1, 1, -1, 1, -1},
+	{1, 1, -1, -1, 1, 1, -1, -1, 1, 1, -1, -1},
+	{1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1},
+}
+
+const numProjections = len(projections)
+
+// bucket groups users with identical gender and partner_genders, so that
+// compatibility is decided once per pair of buckets instead of per pair of users
+type bucket struct {
+	gender, partnerGenders int
+	members                []int32
+	// sorted[p] is members ordered by (projection p, spread)
+	sorted [numProjections][]int32
+}
+
+type candidateIndex struct {
+	users      []User
+	buckets    []*bucket
+	bucketOf   []int
+	compatible [][]int
+	projected  [][numProjections]float64
+	// answers are small integers, so thousands of users share a projection
+	// value. ordering ties by a hash of the user spreads the window of every
+	// user in a tie over the whole run, instead of everyone scanning (and
+	// ranking highly) the same lowest-indexed users.
+	spread []uint64
+}
+
+// newCandidateIndex indexes members, which are indices into users
+func newCandidateIndex(users []User, members []int32) *candidateIndex {
+	idx := &candidateIndex{
+		users:     users,
+		bucketOf:  make([]int, len(users)),
+		projected: make([][numProjections]float64, len(users)),
+		spread:    make([]uint64, len(users)),
+	}
+
+	byKey := map[[2]int]int{}
+	for _, i := range members {
+		user := &users[i]
+		key := [2]int{user.Gender, user.PartnerGenders}
+		b, ok := byKey[key]
+		if !ok {
+			b = len(idx.buckets)
+			byKey[key] = b
+			idx.buckets = append(idx.buckets, &bucket{gender: user.Gender, partnerGenders: user.PartnerGenders})
+		}
+		idx.bucketOf[i] = b
+		idx.buckets[b].members = append(idx.buckets[b].members, i)
+
+		for p := range projections {
+			for k := 0; k < AnswerCount; k++ {
+				idx.projected[i][p] += projections[p][k] * float64(user.Answers[k])
+			}
+		}
+		idx.spread[i] = user.key
+	}
+
+	for _, bk := range idx.buckets {
+		for p := range projections {
+			sorted := append([]int32(nil), bk.members...)
+			sort.Slice(sorted, func(x, y int) bool {
+				return idx.before(p, int(sorted[x]), int(sorted[y]))
+			})
+			bk.sorted[p] = sorted
+		}
+	}
+
+	idx.compatible = make([][]int, len(idx.buckets))
+	for a, bucketA := range idx.buckets {
+		for b, bucketB := range idx.buckets {
+			if bucketA.gender&bucketB.partnerGenders != 0 && bucketB.gender&bucketA.partnerGenders != 0 {
+				idx.compatible[a] = append(idx.compatible[a], b)
+			}
+		}
+	}
+	return idx
+}
+
+// before orders users along projection p, breaking ties by spread
+func (idx *candidateIndex) before(p, x, y int) bool {
+	vx, vy := idx.projected[x][p], idx.projected[y][p]
+	if vx != vy {
+		return vx < vy
+	}
+	if idx.spread[x] != idx.spread[y] {
+		return idx.spread[x] < idx.spread[y]
+	}
+	return x < y
+}
+
+// mix64 is the splitmix64 finalizer
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// candidateScratch is reusable per-goroutine state for candidatesFor
+type candidateScratch struct {
+	seen  []int32
+	stamp int32
+	top   candidateHeap
+}
+
+func newCandidateScratch(n int) *candidateScratch {
+	return &candidateScratch{seen: make([]int32, n)}
+}
+
+// candidatesFor returns up to opts.Candidates of i's closest compatible users,
+// most preferred first, skipping anyone in known. i must be a member of idx.
+// buckets small enough to fit in the scan window are searched exhaustively.
+func (idx *candidateIndex) candidatesFor(i int, scorer Scorer, opts Options, scratch *candidateScratch, known ...[]Candidate) []Candidate {
+	scratch.stamp++
+	scratch.seen[i] = scratch.stamp
+	for _, list := range known {
+		for _, c := range list {
+			scratch.seen[c.User] = scratch.stamp
+		}
+	}
+	scratch.top = scratch.top[:0]
+	user := &idx.users[i]
+
+	consider := func(j int32) {
+		if scratch.seen[j] == scratch.stamp {
+			return
+		}
+		scratch.seen[j] = scratch.stamp
+		other := &idx.users[j]
+		if opts.excluded(user, other) {
+			return
+		}
+		c := Candidate{User: j, Dist: scorer.Score(user, other), tie: pairTie(user, other)}
+		if len(scratch.top) < opts.Candidates {
+			heap.Push(&scratch.top, c)
+		} else if better(c, scratch.top[0]) {
+			scratch.top[0] = c
+			heap.Fix(&scratch.top, 0)
+		}
+	}
+
+	for _, b := range idx.compatible[idx.bucketOf[i]] {
+		bk := idx.buckets[b]
+		if len(bk.members) <= 2*opts.Window {
+			for _, j := range bk.members {
+				consider(j)
+			}
+			continue
+		}
+		for p := range projections {
+			pos := sort.Search(len(bk.sorted[p]), func(n int) bool {
+				return !idx.before(p, int(bk.sorted[p][n]), i)
+			})
+			lo := max(0, pos-opts.Window)
+			hi := min(len(bk.sorted[p]), pos+opts.Window)
+			for _, j := range bk.sorted[p][lo:hi] {
+				consider(j)
+			}
+		}
+	}
+
+	candidates := make([]Candidate, len(scratch.top))
+	copy(candidates, scratch.top)
+	sort.Slice(candidates, func(x, y int) bool {
+		return better(candidates[x], candidates[y])
+	})
+	return candidates
+}
+
+// candidatesForAll fills lists[i] for every i in members, sharding the work
+// across opts.Workers goroutines. known(i) lists users to skip for i and is
+// only read. every list only depends on its own user, so the output is the
+// same whatever the worker count or scheduling.
+func (idx *candidateIndex) candidatesForAll(members []int32, scorer Scorer, opts Options, lists [][]Candidate, known func(i int) [][]Candidate) {
+	const chunk = 256
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < opts.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			scratch := newCandidateScratch(len(idx.users))
+			for {
+				start := int(next.Add(chunk)) - chunk
+				if start >= len(members) {
+					return
+				}
+				for _, i := range members[start:min(start+chunk, len(members))] {
+					lists[i] = idx.candidatesFor(int(i), scorer, opts, scratch, known(int(i))...)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func defaultWorkers() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// candidateHeap keeps the worst kept candidate on top
+type candidateHeap []Candidate
+
+func (h candidateHeap) Len() int           { return len(h) }
+func (h candidateHeap) Less(x, y int) bool { return better(h[y], h[x]) }
+func (h candidateHeap) Swap(x, y int)      { h[x], h[y] = h[y], h[x] }
+func (h *candidateHeap) Push(c any)        { *h = append(*h, c.(Candidate)) }
+
+func (h *candidateHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
@@ -0,0 +1,154 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ScorerConfig is the tunable scoring setup, stored either as a JSON file or
+// as the active row of the scorer_configs table. e.g.
+//
+//	{"scorers": [
+//	    {"name": "manhattan", "weight": 1, "question_weights": [2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1]},
+//	    {"name": "interests", "weight": 0.5},
+//	    {"name": "college", "weight": 0.1},
+//	    {"name": "elo", "weight": 0.2, "scale": 400}
+//	], "rematch": {"exclude": false, "penalty": 1, "half_life_weeks": 4}}
+type ScorerConfig struct {
+	Scorers []ScorerTerm `json:"scorers"`
+	// defaults to excluding every previously generated pair
+	Rematch *RematchPolicy `json:"rematch,omitempty"`
+}
+
+type ScorerTerm struct {
+	Name   string  `json:"name"`
+	Weight float64 `json:"weight"`
+	// only used by manhattan, euclidean, and cosine; defaults to all ones
+	QuestionWeights []float64 `json:"question_weights,omitempty"`
+	// only used by college
+	PreferDifferent bool `json:"prefer_different,omitempty"`
+	// only used by elo; the rating gap that scores 0.5, defaults to DefaultEloScale
+	Scale float64 `json:"scale,omitempty"`
+}
+
+// DefaultScorerConfig is an unweighted manhattan distance over the answers
+func DefaultScorerConfig() ScorerConfig {
+	return ScorerConfig{
+		Scorers: []ScorerTerm{{Name: "manhattan", Weight: 1}},
+	}
+}
+
+// Build turns the config into a Composite scorer
+func (c ScorerConfig) Build() (Scorer, error) {
+	if len(c.Scorers) == 0 {
+		return nil, errors.New("scorer config has no scorers")
+	}
+	composite := &Composite{}
+	for _, term := range c.Scorers {
+		if term.Weight < 0 {
+			return nil, fmt.Errorf("scorer %q has negative weight %v", term.Name, term.Weight)
+		}
+		scorer, err := term.build()
+		if err != nil {
+			return nil, err
+		}
+		composite.Terms = append(composite.Terms, WeightedScorer{Scorer: scorer, Weight: term.Weight})
+	}
+	return composite, nil
+}
+
+// RematchPolicy returns the configured policy, or the default if unset
+func (c ScorerConfig) RematchPolicy() (RematchPolicy, error) {
+	if c.Rematch == nil {
+		return DefaultRematchPolicy(), nil
+	}
+	if c.Rematch.Penalty < 0 || c.Rematch.HalfLifeWeeks < 0 {
+		return RematchPolicy{}, errors.New("rematch penalty and half life must not be negative")
+	}
+	return *c.Rematch, nil
+}
+
+func (t ScorerTerm) build() (Scorer, error) {
+	weights, err := t.questionWeights()
+	if err != nil {
+		return nil, err
+	}
+	switch t.Name {
+	case "manhattan":
+		return &Manhattan{Weights: weights}, nil
+	case "euclidean":
+		return &Euclidean{Weights: weights}, nil
+	case "cosine":
+		return &Cosine{Weights: weights}, nil
+	case "interests":
+		return InterestJaccard{}, nil
+	case "college":
+		return CollegeAffinity{PreferDifferent: t.PreferDifferent}, nil
+	case "elo":
+		if t.Scale < 0 {
+			return nil, fmt.Errorf("scorer %q has negative scale %v", t.Name, t.Scale)
+		}
+		scale := t.Scale
+		if scale == 0 {
+			scale = DefaultEloScale
+		}
+		return EloProximity{Scale: scale}, nil
+	default:
+		return nil, fmt.Errorf("unknown scorer %q", t.Name)
+	}
+}
+
+func (t ScorerTerm) questionWeights() ([AnswerCount]float64, error) {
+	if len(t.QuestionWeights) == 0 {
+		return unitWeights(), nil
+	}
+	var weights [AnswerCount]float64
+	if len(t.QuestionWeights) != AnswerCount {
+		return weights, fmt.Errorf("scorer %q needs %d question weights, got %d",
+			t.Name, AnswerCount, len(t.QuestionWeights))
+	}
+	for k, w := range t.QuestionWeights {
+		if w < 0 {
+			return weights, fmt.Errorf("scorer %q has negative weight for question%d", t.Name, k+1)
+		}
+		weights[k] = w
+	}
+	return weights, nil
+}
+
+// LoadScorerConfigFile reads a ScorerConfig from a JSON file, such as the one
+// SCORER_CONFIG_PATH or simulate -config points at
+func LoadScorerConfigFile(path string) (ScorerConfig, error) {
+	var config ScorerConfig
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("failed to read scorer config: %w", err)
+	}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return config, fmt.Errorf("failed to parse scorer config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// LoadScorerConfigDB reads the newest active row of scorer_configs. ok is
+// false when no config is active.
+func LoadScorerConfigDB(ctx context.Context, q Querier) (config ScorerConfig, ok bool, err error) {
+	query := `
+        SELECT config FROM scorer_configs WHERE is_active = true ORDER BY created_at DESC LIMIT 1
+    `
+	var raw []byte
+	if err := q.QueryRowContext(ctx, query).Scan(&raw); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return config, false, nil
+		}
+		return config, false, fmt.Errorf("failed to query scorer config: %w", err)
+	}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return config, false, fmt.Errorf("failed to parse scorer config: %w", err)
+	}
+	return config, true, nil
+}
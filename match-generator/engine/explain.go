@@ -0,0 +1,164 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// levels of a question's part in a pair's distance, relative to an even split
+// of the answer based distance across questions. exact parts would let either
+// user work out the partner's answer from their own, so only levels are kept.
+const (
+	ContributionLow    = "low"
+	ContributionMedium = "medium"
+	ContributionHigh   = "high"
+)
+
+// Explanation breaks a pair's distance down for the user, without revealing
+// the partner's answers. Answers and Terms add up to Distance.
+type Explanation struct {
+	Distance float64 `json:"distance"`
+	// 1-based position of the partner in the user's own candidate list, or 0
+	// when the partner proposed from their own list
+	Rank int `json:"rank"`
+	// length of the user's candidate list
+	Candidates int `json:"candidates"`
+	// share of Distance from every answer based scorer
+	Answers float64 `json:"answers"`
+	// Questions[k] is the level of question k+1's part in Answers
+	Questions [AnswerCount]string `json:"questions"`
+	// share of Distance from each scorer that isn't answer based, by Name,
+	// plus "rematch" for any penalty from earlier weeks
+	Terms           map[string]float64 `json:"terms"`
+	SharedInterests []string           `json:"shared_interests"`
+}
+
+// Explain explains users[j] as a partner of users[i]
+func (r *Result) Explain(users []User, i, j int) Explanation {
+	e := Explanation{
+		Terms:           map[string]float64{},
+		SharedInterests: SharedInterests(&users[i], &users[j]),
+		Rank:            r.Rank(i, j) + 1,
+		Candidates:      len(r.Preferences[i]),
+	}
+	if e.SharedInterests == nil {
+		e.SharedInterests = []string{}
+	}
+	var questions [AnswerCount]float64
+	if r.Scorer != nil {
+		e.Distance = r.Scorer.Score(&users[i], &users[j])
+		explain(r.Scorer, &users[i], &users[j], 1, &questions, e.Terms)
+	}
+	for _, part := range questions {
+		e.Answers += part
+	}
+	even := e.Answers / AnswerCount
+	for k, part := range questions {
+		switch {
+		case part > 1.5*even:
+			e.Questions[k] = ContributionHigh
+		case part < 0.5*even || even == 0:
+			e.Questions[k] = ContributionLow
+		default:
+			e.Questions[k] = ContributionMedium
+		}
+	}
+	return e
+}
+
+// explain adds scale times s's breakdown of the distance between a and b to
+// each question's part and to terms
+func explain(s Scorer, a, b *User, scale float64, questions *[AnswerCount]float64, terms map[string]float64) {
+	switch s := s.(type) {
+	case *Composite:
+		weights := 0.0
+		for _, term := range s.Terms {
+			weights += term.Weight
+		}
+		for _, term := range s.Terms {
+			if term.Weight != 0 {
+				explain(term.Scorer, a, b, scale*term.Weight/weights, questions, terms)
+			}
+		}
+	case *historyScorer:
+		explain(s.base, a, b, scale, questions, terms)
+		if weeksAgo, ok := s.history.WeeksAgo(a.Email, b.Email); ok {
+			terms["rematch"] += scale * s.policy.penalty(weeksAgo)
+		}
+	case *Manhattan:
+		maxDist := 0.0
+		for k := 0; k < AnswerCount; k++ {
+			maxDist += s.Weights[k] * (maxAnswer - minAnswer)
+		}
+		if maxDist == 0 {
+			return
+		}
+		for k := 0; k < AnswerCount; k++ {
+			diff := math.Abs(float64(a.Answers[k] - b.Answers[k]))
+			questions[k] += scale * s.Weights[k] * diff / maxDist
+		}
+	case *Euclidean:
+		// the root isn't additive, so split the distance in proportion to
+		// each question's share of the squared distance
+		var parts [AnswerCount]float64
+		total := 0.0
+		for k := 0; k < AnswerCount; k++ {
+			diff := float64(a.Answers[k] - b.Answers[k])
+			parts[k] = s.Weights[k] * diff * diff
+			total += parts[k]
+		}
+		if total == 0 {
+			return
+		}
+		dist := s.Score(a, b)
+		for k := range parts {
+			questions[k] += scale * dist * parts[k] / total
+		}
+	case *Cosine:
+		// for unit vectors u and v, (1 - u·v) / 2 = |u - v|² / 4, which is a
+		// sum over questions
+		const mid = float64(minAnswer+maxAnswer) / 2
+		normA, normB := 0.0, 0.0
+		for k := 0; k < AnswerCount; k++ {
+			x := float64(a.Answers[k]) - mid
+			y := float64(b.Answers[k]) - mid
+			normA += s.Weights[k] * x * x
+			normB += s.Weights[k] * y * y
+		}
+		if normA == 0 || normB == 0 {
+			terms[s.Name()] += scale * s.Score(a, b)
+			return
+		}
+		normA, normB = math.Sqrt(normA), math.Sqrt(normB)
+		for k := 0; k < AnswerCount; k++ {
+			diff := (float64(a.Answers[k])-mid)/normA - (float64(b.Answers[k])-mid)/normB
+			questions[k] += scale * s.Weights[k] * diff * diff / 4
+		}
+	default:
+		terms[s.Name()] += scale * s.Score(a, b)
+	}
+}
+
+// InsertExplanations stores an explanation for both sides of every pair of a
+// recorded run, so they can be served after users change their answers
+func InsertExplanations(ctx context.Context, q Querier, runID int, users []User, result *Result) error {
+	insertQuery := `
+        INSERT INTO match_explanations (run_id, email, partner_email, explanation)
+        VALUES ($1, $2, $3, $4)
+    `
+	for _, pair := range result.Pairs() {
+		for _, side := range [2][2]int{{pair.A, pair.B}, {pair.B, pair.A}} {
+			i, j := side[0], side[1]
+			explanation, err := json.Marshal(result.Explain(users, i, j))
+			if err != nil {
+				return fmt.Errorf("failed to encode explanation: %w", err)
+			}
+			if _, err := q.ExecContext(ctx, insertQuery, runID, users[i].Email, users[j].Email, explanation); err != nil {
+				return fmt.Errorf("failed to insert explanation (%s, %s): %w", users[i].Email, users[j].Email, err)
+			}
+		}
+	}
+	return nil
+}
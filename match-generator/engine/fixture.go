@@ -0,0 +1,154 @@
+package engine
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// fixture is the JSON layout accepted by LoadFixture
+type fixture struct {
+	Users []struct {
+		Email              string   `json:"email"`
+		Gender             int      `json:"gender"`
+		PartnerGenders     int      `json:"partner_genders"`
+		ResidentialCollege string   `json:"residential_college"`
+		Interests          []string `json:"interests"`
+		Answers            []int    `json:"answers"`
+		Elo                int      `json:"elo"`
+	} `json:"users"`
+	History []struct {
+		User1Email string `json:"user1_email"`
+		User2Email string `json:"user2_email"`
+		WeeksAgo   int    `json:"weeks_ago"`
+	} `json:"history"`
+	Blocks []struct {
+		BlockerEmail string `json:"blocker_email"`
+		BlockedEmail string `json:"blocked_email"`
+	} `json:"blocks"`
+}
+
+// LoadFixture reads users (and for JSON, match history and blocks) from a .json or .csv
+// file instead of the database. the CSV header uses the users/answers column
+// names: email, gender, partner_genders, residential_college, interest_1..5,
+// question1..12, elo. missing columns take their schema defaults.
+func LoadFixture(path string) (*Input, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open fixture: %w", err)
+	}
+	defer file.Close()
+
+	input := &Input{Config: DefaultScorerConfig(), History: History{}, Blocks: Blocks{}}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = readJSONFixture(file, input)
+	case ".csv":
+		err = readCSVFixture(file, input)
+	default:
+		err = fmt.Errorf("unsupported fixture type %q", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load fixture %s: %w", path, err)
+	}
+	return input, nil
+}
+
+func readJSONFixture(r io.Reader, input *Input) error {
+	var f fixture
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return err
+	}
+	for _, u := range f.Users {
+		if len(u.Answers) > AnswerCount {
+			return fmt.Errorf("user %s has %d answers, expected at most %d", u.Email, len(u.Answers), AnswerCount)
+		}
+		user := User{
+			Email:              u.Email,
+			Gender:             u.Gender,
+			PartnerGenders:     u.PartnerGenders,
+			ResidentialCollege: u.ResidentialCollege,
+			Interests:          u.Interests,
+			Elo:                u.Elo,
+		}
+		for k := range user.Answers {
+			user.Answers[k] = defaultAnswer
+		}
+		copy(user.Answers[:], u.Answers)
+		input.Users = append(input.Users, user)
+	}
+	for _, h := range f.History {
+		input.History.Add(h.User1Email, h.User2Email, h.WeeksAgo)
+	}
+	for _, b := range f.Blocks {
+		input.Blocks.Add(b.BlockerEmail, b.BlockedEmail)
+	}
+	return nil
+}
+
+func readCSVFixture(r io.Reader, input *Input) error {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	columns := map[string]int{}
+	for idx, name := range records[0] {
+		columns[strings.TrimSpace(name)] = idx
+	}
+	if _, ok := columns["email"]; !ok {
+		return fmt.Errorf("missing email column")
+	}
+	field := func(record []string, name string) string {
+		if idx, ok := columns[name]; ok && idx < len(record) {
+			return strings.TrimSpace(record[idx])
+		}
+		return ""
+	}
+	number := func(record []string, name string, defaultVal int) (int, error) {
+		value := field(record, name)
+		if value == "" {
+			return defaultVal, nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s %q", name, value)
+		}
+		return n, nil
+	}
+
+	for line, record := range records[1:] {
+		user := User{
+			Email:              field(record, "email"),
+			ResidentialCollege: field(record, "residential_college"),
+		}
+		if user.Gender, err = number(record, "gender", 0); err != nil {
+			return fmt.Errorf("line %d: %w", line+2, err)
+		}
+		if user.PartnerGenders, err = number(record, "partner_genders", 0); err != nil {
+			return fmt.Errorf("line %d: %w", line+2, err)
+		}
+		for k := 1; k <= InterestCount; k++ {
+			if interest := field(record, fmt.Sprintf("interest_%d", k)); interest != "" {
+				user.Interests = append(user.Interests, interest)
+			}
+		}
+		for k := range user.Answers {
+			if user.Answers[k], err = number(record, fmt.Sprintf("question%d", k+1), defaultAnswer); err != nil {
+				return fmt.Errorf("line %d: %w", line+2, err)
+			}
+		}
+		if user.Elo, err = number(record, "elo", 0); err != nil {
+			return fmt.Errorf("line %d: %w", line+2, err)
+		}
+		input.Users = append(input.Users, user)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"math"
+)
+
+// pairKey orders the emails so (a, b) and (b, a) share a key
+func pairKey(a, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+// History records how many weeks ago each pair was last server generated
+type History map[[2]string]int
+
+// Add records a past match, keeping the most recent one per pair
+func (h History) Add(a, b string, weeksAgo int) {
+	key := pairKey(a, b)
+	if prev, ok := h[key]; ok && prev <= weeksAgo {
+		return
+	}
+	h[key] = weeksAgo
+}
+
+func (h History) WeeksAgo(a, b string) (int, bool) {
+	weeksAgo, ok := h[pairKey(a, b)]
+	return weeksAgo, ok
+}
+
+// RematchPolicy controls how pairs matched in earlier weeks are treated. with
+// Exclude they are never offered again; otherwise Penalty is added to their
+// distance, halving every HalfLifeWeeks (no decay when HalfLifeWeeks is 0).
+type RematchPolicy struct {
+	Exclude       bool    `json:"exclude"`
+	Penalty       float64 `json:"penalty,omitempty"`
+	HalfLifeWeeks float64 `json:"half_life_weeks,omitempty"`
+}
+
+func DefaultRematchPolicy() RematchPolicy {
+	return RematchPolicy{Exclude: true}
+}
+
+// penalty for a pair last matched weeksAgo weeks ago (1 = last week)
+func (p RematchPolicy) penalty(weeksAgo int) float64 {
+	if p.HalfLifeWeeks <= 0 || weeksAgo <= 1 {
+		return p.Penalty
+	}
+	return p.Penalty * math.Pow(0.5, float64(weeksAgo-1)/p.HalfLifeWeeks)
+}
+
+// WithHistory applies policy on top of scorer. the returned exclude func
+// reports pairs that must not be matched at all.
+func WithHistory(scorer Scorer, history History, policy RematchPolicy) (Scorer, func(a, b *User) bool) {
+	exclude := func(a, b *User) bool {
+		_, seen := history.WeeksAgo(a.Email, b.Email)
+		return seen && policy.Exclude
+	}
+	if policy.Exclude || policy.Penalty == 0 || len(history) == 0 {
+		return scorer, exclude
+	}
+	return &historyScorer{base: scorer, history: history, policy: policy}, exclude
+}
+
+type historyScorer struct {
+	base    Scorer
+	history History
+	policy  RematchPolicy
+}
+
+func (h *historyScorer) Name() string { return h.base.Name() + "+history" }
+
+func (h *historyScorer) Score(a, b *User) float64 {
+	score := h.base.Score(a, b)
+	if weeksAgo, ok := h.history.WeeksAgo(a.Email, b.Email); ok {
+		score += h.policy.penalty(weeksAgo)
+	}
+	return score
+}
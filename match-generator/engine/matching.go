@@ -0,0 +1,258 @@
+package engine
+
+import (
+	"cmp"
+	"slices"
+	"sort"
+)
+
+// Result holds the tentative partners of every user after matching.
+// Candidate.User values are indices into the users slice passed to GenerateMatches.
+type Result struct {
+	Partners [][]Candidate
+	// Preferences[i] is i's candidate list, most preferred first
+	Preferences [][]Candidate
+	// the scorer that ranked the candidates
+	Scorer Scorer
+}
+
+// Pair is a generated match between users[A] and users[B], with A < B
+type Pair struct {
+	A, B int
+}
+
+// Pairs returns each match once, ordered by (A, B)
+func (r *Result) Pairs() []Pair {
+	var pairs []Pair
+	for i, partners := range r.Partners {
+		for _, partner := range partners {
+			if i < int(partner.User) {
+				pairs = append(pairs, Pair{A: i, B: int(partner.User)})
+			}
+		}
+	}
+	sort.Slice(pairs, func(x, y int) bool {
+		if pairs[x].A != pairs[y].A {
+			return pairs[x].A < pairs[y].A
+		}
+		return pairs[x].B < pairs[y].B
+	})
+	return pairs
+}
+
+// Rank returns j's 0-based position in i's preference list, or -1 if j is
+// not among i's candidates (j proposed to i from j's own list)
+func (r *Result) Rank(i, j int) int {
+	for pos, candidate := range r.Preferences[i] {
+		if int(candidate.User) == j {
+			return pos
+		}
+	}
+	return -1
+}
+
+// Options tunes a GenerateMatches run
+type Options struct {
+	// max partners per user
+	Capacity int
+	// max candidates kept per user; defaults to DefaultCandidates
+	Candidates int
+	// users scanned on each side of a user along every projection of every
+	// compatible bucket; defaults to DefaultWindow
+	Window int
+	// goroutines used to generate candidates; defaults to GOMAXPROCS
+	Workers int
+	// breaks distance ties and orders proposals. the same users, scorer, and
+	// seed always produce the same matches, whatever order users is in.
+	Seed int64
+	// pairs for which Exclude returns true are never matched; may be nil
+	Exclude func(a, b *User) bool
+}
+
+func (o Options) excluded(a, b *User) bool {
+	return o.Exclude != nil && o.Exclude(a, b)
+}
+
+// WithDefaults fills in the options left unset, as GenerateMatches does. runs
+// record the result so a reproduction doesn't depend on the machine's defaults.
+func (o Options) WithDefaults() Options {
+	if o.Candidates <= 0 {
+		o.Candidates = DefaultCandidates
+	}
+	if o.Window <= 0 {
+		o.Window = DefaultWindow
+	}
+	if o.Workers <= 0 {
+		o.Workers = defaultWorkers()
+	}
+	return o
+}
+
+// GenerateMatches runs the top-n Gale-Shapley variant, giving every user up to
+// opts.Capacity partners. each user only proposes to their opts.Candidates
+// closest compatible users, so memory grows with n * Candidates rather than n².
+// candidates are scored concurrently, so scorer must be safe for concurrent use.
+func GenerateMatches(users []User, scorer Scorer, opts Options) *Result {
+	opts = opts.WithDefaults()
+	freq := len(users)
+	capacity := opts.Capacity
+	prepareUsers(users, opts.Seed)
+
+	everyone := make([]int32, freq)
+	for i := range everyone {
+		everyone[i] = int32(i)
+	}
+	// users propose in seeded order rather than input order
+	order := slices.Clone(everyone)
+	slices.SortFunc(order, func(x, y int32) int {
+		return cmp.Or(cmp.Compare(users[x].key, users[y].key), cmp.Compare(users[x].Email, users[y].Email))
+	})
+	idx := newCandidateIndex(users, everyone)
+	preferenceLists := make([][]Candidate, freq)
+	idx.candidatesForAll(everyone, scorer, opts, preferenceLists, func(int) [][]Candidate { return nil })
+
+	// Gale-Shapley variant for top n matches
+	// Data structures for the matching algorithm:
+	//  - nextChoice[i] = index into preferenceLists[i], telling whom i will propose to next
+	//  - matchedWith[i] = users that have tentatively accepted i (size <= capacity),
+	//    along with their distance from i
+	// scorers are symmetric, so the acceptor compares proposers by the distance
+	// carried on the proposal rather than by a rank matrix. this also lets them
+	// weigh proposers that aren't on their own (truncated) list.
+	nextChoice := make([]int, freq)
+	matchedWith := make([][]Candidate, freq)
+	for i := 0; i < freq; i++ {
+		matchedWith[i] = make([]Candidate, 0, capacity)
+	}
+
+	// Function to find the "worst" matched partner for user u
+	// returns that partner's position in matchedWith[u]
+	worstPartner := func(u int) int {
+		worst := 0
+		for pos, p := range matchedWith[u] {
+			if better(matchedWith[u][worst], p) {
+				worst = pos
+			}
+		}
+		return worst
+	}
+
+	propose := func() {
+		for {
+			changed := false
+
+			// Try each user that still has proposals left
+			for _, proposer := range order {
+				i := int(proposer)
+				// If i has exhausted all possible proposals, skip
+				if nextChoice[i] >= len(preferenceLists[i]) {
+					continue
+				}
+
+				// Propose to the next candidate on i's preference list. a user at
+				// capacity still proposes to anyone they prefer over their worst
+				// partner; otherwise whether a mutually preferred pair forms would
+				// depend on which of them happened to propose first.
+				proposal := preferenceLists[i][nextChoice[i]]
+				full := len(matchedWith[i]) >= capacity
+				if full && (capacity <= 0 || !better(proposal, matchedWith[i][worstPartner(i)])) {
+					continue
+				}
+				proposeTo := int(proposal.User)
+				nextChoice[i]++
+				changed = true
+
+				// proposeTo already proposed to i and was accepted; don't pair them twice
+				if indexOf(matchedWith[i], proposeTo) >= 0 {
+					continue
+				}
+
+				mine := Candidate{User: int32(i), Dist: proposal.Dist, tie: proposal.tie}
+				if len(matchedWith[proposeTo]) < capacity {
+					// If proposeTo is not at capacity, they accept i
+					matchedWith[proposeTo] = append(matchedWith[proposeTo], mine)
+				} else if worst := worstPartner(proposeTo); better(mine, matchedWith[proposeTo][worst]) {
+					// proposeTo is at capacity but prefers i => drops worstP, accepts i
+					worstP := int(matchedWith[proposeTo][worst].User)
+					matchedWith[proposeTo][worst] = mine
+					matchedWith[worstP] = removeOne(matchedWith[worstP], proposeTo)
+				} else {
+					// proposeTo rejects i => do nothing
+					continue
+				}
+
+				// a full proposer makes room by dropping their own worst partner
+				if full {
+					worst := worstPartner(i)
+					worstP := int(matchedWith[i][worst].User)
+					matchedWith[i][worst] = proposal
+					matchedWith[worstP] = removeOne(matchedWith[worstP], i)
+				} else {
+					matchedWith[i] = append(matchedWith[i], proposal)
+				}
+			}
+
+			if !changed {
+				// No change => stable
+				break
+			}
+		}
+	}
+	propose()
+
+	// popular users fill up fast, so users whose whole candidate list said no
+	// may still have room. give them a fresh list drawn only from the users
+	// that still have room, and let them propose again.
+	prevOpen := freq + 1
+	for round := 0; round < refillRounds; round++ {
+		var open []int32
+		for i := 0; i < freq; i++ {
+			if len(matchedWith[i]) < capacity {
+				open = append(open, int32(i))
+			}
+		}
+		// stop once a round makes no progress; the rest have no compatible users left with room
+		if len(open) < 2 || len(open) == prevOpen {
+			break
+		}
+		prevOpen = len(open)
+
+		refill := newCandidateIndex(users, open)
+		extra := make([][]Candidate, freq)
+		refill.candidatesForAll(open, scorer, opts, extra, func(i int) [][]Candidate {
+			return [][]Candidate{preferenceLists[i], matchedWith[i]}
+		})
+		added := false
+		for _, i := range open {
+			preferenceLists[i] = append(preferenceLists[i], extra[i]...)
+			added = added || len(extra[i]) > 0
+		}
+		if !added {
+			break
+		}
+		propose()
+	}
+
+	return &Result{Partners: matchedWith, Preferences: preferenceLists, Scorer: scorer}
+}
+
+// rounds of fresh candidates for users left with room after proposing to their whole list
+const refillRounds = 5
+
+func indexOf(s []Candidate, x int) int {
+	for i, c := range s {
+		if int(c.User) == x {
+			return i
+		}
+	}
+	return -1
+}
+
+func removeOne(s []Candidate, x int) []Candidate {
+	n := len(s)
+	if i := indexOf(s, x); i >= 0 {
+		s[i], s[n-1] = s[n-1], s[i]
+		return s[:n-1]
+	}
+	return s
+}
@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Stats summarizes a match run
+type Stats struct {
+	Users int
+	Pairs int
+	// fraction of users with at least one partner
+	MatchRate float64
+	// mean 1-based rank of each partner in the user's own preference list
+	AverageRank float64
+	// partners that were accepted from outside the user's own candidate list
+	// and so have no rank
+	OutsideCandidates int
+	Unmatched         []string
+}
+
+func Summarize(users []User, result *Result) Stats {
+	stats := Stats{Users: len(users), Pairs: len(result.Pairs())}
+	matched, rankSum, rankCount := 0, 0, 0
+	for i, partners := range result.Partners {
+		if len(partners) == 0 {
+			stats.Unmatched = append(stats.Unmatched, users[i].Email)
+			continue
+		}
+		matched++
+		for _, partner := range partners {
+			rank := result.Rank(i, int(partner.User))
+			if rank < 0 {
+				stats.OutsideCandidates++
+				continue
+			}
+			rankSum += rank + 1
+			rankCount++
+		}
+	}
+	if len(users) > 0 {
+		stats.MatchRate = float64(matched) / float64(len(users))
+	}
+	if rankCount > 0 {
+		stats.AverageRank = float64(rankSum) / float64(rankCount)
+	}
+	sort.Strings(stats.Unmatched)
+	return stats
+}
+
+// WriteReport prints the pairs, each user's partners with the rank they
+// gave them, and the aggregate stats
+func WriteReport(w io.Writer, users []User, result *Result) error {
+	var err error
+	printf := func(format string, args ...any) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+
+	pairs := result.Pairs()
+	printf("pairs (%d):\n", len(pairs))
+	for _, pair := range pairs {
+		printf("  %s <-> %s\n", users[pair.A].Email, users[pair.B].Email)
+	}
+
+	printf("\nranks (partner: rank in own list, - if not a candidate / candidates):\n")
+	for i, partners := range result.Partners {
+		printf("  %s:", users[i].Email)
+		sorted := append([]Candidate(nil), partners...)
+		sort.Slice(sorted, func(x, y int) bool {
+			return better(sorted[x], sorted[y])
+		})
+		for _, partner := range sorted {
+			if rank := result.Rank(i, int(partner.User)); rank >= 0 {
+				printf(" %s #%d", users[partner.User].Email, rank+1)
+			} else {
+				printf(" %s #-", users[partner.User].Email)
+			}
+		}
+		printf(" / %d\n", len(result.Preferences[i]))
+	}
+
+	stats := Summarize(users, result)
+	printf("\nusers: %d\n", stats.Users)
+	printf("pairs: %d\n", stats.Pairs)
+	printf("match rate: %.2f%%\n", stats.MatchRate*100)
+	printf("average rank: %.2f\n", stats.AverageRank)
+	printf("partners from outside own candidates: %d\n", stats.OutsideCandidates)
+	printf("unmatched (%d):\n", len(stats.Unmatched))
+	for _, email := range stats.Unmatched {
+		printf("  %s\n", email)
+	}
+	return err
+}
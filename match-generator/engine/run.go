@@ -0,0 +1,130 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Run is a row of match_runs. the week's users and every input to Generate
+// (seed, config, options, and history window) reproduce its matches exactly;
+// InputHash tells whether the users or history have changed since.
+type Run struct {
+	ID     int
+	Week   time.Time
+	Seed   int64
+	Config ScorerConfig
+	// Options with defaults applied, less Seed and Exclude
+	Capacity   int
+	Candidates int
+	Window     int
+	Workers    int
+	// weeks of match history loaded before Week; 0 for all of it
+	HistoryWeeks int
+	UserCount    int
+	PairCount    int
+	InputHash    string
+	StartedAt    time.Time
+	FinishedAt   time.Time
+}
+
+// Options returns the options the run generated its matches with
+func (r *Run) Options() Options {
+	return Options{Capacity: r.Capacity, Candidates: r.Candidates, Window: r.Window, Workers: r.Workers, Seed: r.Seed}
+}
+
+// NewSeed picks a seed for a run that wasn't given one
+func NewSeed() int64 {
+	return rand.Int64()
+}
+
+// InsertRun records run and sets run.ID
+func InsertRun(ctx context.Context, q Querier, run *Run) error {
+	config, err := json.Marshal(run.Config)
+	if err != nil {
+		return fmt.Errorf("failed to encode scorer config: %w", err)
+	}
+	insertQuery := `
+        INSERT INTO match_runs (week, seed, scorer_config, capacity, candidates, scan_window, workers,
+                                history_weeks, user_count, pair_count, input_hash, started_at, finished_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+        RETURNING id
+    `
+	err = q.QueryRowContext(ctx, insertQuery, run.Week, run.Seed, config, run.Capacity, run.Candidates,
+		run.Window, run.Workers, run.HistoryWeeks, run.UserCount, run.PairCount, run.InputHash,
+		run.StartedAt, run.FinishedAt).Scan(&run.ID)
+	if err != nil {
+		return fmt.Errorf("failed to insert match run: %w", err)
+	}
+	return nil
+}
+
+// LoadRun reads a recorded run by id
+func LoadRun(ctx context.Context, q Querier, id int) (*Run, error) {
+	selectQuery := `
+        SELECT id, week, seed, scorer_config, capacity, candidates, scan_window, workers, history_weeks,
+               user_count, pair_count, input_hash, started_at, finished_at
+          FROM match_runs
+         WHERE id = $1
+    `
+	run := &Run{}
+	var config []byte
+	err := q.QueryRowContext(ctx, selectQuery, id).Scan(&run.ID, &run.Week, &run.Seed, &config,
+		&run.Capacity, &run.Candidates, &run.Window, &run.Workers, &run.HistoryWeeks,
+		&run.UserCount, &run.PairCount, &run.InputHash, &run.StartedAt, &run.FinishedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("match run %d not found", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query match run %d: %w", id, err)
+	}
+	if err := json.Unmarshal(config, &run.Config); err != nil {
+		return nil, fmt.Errorf("failed to parse scorer config of match run %d: %w", id, err)
+	}
+	return run, nil
+}
+
+// Hash fingerprints the users, history, and blocks, independent of row order, so a
+// reproduction can check it is matching the same input as the recorded run
+func (in *Input) Hash() string {
+	users := make([]*User, len(in.Users))
+	for i := range in.Users {
+		users[i] = &in.Users[i]
+	}
+	slices.SortFunc(users, func(a, b *User) int { return strings.Compare(a.Email, b.Email) })
+
+	h := sha256.New()
+	for _, user := range users {
+		fmt.Fprintf(h, "%s|%d|%d|%s|%s|%v|%d\n", user.Email, user.Gender, user.PartnerGenders,
+			user.ResidentialCollege, strings.Join(user.Interests, ","), user.Answers, user.Elo)
+	}
+	pairs := make([][2]string, 0, len(in.History))
+	for pair := range in.History {
+		pairs = append(pairs, pair)
+	}
+	slices.SortFunc(pairs, func(a, b [2]string) int {
+		return strings.Compare(a[0]+"\x00"+a[1], b[0]+"\x00"+b[1])
+	})
+	for _, pair := range pairs {
+		fmt.Fprintf(h, "%s|%s|%d\n", pair[0], pair[1], in.History[pair])
+	}
+	blocked := make([][2]string, 0, len(in.Blocks))
+	for pair := range in.Blocks {
+		blocked = append(blocked, pair)
+	}
+	slices.SortFunc(blocked, func(a, b [2]string) int {
+		return strings.Compare(a[0]+"\x00"+a[1], b[0]+"\x00"+b[1])
+	})
+	for _, pair := range blocked {
+		fmt.Fprintf(h, "block|%s|%s\n", pair[0], pair[1])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
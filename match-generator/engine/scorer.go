@@ -0,0 +1,232 @@
+package engine
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Scorer computes a distance between two users. lower is more compatible.
+// every built-in scorer is symmetric and normalized to [0, 1] so that they
+// can be mixed by a Composite without one term drowning out the others.
+// Score is called from several goroutines at once and must not mutate state.
+type Scorer interface {
+	Name() string
+	Score(a, b *User) float64
+}
+
+// unitWeights returns a weight of 1 for every question
+func unitWeights() [AnswerCount]float64 {
+	var w [AnswerCount]float64
+	for k := range w {
+		w[k] = 1
+	}
+	return w
+}
+
+// Manhattan is the weighted L1 distance over the answers vectors
+type Manhattan struct {
+	Weights [AnswerCount]float64
+}
+
+func (m *Manhattan) Name() string { return "manhattan" }
+
+func (m *Manhattan) Score(a, b *User) float64 {
+	dist, maxDist := 0.0, 0.0
+	for k := 0; k < AnswerCount; k++ {
+		diff := math.Abs(float64(a.Answers[k] - b.Answers[k]))
+		dist += m.Weights[k] * diff
+		maxDist += m.Weights[k] * (maxAnswer - minAnswer)
+	}
+	if maxDist == 0 {
+		return 0
+	}
+	return dist / maxDist
+}
+
+// Euclidean is the weighted L2 distance over the answers vectors
+type Euclidean struct {
+	Weights [AnswerCount]float64
+}
+
+func (e *Euclidean) Name() string { return "euclidean" }
+
+func (e *Euclidean) Score(a, b *User) float64 {
+	dist, maxDist := 0.0, 0.0
+	for k := 0; k < AnswerCount; k++ {
+		diff := float64(a.Answers[k] - b.Answers[k])
+		dist += e.Weights[k] * diff * diff
+		maxDist += e.Weights[k] * (maxAnswer - minAnswer) * (maxAnswer - minAnswer)
+	}
+	if maxDist == 0 {
+		return 0
+	}
+	return math.Sqrt(dist / maxDist)
+}
+
+// Cosine is 1 - cosine similarity of the weighted answers vectors. answers are
+// centered on the neutral answer first, otherwise every vector points into the
+// same orthant and everyone looks alike.
+type Cosine struct {
+	Weights [AnswerCount]float64
+}
+
+func (c *Cosine) Name() string { return "cosine" }
+
+func (c *Cosine) Score(a, b *User) float64 {
+	const mid = float64(minAnswer+maxAnswer) / 2
+	dot, normA, normB := 0.0, 0.0, 0.0
+	for k := 0; k < AnswerCount; k++ {
+		x := float64(a.Answers[k]) - mid
+		y := float64(b.Answers[k]) - mid
+		dot += c.Weights[k] * x * y
+		normA += c.Weights[k] * x * x
+		normB += c.Weights[k] * y * y
+	}
+	if normA == 0 || normB == 0 {
+		// an all-neutral user has no direction; treat as orthogonal
+		return 0.5
+	}
+	sim := dot / (math.Sqrt(normA) * math.Sqrt(normB))
+	// map [-1, 1] similarity onto [0, 1] distance
+	return (1 - sim) / 2
+}
+
+// InterestJaccard is the Jaccard distance between the users' interest_1..5 sets
+type InterestJaccard struct{}
+
+func (InterestJaccard) Name() string { return "interests" }
+
+func (InterestJaccard) Score(a, b *User) float64 {
+	var shared, union int
+	if a.prepared && b.prepared {
+		shared = countShared(a.interestIDs, b.interestIDs)
+		union = len(a.interestIDs) + len(b.interestIDs) - shared
+	} else {
+		keysA, keysB := interestKeys(a.Interests), interestKeys(b.Interests)
+		shared = countShared(keysA, keysB)
+		union = len(keysA) + len(keysB) - shared
+	}
+	if union == 0 {
+		return 1
+	}
+	return 1 - float64(shared)/float64(union)
+}
+
+// countShared counts the common elements of two sorted, de-duplicated slices
+func countShared[T cmp.Ordered](a, b []T) int {
+	shared := 0
+	for x, y := 0, 0; x < len(a) && y < len(b); {
+		switch {
+		case a[x] == b[y]:
+			shared++
+			x++
+			y++
+		case a[x] < b[y]:
+			x++
+		default:
+			y++
+		}
+	}
+	return shared
+}
+
+// SharedInterests returns the interests both users listed, in a's order
+func SharedInterests(a, b *User) []string {
+	keysB := interestKeys(b.Interests)
+	var shared []string
+	seen := map[string]bool{}
+	for _, interest := range a.Interests {
+		key := normalizeInterest(interest)
+		if key == "" || seen[key] {
+			continue
+		}
+		if _, found := slices.BinarySearch(keysB, key); found {
+			shared = append(shared, interest)
+			seen[key] = true
+		}
+	}
+	return shared
+}
+
+func normalizeInterest(interest string) string {
+	return strings.ToLower(strings.TrimSpace(interest))
+}
+
+func interestKeys(interests []string) []string {
+	keys := make([]string, 0, len(interests))
+	for _, interest := range interests {
+		if key := normalizeInterest(interest); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+// CollegeAffinity prefers pairs from the same residential college (or from
+// different ones when PreferDifferent is set). unknown colleges are neutral.
+type CollegeAffinity struct {
+	PreferDifferent bool
+}
+
+func (CollegeAffinity) Name() string { return "college" }
+
+func (c CollegeAffinity) Score(a, b *User) float64 {
+	if a.ResidentialCollege == "" || b.ResidentialCollege == "" {
+		return 0.5
+	}
+	same := a.ResidentialCollege == b.ResidentialCollege
+	if same != c.PreferDifferent {
+		return 0
+	}
+	return 1
+}
+
+// EloProximity prefers pairs with similar desirability ratings. a rating gap
+// of Scale scores 0.5, and the distance approaches 1 as the gap grows.
+type EloProximity struct {
+	Scale float64
+}
+
+// DefaultEloScale is the gap at which Elo expects 10:1 odds
+const DefaultEloScale = 400
+
+func (EloProximity) Name() string { return "elo" }
+
+func (e EloProximity) Score(a, b *User) float64 {
+	gap := math.Abs(float64(a.Elo - b.Elo))
+	if gap == 0 {
+		return 0
+	}
+	return gap / (gap + e.Scale)
+}
+
+// WeightedScorer is a single term of a Composite
+type WeightedScorer struct {
+	Scorer Scorer
+	Weight float64
+}
+
+// Composite is the weighted mean of its terms
+type Composite struct {
+	Terms []WeightedScorer
+}
+
+func (c *Composite) Name() string { return "composite" }
+
+func (c *Composite) Score(a, b *User) float64 {
+	total, weights := 0.0, 0.0
+	for _, term := range c.Terms {
+		if term.Weight == 0 {
+			continue
+		}
+		total += term.Weight * term.Scorer.Score(a, b)
+		weights += term.Weight
+	}
+	if weights == 0 {
+		return 0
+	}
+	return total / weights
+}
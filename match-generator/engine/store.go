@@ -0,0 +1,215 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Querier is satisfied by both *sql.DB and *sql.Tx
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Input is everything a match run needs
+type Input struct {
+	Users   []User
+	Config  ScorerConfig
+	History History
+	Blocks  Blocks
+}
+
+// LoadInput reads the active users, scorer config, blocks, and match history
+// of the historyWeeks weeks before week (every earlier week when 0). the scorer
+// config comes from configPath if set, otherwise from the active scorer_configs
+// row, falling back to DefaultScorerConfig.
+func LoadInput(ctx context.Context, q Querier, week time.Time, historyWeeks int, configPath string) (*Input, error) {
+	input := &Input{Config: DefaultScorerConfig()}
+	if configPath != "" {
+		config, err := LoadScorerConfigFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+		input.Config = config
+	} else {
+		config, ok, err := LoadScorerConfigDB(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			input.Config = config
+		}
+	}
+
+	var err error
+	if input.Users, err = loadUsers(ctx, q); err != nil {
+		return nil, err
+	}
+	if input.History, err = loadHistory(ctx, q, week, historyWeeks); err != nil {
+		return nil, err
+	}
+	if input.Blocks, err = loadBlocks(ctx, q); err != nil {
+		return nil, err
+	}
+	return input, nil
+}
+
+// Generate builds the configured scorer and matches the input users.
+// opts.Exclude is replaced by the rematch policy's exclusions and blocked pairs.
+func (in *Input) Generate(opts Options) (*Result, error) {
+	scorer, err := in.Config.Build()
+	if err != nil {
+		return nil, fmt.Errorf("invalid scorer config: %w", err)
+	}
+	policy, err := in.Config.RematchPolicy()
+	if err != nil {
+		return nil, fmt.Errorf("invalid scorer config: %w", err)
+	}
+	scorer, exclude := WithHistory(scorer, in.History, policy)
+	opts.Exclude = func(a, b *User) bool {
+		return in.Blocks.Blocked(a.Email, b.Email) || exclude(a, b)
+	}
+	return GenerateMatches(in.Users, scorer, opts), nil
+}
+
+// SundayOf returns midnight of the sunday starting t's week, which is how
+// matches.week is keyed
+func SundayOf(t time.Time) time.Time {
+	offset := (int(t.Weekday()) + 7 - int(time.Sunday)) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, t.Location())
+}
+
+// WeekOf returns the week t falls in, as midnight UTC of its sunday in
+// WEEK_TIMEZONE (default UTC), the same week match-service computes
+func WeekOf(t time.Time) time.Time {
+	loc, err := time.LoadLocation(GetEnv("WEEK_TIMEZONE", "UTC"))
+	if err != nil {
+		loc = time.UTC
+	}
+	sunday := SundayOf(t.In(loc))
+	return time.Date(sunday.Year(), sunday.Month(), sunday.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// loadHistory collects every pair server generated in the weeks weeks before
+// this one, or in any earlier week when weeks is 0
+func loadHistory(ctx context.Context, q Querier, sunday time.Time, weeks int) (History, error) {
+	historyQuery := `
+        SELECT user1_email, user2_email, MAX(week)
+          FROM matches
+         WHERE server_generated = true AND week < $1 AND week >= $2
+         GROUP BY user1_email, user2_email
+    `
+	since := time.Time{}
+	if weeks > 0 {
+		since = sunday.AddDate(0, 0, -7*weeks)
+	}
+	rows, err := q.QueryContext(ctx, historyQuery, sunday, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query match history: %w", err)
+	}
+	defer rows.Close()
+
+	history := History{}
+	for rows.Next() {
+		var email1, email2 string
+		var week time.Time
+		if scanErr := rows.Scan(&email1, &email2, &week); scanErr != nil {
+			return nil, fmt.Errorf("failed to scan match history: %w", scanErr)
+		}
+		weeksAgo := int(math.Round(sunday.Sub(week).Hours() / (24 * 7)))
+		history.Add(email1, email2, weeksAgo)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate match history: %w", err)
+	}
+	return history, nil
+}
+
+func loadUsers(ctx context.Context, q Querier) ([]User, error) {
+	selectQuery := `
+        SELECT 
+			u.email, 
+			u.gender, 
+			u.partner_genders, 
+			u.residential_college,
+			u.interest_1,
+			u.interest_2,
+			u.interest_3,
+			u.interest_4,
+			u.interest_5,
+			a.question1, 
+			a.question2, 
+			a.question3, 
+			a.question4, 
+			a.question5, 
+			a.question6, 
+			a.question7, 
+			a.question8, 
+			a.question9, 
+			a.question10, 
+			a.question11, 
+			a.question12,
+			e.elo
+		FROM users u
+		LEFT JOIN answers a ON u.email = a.email
+		LEFT JOIN elos e ON u.email = e.email
+		WHERE u.is_active = true
+		ORDER BY u.email
+	`
+
+	rows, err := q.QueryContext(ctx, selectQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query: %w", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		var gender, partnerGenders sql.NullInt64
+		var college sql.NullString
+		var interests [InterestCount]sql.NullString
+		var answers [AnswerCount]sql.NullInt64
+		var elo sql.NullInt64
+		dest := []any{&user.Email, &gender, &partnerGenders, &college}
+		for k := range interests {
+			dest = append(dest, &interests[k])
+		}
+		for k := range answers {
+			dest = append(dest, &answers[k])
+		}
+		dest = append(dest, &elo)
+		if scanErr := rows.Scan(dest...); scanErr != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", scanErr)
+		}
+		// users without genders set can't be matched with anyone
+		if !gender.Valid || !partnerGenders.Valid {
+			continue
+		}
+		user.Gender = int(gender.Int64)
+		user.PartnerGenders = int(partnerGenders.Int64)
+		user.ResidentialCollege = college.String
+		user.Elo = int(elo.Int64)
+		for _, interest := range interests {
+			if interest.Valid && interest.String != "" {
+				user.Interests = append(user.Interests, interest.String)
+			}
+		}
+		for k, answer := range answers {
+			// unanswered questions take the schema default (neutral)
+			user.Answers[k] = defaultAnswer
+			if answer.Valid {
+				user.Answers[k] = int(answer.Int64)
+			}
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate users: %w", err)
+	}
+	return users, nil
+}
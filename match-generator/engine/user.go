@@ -0,0 +1,65 @@
+package engine
+
+import (
+	"hash/fnv"
+	"slices"
+)
+
+const (
+	AnswerCount   = 12
+	InterestCount = 5
+
+	// answers are validated to [0, 5] by user-service
+	minAnswer = 0
+	maxAnswer = 5
+	// schema default for unanswered questions
+	defaultAnswer = 3
+)
+
+// User is the subset of a users/answers row that the engine scores on
+type User struct {
+	Email              string
+	Gender             int
+	PartnerGenders     int
+	ResidentialCollege string
+	Interests          []string
+	Answers            [AnswerCount]int
+	// desirability rating from elos, moved by sqs-consumer as users accept or
+	// decline matches
+	Elo int
+
+	// sorted ids of the normalized Interests; filled in by prepareUsers
+	interestIDs []int32
+	// seeded hash of Email; filled in by prepareUsers
+	key      uint64
+	prepared bool
+}
+
+// prepareUsers caches per-user derived data before scoring, so scorers don't
+// redo it for every pair
+func prepareUsers(users []User, seed int64) {
+	ids := map[string]int32{}
+	for i := range users {
+		hash := fnv.New64a()
+		hash.Write([]byte(users[i].Email))
+		users[i].key = mix64(hash.Sum64() ^ mix64(uint64(seed)))
+
+		keys := interestKeys(users[i].Interests)
+		users[i].interestIDs = make([]int32, len(keys))
+		for k, key := range keys {
+			id, ok := ids[key]
+			if !ok {
+				id = int32(len(ids))
+				ids[key] = id
+			}
+			users[i].interestIDs[k] = id
+		}
+		slices.Sort(users[i].interestIDs)
+		users[i].prepared = true
+	}
+}
+
+// compatible reports whether both users are in each other's partner_genders
+func compatible(a, b *User) bool {
+	return a.Gender&b.PartnerGenders != 0 && b.Gender&a.PartnerGenders != 0
+}
@@ -3,19 +3,18 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
-	"math"
-	"net"
 	"os"
-	"sort"
-	"strings"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	_ "github.com/lib/pq"
+
+	"github.com/sebaraj/crush/match-generator/engine"
 )
 
 var (
@@ -28,14 +27,24 @@ func main() {
 }
 
 const (
-	answerCount = 12
-	capacity    = 3
+	capacity = 3
 )
 
-func handleMatchGen(ctx context.Context, event events.SQSEvent) error {
+// an event with any record body of {"dry_run": true} runs without writing.
+// {"seed": n} reruns with a given seed; otherwise MATCH_SEED or a random one
+type triggerMessage struct {
+	DryRun bool   `json:"dry_run"`
+	Seed   *int64 `json:"seed"`
+}
+
+func handleMatchGen(ctx context.Context, event events.SQSEvent) (err error) {
 	initDB()
+	dryRun := isDryRun(event)
+	seed, err := runSeed(event)
+	if err != nil {
+		return err
+	}
 
-	// get count of active users
 	tx, err := db.BeginTx(ctx, &sql.TxOptions{})
 	if err != nil {
 		return fmt.Errorf("failed to begin tx: %w", err)
@@ -46,294 +55,105 @@ func handleMatchGen(ctx context.Context, event events.SQSEvent) error {
 		if p := recover(); p != nil {
 			_ = tx.Rollback()
 			panic(p)
-		} else if err != nil {
+		} else if err != nil || dryRun {
 			_ = tx.Rollback()
 		} else {
 			err = tx.Commit()
 		}
 	}()
 
-	countQuery := `
-        SELECT COUNT(DISTINCT email) FROM users WHERE is_active = true
-    `
-	var freq int
-	row := tx.QueryRowContext(ctx, countQuery)
-	countErr := row.Scan(&freq)
-	if countErr != nil {
-		return fmt.Errorf("locking rows failed: %w", countErr)
-	}
-	// init lists
-	emailList := make([]string, freq)
-	myGenderList := make([]int, freq)
-	targetGenderList := make([]int, freq)
-	answersList := make([][]int, freq)
-	for i := range answersList {
-		answersList[i] = make([]int, answerCount)
-	}
-	distanceList := make([][]int, freq)
-	for i := range distanceList {
-		distanceList[i] = make([]int, freq)
+	startedAt := time.Now()
+	sunday := engine.WeekOf(startedAt) // this weeks sunday
+	// MATCH_HISTORY_WEEKS limits the match history the rematch policy sees; defaults to every earlier week
+	historyWeeks, _ := strconv.Atoi(engine.GetEnv("MATCH_HISTORY_WEEKS", "0"))
+	input, err := engine.LoadInput(ctx, tx, sunday, historyWeeks, engine.GetEnv("SCORER_CONFIG_PATH", ""))
+	if err != nil {
+		return err
 	}
 
-	// SQL query to popular lists
-	selectQuery := `
-        SELECT 
-			u.email, 
-			u.gender, 
-			u.partner_genders, 
-			a.question1, 
-			a.question2, 
-			a.question3, 
-			a.question4, 
-			a.question5, 
-			a.question6, 
-			a.question7, 
-			a.question8, 
-			a.question9, 
-			a.question10, 
-			a.question11, 
-			a.question12
-		FROM users u
-		LEFT JOIN answers a ON u.email = a.email
-		WHERE u.is_active = true
-	`
-
-	rows, err := tx.QueryContext(ctx, selectQuery)
+	// MATCH_WORKERS caps the goroutines scoring candidates; defaults to GOMAXPROCS
+	workers, _ := strconv.Atoi(engine.GetEnv("MATCH_WORKERS", "0"))
+	opts := engine.Options{Capacity: capacity, Workers: workers, Seed: seed}.WithDefaults()
+	result, err := input.Generate(opts)
 	if err != nil {
-		return fmt.Errorf("failed to query: %w", err)
+		return err
 	}
-	defer rows.Close()
-	idx := 0
-	var email string
-	var gender int
-	var partnerGenders int
-	answers := make([]int, answerCount)
+	pairs := result.Pairs()
 
-	// weights for manhattan distances
-	weightsMul := [answerCount]int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}
-	weightsAdd := [answerCount]int{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
-	for rows.Next() {
-		if scanErr := rows.Scan(&email, &gender, &partnerGenders, &answers[0], &answers[1], &answers[2], &answers[3], &answers[4], &answers[5], &answers[6], &answers[7], &answers[8], &answers[9], &answers[10], &answers[11]); scanErr != nil {
-			continue
-		}
-		emailList[idx] = email
-		myGenderList[idx] = gender
-		targetGenderList[idx] = partnerGenders
-		tempAns := make([]int, answerCount)
-		copy(tempAns, answers)
-		answersList[idx] = tempAns
-		idx++
+	if dryRun {
+		log.Printf("Dry run for week of %s with seed %d; nothing will be written", sunday.Format("2006-01-02"), seed)
+		return engine.WriteReport(os.Stdout, input.Users, result)
 	}
 
-	// calculate weighted manhattan distances
-	for i := 0; i < freq-1; i++ {
-		for j := i + 1; j < freq; j++ {
-			dist := 0
-			// check if genders are compatible
-			if i == j || ((myGenderList[i]&targetGenderList[j]) == 0 || (myGenderList[j]&targetGenderList[i]) == 0) {
-				// if not compatible, set distance to max
-				dist = math.MaxInt
-			} else {
-				for k := 0; k < answerCount; k++ {
-					temp := answersList[i][k] - answersList[j][k]
-					if temp < 0 {
-						temp = -temp // go please add abs() for ints and not just float64! :(
-					}
-					dist += weightsMul[k]*temp + weightsAdd[k]
-				}
-			}
-			// store dist in [i,j] and [j,i]
-			distanceList[i][j] = dist
-			distanceList[j][i] = dist
-
-		}
+	run := &engine.Run{
+		Week:         sunday,
+		Seed:         seed,
+		Config:       input.Config,
+		Capacity:     opts.Capacity,
+		Candidates:   opts.Candidates,
+		Window:       opts.Window,
+		Workers:      opts.Workers,
+		HistoryWeeks: historyWeeks,
+		UserCount:    len(input.Users),
+		PairCount:    len(pairs),
+		InputHash:    input.Hash(),
+		StartedAt:    startedAt,
+		FinishedAt:   time.Now(),
 	}
-
-	preferenceLists := make([][]int, freq)
-	for i := 0; i < freq; i++ {
-		var candidates []int
-		for j := 0; j < freq; j++ {
-			if i != j && distanceList[i][j] != math.MaxInt {
-				candidates = append(candidates, j)
-			}
-		}
-		sortByDist := func(a, b int) bool {
-			return distanceList[i][a] < distanceList[i][b]
-		}
-		sort.Slice(candidates, sortByDist)
-
-		preferenceLists[i] = candidates
-	}
-
-	// Gale-Shapley variant for top 3 matches
-	// Data structures for the matching algorithm:
-	//  - nextChoice[i] = index into preferenceLists[i], telling whom i will propose to next
-	//  - matchedWith[i] = slice of users that have tentatively accepted i (size <= capacity)
-	//  - We also need a quick way for the “acceptor” to compare two proposers:
-	//    rank[i][j] = how user i ranks user j (lower = more preferred)
-	nextChoice := make([]int, freq)
-	matchedWith := make([][]int, freq)
-	for i := 0; i < freq; i++ {
-		matchedWith[i] = make([]int, 0, capacity)
+	if err = engine.InsertRun(ctx, tx, run); err != nil {
+		return err
 	}
+	log.Printf("Match run %d for week of %s: seed %d, %d users, %d pairs",
+		run.ID, sunday.Format("2006-01-02"), seed, run.UserCount, run.PairCount)
 
-	// rank[i][j]: position of j in i's preference list (lower = more preferred)
-	rank := make([][]int, freq)
-	for i := 0; i < freq; i++ {
-		rank[i] = make([]int, freq)
-		// For each j in preferenceLists[i], assign rank
-		for pos, userJ := range preferenceLists[i] {
-			rank[i][userJ] = pos
-		}
-	}
-	// Function to find the "worst" matched partner for user u (i.e. highest rank)
-	// returns that partner's index and their rank
-	worstPartner := func(u int) (partner int, partnerRank int) {
-		worst := -1
-		worstPos := -1
-		for _, p := range matchedWith[u] {
-			rk := rank[u][p]
-			if rk > worstPos {
-				worstPos = rk
-				worst = p
-			}
+	// store matches in DB
+	insertStmt := `INSERT INTO matches (user1_email, user2_email, server_generated, week, run_id) VALUES ($1, $2, $3, $4, $5)`
+	for _, pair := range pairs {
+		emailA, emailB := input.Users[pair.A].Email, input.Users[pair.B].Email
+		if _, iErr := tx.ExecContext(ctx, insertStmt, emailA, emailB, true, sunday, run.ID); iErr != nil {
+			return fmt.Errorf("failed to insert match (%s, %s): %w", emailA, emailB, iErr)
 		}
-		return worst, worstPos
 	}
 
-	for {
-		changed := false
-
-		// Try each user if they still have room for matches < capacity (or have proposals left)
-		for i := 0; i < freq; i++ {
-			// If i is already at capacity, skip
-			if len(matchedWith[i]) >= capacity {
-				continue
-			}
-
-			// If i has exhausted all possible proposals, skip
-			if nextChoice[i] >= len(preferenceLists[i]) {
-				continue
-			}
-
-			// Propose to the next candidate on i's preference list
-			proposeTo := preferenceLists[i][nextChoice[i]]
-			nextChoice[i]++
-
-			// If proposeTo is not at capacity, they accept i
-			if len(matchedWith[proposeTo]) < capacity {
-				matchedWith[proposeTo] = append(matchedWith[proposeTo], i)
-				matchedWith[i] = append(matchedWith[i], proposeTo)
-				changed = true
-
-			} else {
-				// proposeTo is at capacity => check if i is better than their worst
-				worstP, worstRank := worstPartner(proposeTo)
-				myRank := rank[proposeTo][i]
-
-				if myRank < worstRank {
-					// proposeTo drops worstP, accepts i
-					matchedWith[proposeTo] = removeOne(matchedWith[proposeTo], worstP)
-					matchedWith[worstP] = removeOne(matchedWith[worstP], proposeTo)
-
-					matchedWith[proposeTo] = append(matchedWith[proposeTo], i)
-					matchedWith[i] = append(matchedWith[i], proposeTo)
-					changed = true
-
-				}
-				//else {
-				// proposeTo rejects i => do nothing, i remains unmatched
-				//}
-			}
-		}
+	// explanations are computed now, while the answers that produced the matches are still current
+	return engine.InsertExplanations(ctx, tx, run.ID, input.Users, result)
+}
 
-		if !changed {
-			// No change => stable
-			break
-		}
+// isDryRun checks the DRY_RUN env var and the triggering event
+func isDryRun(event events.SQSEvent) bool {
+	if dryRun, err := strconv.ParseBool(engine.GetEnv("DRY_RUN", "false")); err == nil && dryRun {
+		return true
 	}
-
-	// store matches in DB
-	sunday := getThisWeeksSunday() // this weeks sunday
-	insertStmt := `INSERT INTO matches (email1, email2, server_generated, week) VALUES ($1, $2, $3, $4)`
-	for i := 0; i < freq; i++ {
-		for _, partner := range matchedWith[i] {
-			if i < partner {
-				if _, iErr := tx.ExecContext(ctx, insertStmt, emailList[i], emailList[partner], true, sunday); iErr != nil {
-					return fmt.Errorf("failed to insert match (%s, %s): %w",
-						emailList[i], emailList[partner], iErr)
-				}
-			}
+	for _, record := range event.Records {
+		var msg triggerMessage
+		if err := json.Unmarshal([]byte(record.Body), &msg); err == nil && msg.DryRun {
+			return true
 		}
 	}
-
-	return nil
-}
-
-func getThisWeeksSunday() time.Time {
-	now := time.Now()
-	offset := (int(now.Weekday()) + 7 - int(time.Sunday)) % 7
-	sunday := time.Date(
-		now.Year(),
-		now.Month(),
-		now.Day()-offset,
-		0, 0, 0, 0,
-		now.Location(),
-	)
-	return sunday
+	return false
 }
 
-func GetEnv(key, defaultVal string) string {
-	if value, exists := os.LookupEnv(key); exists {
-		return value
+// runSeed takes the seed from the triggering event, then MATCH_SEED, and
+// otherwise picks a random one
+func runSeed(event events.SQSEvent) (int64, error) {
+	for _, record := range event.Records {
+		var msg triggerMessage
+		if err := json.Unmarshal([]byte(record.Body), &msg); err == nil && msg.Seed != nil {
+			return *msg.Seed, nil
+		}
 	}
-	return defaultVal
-}
-
-func removeOne(s []int, x int) []int {
-	n := len(s)
-	for i, val := range s {
-		if val == x {
-			s[i], s[n-1] = s[n-1], s[i]
-			return s[:n-1]
+	if env := engine.GetEnv("MATCH_SEED", ""); env != "" {
+		seed, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid MATCH_SEED %q: %w", env, err)
 		}
+		return seed, nil
 	}
-	return s
+	return engine.NewSeed(), nil
 }
 
 func initDB() {
 	dbOnce.Do(func() {
-		dbUser := GetEnv("DB_USERNAME", "localtest")
-		dbPassword := GetEnv("DB_PASSWORD", "localtest")
-		dbEndpoint := GetEnv("DB_ENDPOINT", "localhost")
-		dbPort := GetEnv("DB_PORT", "5432")
-		dbName := GetEnv("DB_NAME", "my_database")
-		if dbUser == "" || dbPassword == "" || dbEndpoint == "" || dbPort == "" || dbName == "" {
-			log.Fatal("One or more required environment variables are missing")
-		}
-		dbEndpoint = strings.Split(dbEndpoint, ":")[0]
-
-		ips, err := net.LookupIP(dbEndpoint)
-		if err != nil {
-			log.Fatalf("Failed to resolve hostname: %v", err)
-		}
-
-		if len(ips) == 0 {
-			log.Fatalf("No IP addresses found for hostname: %s", dbEndpoint)
-		}
-
-		dbIP := ips[0].String()
-		psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=require",
-			dbIP, dbPort, dbUser, dbPassword, dbName)
-
-		db, err := sql.Open("postgres", psqlInfo)
-		if err != nil {
-			log.Fatalf("Unable to connect to DB: %v", err)
-		}
-
-		err = db.Ping()
-		if err != nil {
-			log.Fatalf("Failed to ping DB: %v", err)
-		}
+		db = engine.ConnectToDB()
 	})
 }
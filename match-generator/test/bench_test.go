@@ -0,0 +1,93 @@
+package test
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/sebaraj/crush/match-generator/engine"
+)
+
+var (
+	benchColleges  = []string{"Berkeley", "Branford", "Davenport", "Morse", "Pierson", "Saybrook", "Silliman", "Trumbull"}
+	benchInterests = []string{"music", "film", "hiking", "chess", "cooking", "running", "art", "theater", "coding", "travel", "reading", "dance"}
+)
+
+// syntheticUsers builds a reproducible population that roughly follows the
+// real gender mix: mostly straight cis users with some queer and non-binary users
+func syntheticUsers(n int) []engine.User {
+	rng := rand.New(rand.NewSource(int64(n)))
+	users := make([]engine.User, n)
+	for i := range users {
+		user := &users[i]
+		user.Email = fmt.Sprintf("user%d@yale.edu", i)
+		switch roll := rng.Intn(100); {
+		case roll < 42:
+			user.Gender, user.PartnerGenders = cisFemale, cisMale
+		case roll < 84:
+			user.Gender, user.PartnerGenders = cisMale, cisFemale
+		case roll < 90:
+			user.Gender, user.PartnerGenders = cisFemale, cisFemale
+		case roll < 95:
+			user.Gender, user.PartnerGenders = cisMale, cisMale
+		default:
+			user.Gender, user.PartnerGenders = 1<<4, 0b11111
+		}
+		user.ResidentialCollege = benchColleges[rng.Intn(len(benchColleges))]
+		for k := 0; k < engine.InterestCount; k++ {
+			user.Interests = append(user.Interests, benchInterests[rng.Intn(len(benchInterests))])
+		}
+		for k := range user.Answers {
+			user.Answers[k] = rng.Intn(6)
+		}
+	}
+	return users
+}
+
+func benchScorer(b *testing.B) engine.Scorer {
+	config := engine.ScorerConfig{Scorers: []engine.ScorerTerm{
+		{Name: "manhattan", Weight: 1},
+		{Name: "interests", Weight: 0.5},
+		{Name: "college", Weight: 0.1},
+	}}
+	scorer, err := config.Build()
+	if err != nil {
+		b.Fatalf("failed to build scorer: %v", err)
+	}
+	return scorer
+}
+
+// BenchmarkGenerateMatches reports time and B/op for a full run; memory is
+// bounded by n * engine.DefaultCandidates rather than n².
+func BenchmarkGenerateMatches(b *testing.B) {
+	scorer := benchScorer(b)
+	for _, n := range []int{10_000, 50_000, 100_000} {
+		users := syntheticUsers(n)
+		b.Run(fmt.Sprintf("users=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				result := engine.GenerateMatches(users, scorer, engine.Options{Capacity: 3})
+				stats := engine.Summarize(users, result)
+				b.ReportMetric(stats.MatchRate, "match-rate")
+				b.ReportMetric(stats.AverageRank, "avg-rank")
+			}
+		})
+	}
+}
+
+// BenchmarkGenerateMatchesWorkers compares a single worker against sharding
+// candidate generation; speedup is bounded by GOMAXPROCS
+func BenchmarkGenerateMatchesWorkers(b *testing.B) {
+	scorer := benchScorer(b)
+	users := syntheticUsers(50_000)
+	b.Logf("GOMAXPROCS=%d", runtime.GOMAXPROCS(0))
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				engine.GenerateMatches(users, scorer, engine.Options{Capacity: 3, Workers: workers})
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+package test
+
+import (
+	"maps"
+	"math"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sebaraj/crush/match-generator/engine"
+)
+
+const (
+	cisFemale = 1 << 0
+	cisMale   = 1 << 2
+)
+
+func newUser(email string, gender, partnerGenders int, answers ...int) engine.User {
+	user := engine.User{Email: email, Gender: gender, PartnerGenders: partnerGenders}
+	for k := range user.Answers {
+		user.Answers[k] = 3
+	}
+	copy(user.Answers[:], answers)
+	return user
+}
+
+func TestScorers(t *testing.T) {
+	a := newUser("a@yale.edu", cisFemale, cisMale, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	b := newUser("b@yale.edu", cisMale, cisFemale, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5)
+	a.Interests = []string{"Music", "Hiking", "chess"}
+	b.Interests = []string{"music", "Chess", "Film"}
+	a.ResidentialCollege = "Berkeley"
+	b.ResidentialCollege = "Berkeley"
+
+	config := engine.ScorerConfig{Scorers: []engine.ScorerTerm{
+		{Name: "manhattan", Weight: 1},
+		{Name: "euclidean", Weight: 1},
+		{Name: "cosine", Weight: 1},
+	}}
+	scorer, err := config.Build()
+	if err != nil {
+		t.Fatalf("failed to build scorer: %v", err)
+	}
+	// a and b are opposite corners of the answer space
+	if got := scorer.Score(&a, &b); math.Abs(got-1) > 1e-9 {
+		t.Errorf("expected max distance 1, got %v", got)
+	}
+	if got := scorer.Score(&a, &a); math.Abs(got) > 1e-9 {
+		t.Errorf("expected self distance 0, got %v", got)
+	}
+
+	// shared {music, chess} out of {music, hiking, chess, film}
+	if got := (engine.InterestJaccard{}).Score(&a, &b); math.Abs(got-0.5) > 1e-9 {
+		t.Errorf("expected jaccard distance 0.5, got %v", got)
+	}
+	if got := engine.SharedInterests(&a, &b); len(got) != 2 || got[0] != "Music" || got[1] != "chess" {
+		t.Errorf("unexpected shared interests %v", got)
+	}
+
+	if got := (engine.CollegeAffinity{}).Score(&a, &b); got != 0 {
+		t.Errorf("expected same college distance 0, got %v", got)
+	}
+	if got := (engine.CollegeAffinity{PreferDifferent: true}).Score(&a, &b); got != 1 {
+		t.Errorf("expected same college distance 1 when preferring different, got %v", got)
+	}
+
+	a.Elo, b.Elo = 1200, 1600
+	if got := (engine.EloProximity{Scale: engine.DefaultEloScale}).Score(&a, &b); math.Abs(got-0.5) > 1e-9 {
+		t.Errorf("expected elo distance 0.5 at a gap of one scale, got %v", got)
+	}
+	if got := (engine.EloProximity{Scale: engine.DefaultEloScale}).Score(&a, &a); got != 0 {
+		t.Errorf("expected elo self distance 0, got %v", got)
+	}
+}
+
+func TestScorerConfigValidation(t *testing.T) {
+	bad := []engine.ScorerConfig{
+		{},
+		{Scorers: []engine.ScorerTerm{{Name: "unknown", Weight: 1}}},
+		{Scorers: []engine.ScorerTerm{{Name: "manhattan", Weight: -1}}},
+		{Scorers: []engine.ScorerTerm{{Name: "manhattan", Weight: 1, QuestionWeights: []float64{1, 2}}}},
+		{Scorers: []engine.ScorerTerm{{Name: "elo", Weight: 1, Scale: -1}}},
+	}
+	for _, config := range bad {
+		if _, err := config.Build(); err == nil {
+			t.Errorf("expected error building %+v", config)
+		}
+	}
+}
+
+func TestGenerateMatches(t *testing.T) {
+	users := []engine.User{
+		newUser("f1@yale.edu", cisFemale, cisMale, 1, 1, 1),
+		newUser("f2@yale.edu", cisFemale, cisMale, 5, 5, 5),
+		newUser("m1@yale.edu", cisMale, cisFemale, 1, 1, 2),
+		newUser("m2@yale.edu", cisMale, cisFemale, 5, 5, 4),
+	}
+	scorer, err := engine.DefaultScorerConfig().Build()
+	if err != nil {
+		t.Fatalf("failed to build scorer: %v", err)
+	}
+
+	pairs := engine.GenerateMatches(users, scorer, engine.Options{Capacity: 1}).Pairs()
+	assertPairs(t, []engine.Pair{{A: 0, B: 2}, {A: 1, B: 3}}, pairs)
+
+	// f1 and m1 were matched last week, so f1 and m1 are left without a partner
+	history := engine.History{}
+	history.Add("m1@yale.edu", "f1@yale.edu", 1)
+
+	excluding, exclude := engine.WithHistory(scorer, history, engine.DefaultRematchPolicy())
+	pairs = engine.GenerateMatches(users, excluding, engine.Options{Capacity: 1, Exclude: exclude}).Pairs()
+	assertPairs(t, []engine.Pair{{A: 1, B: 3}}, pairs)
+
+	// a penalty only pushes the pair down the list, so it is still a last resort
+	penalizing, exclude := engine.WithHistory(scorer, history, engine.RematchPolicy{Penalty: 1})
+	if got := penalizing.Score(&users[0], &users[2]); got < 1 {
+		t.Errorf("expected penalized distance >= 1, got %v", got)
+	}
+	pairs = engine.GenerateMatches(users, penalizing, engine.Options{Capacity: 1, Exclude: exclude}).Pairs()
+	assertPairs(t, []engine.Pair{{A: 0, B: 2}, {A: 1, B: 3}}, pairs)
+
+	// and decays away over time
+	old := engine.History{}
+	old.Add("m1@yale.edu", "f1@yale.edu", 11)
+	decayed, _ := engine.WithHistory(scorer, old, engine.RematchPolicy{Penalty: 1, HalfLifeWeeks: 1})
+	if got := decayed.Score(&users[0], &users[2]) - scorer.Score(&users[0], &users[2]); math.Abs(got-1.0/1024) > 1e-9 {
+		t.Errorf("expected decayed penalty 1/1024, got %v", got)
+	}
+}
+
+func assertPairs(t *testing.T, expected, pairs []engine.Pair) {
+	t.Helper()
+	if len(pairs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, pairs)
+	}
+	for i := range expected {
+		if pairs[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, pairs)
+		}
+	}
+}
+
+func TestFixtureReport(t *testing.T) {
+	input, err := engine.LoadFixture("testdata/users.csv")
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+	if len(input.Users) != 5 || input.Users[2].Interests[0] != "Music" || input.Users[1].Answers[11] != 3 {
+		t.Fatalf("unexpected users %+v", input.Users)
+	}
+
+	result, err := input.Generate(engine.Options{Capacity: 1})
+	if err != nil {
+		t.Fatalf("failed to generate matches: %v", err)
+	}
+	stats := engine.Summarize(input.Users, result)
+	if stats.Pairs != 2 || stats.MatchRate != 0.8 || stats.AverageRank != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if len(stats.Unmatched) != 1 || stats.Unmatched[0] != "n1@yale.edu" {
+		t.Errorf("expected n1 to be unmatched, got %v", stats.Unmatched)
+	}
+
+	var report strings.Builder
+	if err := engine.WriteReport(&report, input.Users, result); err != nil {
+		t.Fatalf("failed to write report: %v", err)
+	}
+	if !strings.Contains(report.String(), "f1@yale.edu <-> m1@yale.edu") {
+		t.Errorf("report is missing pair:\n%s", report.String())
+	}
+}
+
+func TestGenerateMatchesDeterministicAcrossWorkers(t *testing.T) {
+	users := syntheticUsers(3_000)
+	scorer, err := engine.DefaultScorerConfig().Build()
+	if err != nil {
+		t.Fatalf("failed to build scorer: %v", err)
+	}
+	// a small window forces the projection scan rather than exhaustive buckets
+	single := engine.GenerateMatches(users, scorer, engine.Options{Capacity: 3, Window: 8, Workers: 1}).Pairs()
+	parallel := engine.GenerateMatches(users, scorer, engine.Options{Capacity: 3, Window: 8, Workers: 8}).Pairs()
+	assertPairs(t, single, parallel)
+}
+
+func TestGenerateMatchesSeeded(t *testing.T) {
+	users := syntheticUsers(2_000)
+	// answers are small integers, so the population is full of distance ties
+	scorer, err := engine.DefaultScorerConfig().Build()
+	if err != nil {
+		t.Fatalf("failed to build scorer: %v", err)
+	}
+	emailPairs := func(users []engine.User, seed int64) map[[2]string]bool {
+		pairs := map[[2]string]bool{}
+		for _, pair := range engine.GenerateMatches(users, scorer, engine.Options{Capacity: 3, Seed: seed}).Pairs() {
+			a, b := users[pair.A].Email, users[pair.B].Email
+			pairs[[2]string{min(a, b), max(a, b)}] = true
+		}
+		return pairs
+	}
+
+	// row order from the database must not matter
+	shuffled := slices.Clone(users)
+	rand.New(rand.NewSource(1)).Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	if !maps.Equal(emailPairs(users, 7), emailPairs(shuffled, 7)) {
+		t.Error("expected the same seed to give the same matches regardless of user order")
+	}
+	if maps.Equal(emailPairs(users, 7), emailPairs(users, 8)) {
+		t.Error("expected a different seed to break ties differently")
+	}
+
+	input := &engine.Input{Users: users}
+	if input.Hash() != (&engine.Input{Users: shuffled}).Hash() {
+		t.Error("expected the input hash to ignore user order")
+	}
+	shuffled[0].Answers[0]++
+	if input.Hash() == (&engine.Input{Users: shuffled}).Hash() {
+		t.Error("expected the input hash to change with answers")
+	}
+}
+
+func TestRunOptionsReproduceMatches(t *testing.T) {
+	users := syntheticUsers(1_000)
+	scorer, err := engine.DefaultScorerConfig().Build()
+	if err != nil {
+		t.Fatalf("failed to build scorer: %v", err)
+	}
+	opts := engine.Options{Capacity: 2, Candidates: 20, Window: 8, Seed: 3}.WithDefaults()
+	if opts.Workers <= 0 {
+		t.Fatalf("expected WithDefaults to pick a worker count, got %d", opts.Workers)
+	}
+	run := &engine.Run{Seed: opts.Seed, Capacity: opts.Capacity, Candidates: opts.Candidates,
+		Window: opts.Window, Workers: opts.Workers}
+	if got := run.Options(); got.Capacity != 2 || got.Candidates != 20 || got.Window != 8 || got.Seed != 3 {
+		t.Fatalf("expected the recorded options, got %+v", got)
+	}
+	assertPairs(t, engine.GenerateMatches(users, scorer, opts).Pairs(),
+		engine.GenerateMatches(users, scorer, run.Options()).Pairs())
+}
+
+func TestExplain(t *testing.T) {
+	users := []engine.User{
+		newUser("f1@yale.edu", cisFemale, cisMale, 0, 1, 2, 3, 4, 5, 0, 1, 2, 3, 4, 5),
+		newUser("m1@yale.edu", cisMale, cisFemale, 5, 1, 2, 2, 4, 0, 1, 1, 3, 3, 4, 5),
+	}
+	users[0].Interests = []string{"Music", "chess"}
+	users[1].Interests = []string{"music", "hiking"}
+	users[0].ResidentialCollege, users[1].ResidentialCollege = "Morse", "Morse"
+	config := engine.ScorerConfig{Scorers: []engine.ScorerTerm{
+		{Name: "manhattan", Weight: 1, QuestionWeights: []float64{2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+		{Name: "euclidean", Weight: 0.5},
+		{Name: "cosine", Weight: 0.5},
+		{Name: "interests", Weight: 0.5},
+		{Name: "college", Weight: 0.1, PreferDifferent: true},
+	}}
+	scorer, err := config.Build()
+	if err != nil {
+		t.Fatalf("failed to build scorer: %v", err)
+	}
+	history := engine.History{}
+	history.Add("f1@yale.edu", "m1@yale.edu", 3)
+	scorer, _ = engine.WithHistory(scorer, history, engine.RematchPolicy{Penalty: 0.2, HalfLifeWeeks: 2})
+
+	result := engine.GenerateMatches(users, scorer, engine.Options{Capacity: 1})
+	assertPairs(t, []engine.Pair{{A: 0, B: 1}}, result.Pairs())
+	explanation := result.Explain(users, 0, 1)
+
+	if explanation.Rank != 1 || explanation.Candidates != 1 {
+		t.Errorf("expected rank 1 of 1, got %d of %d", explanation.Rank, explanation.Candidates)
+	}
+	if len(explanation.SharedInterests) != 1 || explanation.SharedInterests[0] != "Music" {
+		t.Errorf("expected shared interests [Music], got %v", explanation.SharedInterests)
+	}
+	if got := explanation.Terms["rematch"]; math.Abs(got-0.1) > 1e-9 {
+		t.Errorf("expected rematch penalty 0.1, got %v", got)
+	}
+	// question 1 is weighted double and answered at opposite ends, as is question 6
+	want := map[int]string{0: engine.ContributionHigh, 5: engine.ContributionHigh, 1: engine.ContributionLow}
+	for k, level := range want {
+		if explanation.Questions[k] != level {
+			t.Errorf("expected question %d to be %s, got %q", k+1, level, explanation.Questions[k])
+		}
+	}
+	sum := explanation.Answers
+	for _, part := range explanation.Terms {
+		sum += part
+	}
+	if math.Abs(sum-explanation.Distance) > 1e-9 {
+		t.Errorf("expected the parts to add up to %v, got %v", explanation.Distance, sum)
+	}
+}
+
+func TestBlockedPairsNeverMatched(t *testing.T) {
+	users := []engine.User{
+		newUser("f1@yale.edu", cisFemale, cisMale, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0),
+		newUser("m1@yale.edu", cisMale, cisFemale, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0),
+		newUser("m2@yale.edu", cisMale, cisFemale, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5),
+	}
+	partnerOf := func(input *engine.Input) string {
+		result, err := input.Generate(engine.Options{Capacity: 1})
+		if err != nil {
+			t.Fatalf("failed to generate matches: %v", err)
+		}
+		for _, pair := range result.Pairs() {
+			if pair.A == 0 {
+				return users[pair.B].Email
+			}
+			if pair.B == 0 {
+				return users[pair.A].Email
+			}
+		}
+		return ""
+	}
+
+	input := &engine.Input{Users: users, Config: engine.DefaultScorerConfig()}
+	if partner := partnerOf(input); partner != "m1@yale.edu" {
+		t.Fatalf("expected f1 to match m1 without blocks, got %q", partner)
+	}
+	unblockedHash := input.Hash()
+
+	// blocks apply in both directions
+	input.Blocks = engine.Blocks{}
+	input.Blocks.Add("m1@yale.edu", "f1@yale.edu")
+	if partner := partnerOf(input); partner != "m2@yale.edu" {
+		t.Errorf("expected f1 to match m2 once m1 blocked f1, got %q", partner)
+	}
+	if input.Hash() == unblockedHash {
+		t.Error("expected the input hash to change with blocks")
+	}
+}
+
+func TestWeekOf(t *testing.T) {
+	if _, err := time.LoadLocation("America/New_York"); err != nil {
+		t.Skipf("No timezone data: %v", err)
+	}
+	cases := map[string]struct {
+		timezone string
+		at, week string
+	}{
+		"utc by default":                      {"", "2025-01-06T03:00:00Z", "2025-01-05"},
+		"still sunday in new york":            {"America/New_York", "2025-01-06T03:00:00Z", "2025-01-05"},
+		"sunday in utc, saturday in new york": {"America/New_York", "2025-01-05T03:00:00Z", "2024-12-29"},
+		"unknown timezone falls back to utc":  {"Nowhere/Else", "2025-01-05T03:00:00Z", "2025-01-05"},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("WEEK_TIMEZONE", c.timezone)
+			at, _ := time.Parse(time.RFC3339, c.at)
+			week := engine.WeekOf(at)
+			if got := week.Format("2006-01-02"); got != c.week {
+				t.Errorf("expected week %s, got %s", c.week, got)
+			}
+			// matches.week is keyed by midnight UTC
+			if week.Location() != time.UTC || week.Hour() != 0 {
+				t.Errorf("expected midnight UTC, got %v", week)
+			}
+		})
+	}
+}
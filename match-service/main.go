@@ -2,7 +2,7 @@
  * File Name: match-service/main.go
  * Author: Bryan SebaRaj
  * Description: Entrypoint for match service pod; initializes server and its dependencies/
- * connections to PostgreSQL (DMS) and SQS.
+ * connections to PostgreSQL and SQS.
  * Date Created: 01-07-2025
  *
  * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
@@ -33,7 +33,9 @@ import (
 
 func main() {
 	// connect to postgresql (RDS)
-	db := server.ConnectToDB()
+	// resolved once, for the pool and the match update listener
+	dsn := server.DSN()
+	db := server.ConnectToDB(dsn)
 
 	// initialize SQS client
 	ctx := context.Background()
@@ -50,8 +52,19 @@ func main() {
 		log.Fatal("MATCH_QUEUE_URL not set")
 	}
 
+	// relay match updates from the outbox to SQS in the background
+	relayCtx, stopRelay := context.WithCancel(ctx)
+	relayDone := make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		server.NewRelay(db, server.NewSQSPublisher(sqsClient, queueURL)).Run(relayCtx)
+	}()
+
 	// initialize server
-	app := server.NewServer(db, queueURL, sqsClient)
+	app := server.NewServer(db)
+
+	// push match changes committed by sqs-consumer to open streams
+	go app.ListenForMatchUpdates(relayCtx, dsn)
 	router := http.NewServeMux()
 	app.InitializeRoutes(router)
 
@@ -59,6 +72,8 @@ func main() {
 		Addr:    ":7000",
 		Handler: router,
 	}
+	// streams never finish on their own, so end them as shutdown starts
+	server.RegisterOnShutdown(app.Hub.Close)
 
 	// graceful shutdown when testing locally
 	stop := make(chan os.Signal, 1)
@@ -77,8 +92,12 @@ func main() {
 	defer cancel()
 
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		// still stop the relay and close the DB below
+		log.Printf("Server forced to shutdown: %v", err)
+		server.Close()
 	}
+	stopRelay()
+	<-relayDone
 	if err := app.DB.Close(); err != nil {
 		log.Fatalf("Error closing DB: %v", err)
 	}
@@ -0,0 +1,411 @@
+/***************************************************************************
+ * File Name: match-service/server/crush.go
+ * Author: Bryan SebaRaj
+ * Description: The one-crush-per-week rule and handlers for a user's crush
+ * Date Created: 01-07-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// a crush is a user generated match; its user1 is the user who picked it.
+// returning someone's crush picks them too, so the user2 of a crush they are
+// interested in has it as their crush. every user gets one per week, which can be changed or withdrawn until the
+// cutoff, CRUSH_CUTOFF after the start of the week (default friday 00:00).
+// weeks start on sunday 00:00 in WEEK_TIMEZONE (default UTC).
+//
+// the rule is checked here and the crush applied later by sqs-consumer, so a
+// request holds its user's row locked from the check until its update is in
+// the outbox, and the check counts updates still waiting there as applied.
+// sqs-consumer re-checks under its own lock and only dead letters an update
+// when the data changed under it, such as a block or a deleted user.
+const defaultCrushCutoff = 5 * 24 * time.Hour
+
+// actions carried by SQSMessage.Action; sqs-consumer enforces the same rule
+const (
+	actionUpdate        = ""
+	actionChangeCrush   = "change_crush"
+	actionWithdrawCrush = "withdraw_crush"
+)
+
+// reasons returned with 409 Conflict
+const (
+	reasonCrushTaken   = "crush_already_chosen"
+	reasonCutoffPassed = "crush_cutoff_passed"
+	reasonPastWeek     = "crush_week_closed"
+	reasonSelfCrush    = "crush_on_self"
+	reasonBlocked      = "crush_blocked"
+)
+
+// relation is what a user already has with a target in a given week
+type relation int
+
+const (
+	relationNone      relation = iota
+	relationGenerated          // server generated match
+	relationTheirs             // the target's crush on the user, still hidden from them
+	relationReturned           // the target's crush on the user, which they returned
+	relationOwn                // the user's crush on the target
+)
+
+// hidden reports whether the user can't know about the relation, so acting
+// on it must look exactly like acting on no match at all
+func (r relation) hidden() bool {
+	return r == relationNone || r == relationTheirs
+}
+
+type Crush struct {
+	TargetEmail string `json:"target_email"`
+	Week        string `json:"week"`
+	// last moment the crush can be changed or withdrawn
+	ChangeableUntil time.Time `json:"changeable_until"`
+}
+
+type conflictResponse struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func writeConflict(w http.ResponseWriter, reason, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	if err := json.NewEncoder(w).Encode(conflictResponse{Reason: reason, Message: message}); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// weekLocation is WEEK_TIMEZONE, falling back to UTC
+func weekLocation() *time.Location {
+	if loc, err := time.LoadLocation(GetEnv("WEEK_TIMEZONE", "UTC")); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// sundayOf returns the sunday starting date's week, as midnight UTC, which is
+// how matches.week is keyed
+func sundayOf(date time.Time) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day()-int(date.Weekday()), 0, 0, 0, 0, time.UTC)
+}
+
+// weekOf returns the week t falls in, in WEEK_TIMEZONE
+func weekOf(t time.Time) time.Time {
+	return sundayOf(t.In(weekLocation()))
+}
+
+// parseWeek accepts a date or a timestamp in the week and returns its sunday
+func parseWeek(value string) (time.Time, error) {
+	if len(value) >= len("2006-01-02") {
+		if t, err := time.Parse("2006-01-02", value[:len("2006-01-02")]); err == nil {
+			return sundayOf(t), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid week %q, expected YYYY-MM-DD", value)
+}
+
+// crushCutoff is CRUSH_CUTOFF after week starts in WEEK_TIMEZONE
+func crushCutoff(week time.Time) time.Time {
+	cutoff := defaultCrushCutoff
+	if parsed, err := time.ParseDuration(GetEnv("CRUSH_CUTOFF", "")); err == nil && parsed > 0 {
+		cutoff = parsed
+	}
+	start := time.Date(week.Year(), week.Month(), week.Day(), 0, 0, 0, 0, weekLocation())
+	return start.Add(cutoff)
+}
+
+// queryer is the database or a request's transaction
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// lockUser holds email's users row until tx ends, so the crush checks and
+// outbox inserts of concurrent requests by the same user run one at a time
+func lockUser(ctx context.Context, tx *sql.Tx, email string) error {
+	if _, err := tx.ExecContext(ctx, `SELECT 1 FROM users WHERE email = $1 FOR UPDATE`, email); err != nil {
+		return fmt.Errorf("failed to lock user: %w", err)
+	}
+	return nil
+}
+
+// currentCrush returns the user's crush for week, if any. an update still
+// waiting in the outbox, which sqs-consumer hasn't processed yet, counts as
+// already applied, unless the relay gave up on it.
+func currentCrush(ctx context.Context, q queryer, email string, week time.Time) (string, bool, error) {
+	pendingQuery := `
+		SELECT o.crush_target FROM match_outbox o
+		WHERE o.crush_email = $1 AND o.crush_week = $2 AND o.failed_at IS NULL
+		  AND NOT EXISTS (SELECT 1 FROM processed_messages p WHERE p.idempotency_key = o.idempotency_key)
+		ORDER BY o.id DESC
+		LIMIT 1
+	`
+	var pending sql.NullString
+	err := q.QueryRowContext(ctx, pendingQuery, email, week).Scan(&pending)
+	if err == nil {
+		return pending.String, pending.Valid, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", false, err
+	}
+
+	query := `
+		SELECT CASE WHEN user1_email = $1 THEN user2_email ELSE user1_email END FROM matches
+		WHERE server_generated = false AND week = $2
+		  AND (user1_email = $1 OR (user2_email = $1 AND user2_interested))
+		ORDER BY user1_email = $1 DESC
+		LIMIT 1
+	`
+	var target string
+	err = q.QueryRowContext(ctx, query, email, week).Scan(&target)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return target, true, nil
+}
+
+// relationWith classifies the existing match between email and target in week
+func relationWith(ctx context.Context, q queryer, email, target string, week time.Time) (relation, error) {
+	query := `
+		SELECT user1_email, server_generated, user1_interested AND user2_interested FROM matches
+		WHERE ((user1_email = $1 AND user2_email = $2) OR (user1_email = $2 AND user2_email = $1)) AND week = $3
+	`
+	var user1 string
+	var generated, mutual bool
+	err := q.QueryRowContext(ctx, query, email, target, week).Scan(&user1, &generated, &mutual)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return relationNone, nil
+	case err != nil:
+		return relationNone, err
+	case generated:
+		return relationGenerated, nil
+	case user1 == email:
+		return relationOwn, nil
+	case mutual:
+		return relationReturned, nil
+	default:
+		return relationTheirs, nil
+	}
+}
+
+// isBlocked reports whether either of a and b blocked the other. sqs-consumer
+// checks again before applying a crush, in case a block lands in between.
+func isBlocked(ctx context.Context, q queryer, a, b string) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM blocks
+			WHERE (blocker_email = $1 AND blocked_email = $2)
+			   OR (blocker_email = $2 AND blocked_email = $1)
+		)
+	`
+	var blocked bool
+	if err := q.QueryRowContext(ctx, query, a, b).Scan(&blocked); err != nil {
+		return false, fmt.Errorf("failed to check blocks: %w", err)
+	}
+	return blocked, nil
+}
+
+// checkNewCrush applies the one-crush rule to email picking target in week,
+// in tx after lockUser. it returns the action to queue, or writes a 409 and
+// returns ok false.
+func checkNewCrush(ctx context.Context, tx *sql.Tx, w http.ResponseWriter, email, target string, week time.Time, allowChange bool) (action string, ok bool, err error) {
+	now := time.Now()
+	if email == target {
+		writeConflict(w, reasonSelfCrush, "You can't pick yourself as your crush")
+		return "", false, nil
+	}
+	if !week.Equal(weekOf(now)) {
+		writeConflict(w, reasonPastWeek, "Crushes can only be picked for the current week")
+		return "", false, nil
+	}
+	blocked, err := isBlocked(ctx, tx, email, target)
+	if err != nil {
+		return "", false, err
+	}
+	if blocked {
+		// same answer whichever of the two blocked the other
+		writeConflict(w, reasonBlocked, "You can't pick this user as your crush")
+		return "", false, nil
+	}
+	current, hasCrush, err := currentCrush(ctx, tx, email, week)
+	if err != nil {
+		return "", false, err
+	}
+	if !hasCrush || current == target {
+		return actionUpdate, true, nil
+	}
+	if !allowChange {
+		writeConflict(w, reasonCrushTaken, fmt.Sprintf("You already picked %s as your crush this week; change it with PUT /v1/match/%s/crush/current", current, email))
+		return "", false, nil
+	}
+	if cutoff := crushCutoff(week); now.After(cutoff) {
+		writeConflict(w, reasonCutoffPassed, fmt.Sprintf("Crushes can't be changed after %s", cutoff.Format(time.RFC3339)))
+		return "", false, nil
+	}
+	return actionChangeCrush, true, nil
+}
+
+// HandleGetCurrentCrush returns the user's crush for this week, or 404
+func (s *Server) HandleGetCurrentCrush(w http.ResponseWriter, r *http.Request) {
+	email := r.PathValue("email")
+	emailFromToken, err := s.validateOAuthToken(r)
+	if err != nil || emailFromToken != email {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	week := weekOf(time.Now())
+	target, ok, err := currentCrush(r.Context(), s.DB, email, week)
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to query current crush: %v", err)
+		return
+	}
+	if !ok {
+		http.Error(w, "No crush this week", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	crush := Crush{TargetEmail: target, Week: week.Format("2006-01-02"), ChangeableUntil: crushCutoff(week)}
+	if err := json.NewEncoder(w).Encode(crush); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// HandleSetCrush picks or changes this week's crush. the body is
+// {"target_email": "..."}; changing is only allowed before the cutoff.
+func (s *Server) HandleSetCrush(w http.ResponseWriter, r *http.Request) {
+	printRequestDetails(r)
+	email := r.PathValue("email")
+	emailFromToken, err := s.validateOAuthToken(r)
+	if err != nil || emailFromToken != email {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		TargetEmail string `json:"target_email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.TargetEmail == "" {
+		http.Error(w, "Body must be {\"target_email\": \"...\"}", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	tx, ok := s.beginLocked(w, r, email)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	week := weekOf(time.Now())
+	rel, err := relationWith(ctx, tx, email, body.TargetEmail, week)
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to query match: %v", err)
+		return
+	}
+	action := actionUpdate
+	// a crush on a generated match or an already returned crush is just
+	// interest. a hidden crush on the user goes through the rule like anyone
+	// else, and sqs-consumer turns it into a returned crush, their pick.
+	picksCrush := rel == relationNone || rel == relationOwn || rel == relationTheirs
+	if picksCrush {
+		action, ok, err = checkNewCrush(ctx, tx, w, email, body.TargetEmail, week, true)
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Printf("Failed to query current crush: %v", err)
+			return
+		}
+		if !ok {
+			return
+		}
+	}
+
+	s.queueUpdate(w, r, tx, SQSMessage{
+		EmailSource: email,
+		EmailTarget: body.TargetEmail,
+		Date:        week.Format("2006-01-02"),
+		WantsMatch:  true,
+		Action:      action,
+	}, picksCrush)
+}
+
+// HandleWithdrawCrush removes this week's crush before the cutoff
+func (s *Server) HandleWithdrawCrush(w http.ResponseWriter, r *http.Request) {
+	printRequestDetails(r)
+	email := r.PathValue("email")
+	emailFromToken, err := s.validateOAuthToken(r)
+	if err != nil || emailFromToken != email {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	tx, ok := s.beginLocked(w, r, email)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	week := weekOf(time.Now())
+	target, ok, err := currentCrush(r.Context(), tx, email, week)
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to query current crush: %v", err)
+		return
+	}
+	if !ok {
+		http.Error(w, "No crush this week", http.StatusNotFound)
+		return
+	}
+	if cutoff := crushCutoff(week); time.Now().After(cutoff) {
+		writeConflict(w, reasonCutoffPassed, fmt.Sprintf("Crushes can't be withdrawn after %s", cutoff.Format(time.RFC3339)))
+		return
+	}
+
+	s.queueUpdate(w, r, tx, SQSMessage{
+		EmailSource: email,
+		EmailTarget: target,
+		Date:        week.Format("2006-01-02"),
+		WantsMatch:  false,
+		Action:      actionWithdrawCrush,
+	}, true)
+}
+
+// beginLocked starts the transaction a crush request checks and queues its
+// update in, holding the user's row (see lockUser). on failure it writes a
+// 500 and returns ok false.
+func (s *Server) beginLocked(w http.ResponseWriter, r *http.Request, email string) (*sql.Tx, bool) {
+	tx, err := s.DB.BeginTx(r.Context(), &sql.TxOptions{})
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to begin tx: %v", err)
+		return nil, false
+	}
+	if err := lockUser(r.Context(), tx, email); err != nil {
+		_ = tx.Rollback()
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to lock user %s: %v", email, err)
+		return nil, false
+	}
+	return tx, true
+}
@@ -30,14 +30,14 @@ func GetEnv(key, defaultVal string) string {
 	return defaultVal
 }
 
-func ConnectToDB() *sql.DB {
+// DSN builds the connection string from the DB_* environment variables
+func DSN() string {
 	dbUser := GetEnv("DB_USERNAME", "localtest")
 	dbPassword := GetEnv("DB_PASSWORD", "localtest")
 	dbEndpoint := GetEnv("DB_ENDPOINT", "localhost")
 	dbPort := GetEnv("DB_PORT", "5432")
 	dbName := GetEnv("DB_NAME", "my_database")
 	fmt.Println("DB_USER:", dbUser)
-	fmt.Println("DB_PASSWORD:", dbPassword)
 
 	if dbUser == "" || dbPassword == "" || dbEndpoint == "" || dbPort == "" || dbName == "" {
 		log.Fatal("One or more required environment variables are missing")
@@ -56,10 +56,13 @@ func ConnectToDB() *sql.DB {
 	dbIP := ips[0].String()
 	log.Printf("Resolved %s to %s", dbEndpoint, dbIP)
 
-	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=require",
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=require",
 		dbIP, dbPort, dbUser, dbPassword, dbName)
+}
 
-	db, err := sql.Open("postgres", psqlInfo)
+// ConnectToDB opens and pings the database at dsn (see DSN)
+func ConnectToDB(dsn string) *sql.DB {
+	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		log.Fatalf("Unable to connect to DB: %v", err)
 	}
@@ -0,0 +1,133 @@
+/***************************************************************************
+ * File Name: match-service/server/explain_match.go
+ * Author: Bryan SebaRaj
+ * Description: Handler explaining why a user was matched with a partner
+ * Date Created: 01-07-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// storedExplanation mirrors engine.Explanation in match-generator, as stored
+// in match_explanations
+type storedExplanation struct {
+	Distance   float64 `json:"distance"`
+	Rank       int     `json:"rank"`
+	Candidates int     `json:"candidates"`
+	Answers    float64 `json:"answers"`
+	// level of each question's part in Answers
+	Questions       []string           `json:"questions"`
+	Terms           map[string]float64 `json:"terms"`
+	SharedInterests []string           `json:"shared_interests"`
+}
+
+// QuestionContribution is how much a question added to the distance: low,
+// medium, or high
+type QuestionContribution struct {
+	Question     int    `json:"question"`
+	Contribution string `json:"contribution"`
+}
+
+// MatchExplanation holds only the source's view of the distance; the target's
+// answers are never returned
+type MatchExplanation struct {
+	SourceEmail string `json:"source_email"`
+	TargetEmail string `json:"target_email"`
+	Week        Date   `json:"week"`
+	// lower is more compatible, in [0, 1] before any rematch penalty
+	Distance float64 `json:"distance"`
+	// 1-based rank of the target among the source's candidates, or 0 if the
+	// target picked the source from their own candidates
+	Rank       int `json:"rank"`
+	Candidates int `json:"candidates"`
+	// share of Distance from the questionnaire
+	Answers         float64                `json:"answers"`
+	Questions       []QuestionContribution `json:"questions"`
+	Terms           map[string]float64     `json:"terms"`
+	SharedInterests []string               `json:"shared_interests"`
+}
+
+// HandleExplainMatch returns the explanation recorded by the match generator for
+// the most recent server generated match between email and target
+func (s *Server) HandleExplainMatch(w http.ResponseWriter, r *http.Request) {
+	printRequestDetails(r)
+	email, target := r.PathValue("email"), r.PathValue("target")
+	if email == "" || target == "" {
+		http.Error(w, "Email and target are required", http.StatusBadRequest)
+		return
+	}
+	emailFromToken, err := s.validateOAuthToken(r)
+	if err != nil || emailFromToken != email {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	log.Printf("GET request for explanation of match between %s and %s", email, target)
+
+	query := `
+		SELECT e.explanation, m.week
+		FROM matches m
+		JOIN match_explanations e ON e.run_id = m.run_id AND e.email = $1 AND e.partner_email = $2
+		WHERE m.server_generated = true
+		  AND ((m.user1_email = $1 AND m.user2_email = $2) OR (m.user1_email = $2 AND m.user2_email = $1))
+		ORDER BY m.week DESC
+		LIMIT 1
+	`
+	var raw []byte
+	result := MatchExplanation{SourceEmail: email, TargetEmail: target}
+	err = s.DB.QueryRowContext(r.Context(), query, email, target).Scan(&raw, &result.Week)
+	if errors.Is(err, sql.ErrNoRows) {
+		// user generated matches have no explanation either
+		http.Error(w, "No generated match with this user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to query database: %v", err)
+		return
+	}
+
+	var stored storedExplanation
+	if err = json.Unmarshal(raw, &stored); err != nil {
+		http.Error(w, "Failed to read explanation", http.StatusInternalServerError)
+		log.Printf("Failed to unmarshal explanation: %v", err)
+		return
+	}
+	result.Distance = stored.Distance
+	result.Rank = stored.Rank
+	result.Candidates = stored.Candidates
+	result.Answers = stored.Answers
+	result.Terms = stored.Terms
+	result.SharedInterests = stored.SharedInterests
+	result.Questions = []QuestionContribution{}
+	for k, level := range stored.Questions {
+		result.Questions = append(result.Questions, QuestionContribution{Question: k + 1, Contribution: level})
+	}
+
+	jsonResponse, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "Failed to marshal JSON response", http.StatusInternalServerError)
+		log.Printf("Failed to marshal JSON response: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonResponse)
+	if err != nil {
+		log.Printf("Failed to write response: %v", err)
+		return
+	}
+}
@@ -13,22 +13,300 @@
 package server
 
 import (
-	// "database/sql"
+	"context"
+	"database/sql"
+	"encoding/base64"
 	"encoding/json"
-	// "fmt"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// Date is a calendar date, written as YYYY-MM-DD. it also reads timestamps,
+// which older clients send back from the week field.
+type Date struct {
+	time.Time
+}
+
+func (d Date) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Format("2006-01-02"))
+}
+
+func (d *Date) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	week, err := parseWeek(value)
+	if err != nil {
+		return err
+	}
+	d.Time = week
+	return nil
+}
+
+func (d *Date) Scan(src any) error {
+	t, ok := src.(time.Time)
+	if !ok {
+		return fmt.Errorf("cannot scan %T into Date", src)
+	}
+	d.Time = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return nil
+}
+
+// Match is the source's view of a match. the target's interest is only
+// revealed, along with their contact info, once both sides are interested.
 type Match struct {
 	SourceEmail      string `json:"source_email"`
 	TargetEmail      string `json:"target_email"`
 	SourceInterested bool   `json:"source_interested"`
-	TargetInterested bool   `json:"target_interested"`
-	ServerGenerated  bool   `json:"server_generated"`
-	Week             string `json:"week"`
+	// always false until the match is mutual
+	TargetInterested bool `json:"target_interested"`
+	Mutual           bool `json:"mutual"`
+	ServerGenerated  bool `json:"server_generated"`
+	// sunday starting the week of the match
+	Week Date `json:"week"`
+	// only set on mutual matches
+	Contact *Contact `json:"contact,omitempty"`
+	// the source picked the target as their crush
+	ownCrush bool
+}
+
+// Contact is how to reach the target of a mutual match, from users
+type Contact struct {
+	Instagram   string `json:"instagram,omitempty"`
+	Snapchat    string `json:"snapchat,omitempty"`
+	PhoneNumber string `json:"phone_number,omitempty"`
 }
 
+type MatchPage struct {
+	Matches []Match `json:"matches"`
+	// pass as ?cursor= for the next page; empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type CurrentMatches struct {
+	Week            Date    `json:"week"`
+	Recommendations []Match `json:"recommendations"`
+	Crush           *Match  `json:"crush"`
+}
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// matchCursor is the last row of a page, in listing order (week desc, then emails)
+type matchCursor struct {
+	Week   string `json:"w"`
+	User1  string `json:"a"`
+	User2  string `json:"b"`
+	cursor bool
+}
+
+func (c matchCursor) encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(value string) (matchCursor, error) {
+	var c matchCursor
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err == nil {
+		err = json.Unmarshal(raw, &c)
+	}
+	if err != nil || c.User1 == "" || c.User2 == "" {
+		return c, errors.New("invalid cursor")
+	}
+	if _, err := time.Parse("2006-01-02", c.Week); err != nil {
+		return c, errors.New("invalid cursor")
+	}
+	c.cursor = true
+	return c, nil
+}
+
+// matchFilter is the parsed query string of a listing
+type matchFilter struct {
+	from, to        *time.Time
+	serverGenerated *bool
+	// 0 lists every match, unpaginated
+	limit int
+	after matchCursor
+}
+
+// paginated reports whether the listing was asked for a page, with limit or
+// cursor; older clients ask for neither and get every match as a bare array
+func (f matchFilter) paginated() bool {
+	return f.limit > 0
+}
+
+// parseMatchFilter reads week, from, to (dates, inclusive, by week),
+// server_generated, limit, and cursor
+func parseMatchFilter(r *http.Request) (matchFilter, error) {
+	query := r.URL.Query()
+	filter := matchFilter{}
+	if query.Has("limit") || query.Has("cursor") {
+		filter.limit = defaultPageSize
+	}
+	weekParam := func(name string) (*time.Time, error) {
+		if value := query.Get(name); value != "" {
+			week, err := parseWeek(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			return &week, nil
+		}
+		return nil, nil
+	}
+
+	var err error
+	if filter.from, err = weekParam("from"); err != nil {
+		return filter, err
+	}
+	if filter.to, err = weekParam("to"); err != nil {
+		return filter, err
+	}
+	week, err := weekParam("week")
+	if err != nil {
+		return filter, err
+	}
+	if week != nil {
+		if filter.from != nil || filter.to != nil {
+			return filter, errors.New("week can't be combined with from or to")
+		}
+		filter.from, filter.to = week, week
+	}
+	if value := query.Get("server_generated"); value != "" {
+		generated, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, fmt.Errorf("server_generated: expected true or false")
+		}
+		filter.serverGenerated = &generated
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return filter, fmt.Errorf("limit: expected 1 to %d", maxPageSize)
+		}
+		filter.limit = limit
+	}
+	if value := query.Get("cursor"); value != "" {
+		if filter.after, err = decodeCursor(value); err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+// matchSelect reads matches m as seen by the user in $1: the partner's
+// contact info is only selected on mutual matches, and another user's crush
+// on them stays hidden until they return it
+const matchSelect = `
+		SELECT m.user1_email, m.user2_email, m.user1_interested, m.user2_interested, m.server_generated, m.week,
+		       CASE WHEN m.user1_interested AND m.user2_interested THEN u.instagram END,
+		       CASE WHEN m.user1_interested AND m.user2_interested THEN u.snapchat END,
+		       CASE WHEN m.user1_interested AND m.user2_interested THEN u.phone_number END
+		FROM matches m
+		LEFT JOIN users u ON u.email = CASE WHEN m.user1_email = $1 THEN m.user2_email ELSE m.user1_email END
+		WHERE (m.server_generated OR m.user1_email = $1 OR (m.user1_interested AND m.user2_interested))
+`
+
+// scanMatch scans a matchSelect row into email's view of it
+func scanMatch(row interface{ Scan(dest ...any) error }, email string) (match Match, user1, user2 string, err error) {
+	var instagram, snapchat, phone sql.NullString
+	err = row.Scan(&user1, &user2, &match.SourceInterested, &match.TargetInterested, &match.ServerGenerated, &match.Week,
+		&instagram, &snapchat, &phone)
+	if err != nil {
+		return Match{}, "", "", err
+	}
+	contact := Contact{Instagram: instagram.String, Snapchat: snapchat.String, PhoneNumber: phone.String}
+	return renderMatch(email, user1, user2, match, contact), user1, user2, nil
+}
+
+// listMatches returns one page of email's matches, newest week first, and the
+// cursor of the next page. unpaginated filters return every match.
+func (s *Server) listMatches(ctx context.Context, email string, filter matchFilter) ([]Match, string, error) {
+	conditions := []string{"(m.user1_email = $1 OR m.user2_email = $1)"}
+	args := []any{email}
+	arg := func(value any) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if filter.from != nil {
+		conditions = append(conditions, "m.week >= "+arg(*filter.from))
+	}
+	if filter.to != nil {
+		// to is inclusive of its whole week
+		conditions = append(conditions, "m.week < "+arg(filter.to.AddDate(0, 0, 7)))
+	}
+	if filter.serverGenerated != nil {
+		conditions = append(conditions, "m.server_generated = "+arg(*filter.serverGenerated))
+	}
+	if filter.after.cursor {
+		week, user1, user2 := arg(filter.after.Week), arg(filter.after.User1), arg(filter.after.User2)
+		conditions = append(conditions, fmt.Sprintf(
+			"(m.week < %[1]s::timestamp OR (m.week = %[1]s::timestamp AND (m.user1_email, m.user2_email) > (%[2]s, %[3]s)))",
+			week, user1, user2))
+	}
+	query := fmt.Sprintf(`%s
+		  AND %s
+		ORDER BY m.week DESC, m.user1_email, m.user2_email
+	`, matchSelect, strings.Join(conditions, " AND "))
+	if filter.paginated() {
+		// one extra row tells whether there is another page
+		query += "LIMIT " + arg(filter.limit+1)
+	}
+
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query database: %w", err)
+	}
+	defer rows.Close()
+
+	results := []Match{}
+	var last matchCursor
+	for rows.Next() {
+		result, user1, user2, err := scanMatch(rows, email)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to scan database results: %w", err)
+		}
+		if filter.paginated() && len(results) == filter.limit {
+			return results, last.encode(), nil
+		}
+		last = matchCursor{Week: result.Week.Format("2006-01-02"), User1: user1, User2: user2}
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("error iterating rows: %w", err)
+	}
+	return results, "", nil
+}
+
+// renderMatch turns a matches row, scanned into m with user1's columns as
+// the source, into email's view of it. this is the only place a match is
+// shaped for a user, so the target's interest and contact are hidden here.
+func renderMatch(email, user1, user2 string, m Match, contact Contact) Match {
+	m.ownCrush = !m.ServerGenerated && user1 == email
+	m.SourceEmail, m.TargetEmail = user1, user2
+	if user1 != email {
+		m.SourceEmail, m.TargetEmail = user2, user1
+		m.SourceInterested, m.TargetInterested = m.TargetInterested, m.SourceInterested
+	}
+	m.Mutual = m.SourceInterested && m.TargetInterested
+	m.TargetInterested = m.Mutual
+	if m.Mutual {
+		m.Contact = &contact
+	}
+	return m
+}
+
+// HandleGetMatch lists the user's matches, filtered and paginated by the query
+// string (see parseMatchFilter). without limit or cursor it returns the bare
+// array of matches older clients expect; with either, a MatchPage.
 func (s *Server) HandleGetMatch(w http.ResponseWriter, r *http.Request) {
 	printRequestDetails(r)
 	email := r.URL.Path[len("/v1/match/"):]
@@ -45,66 +323,56 @@ func (s *Server) HandleGetMatch(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("GET request for matches for user: %s", email)
 
-	tx, err := s.DB.Begin()
+	filter, err := parseMatchFilter(r)
 	if err != nil {
-		http.Error(w, "Failed to start database transaction", http.StatusInternalServerError)
-		log.Printf("Failed to start database transaction: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	// no-op in psql if tx.Commit is called first
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-			log.Printf("Transaction rolled back: %v", err)
-		}
-	}()
-
-	query := `
-		SELECT user1_email, user2_email, user1_interested, user2_interested, server_generated, week FROM matches WHERE user1_email = $1 OR user2_email = $1
-	`
-	rows, queryErr := tx.Query(query, email)
-	if queryErr != nil {
+	matches, next, err := s.listMatches(r.Context(), email, filter)
+	if err != nil {
 		http.Error(w, "Failed to query database", http.StatusInternalServerError)
-		log.Printf("Failed to query database: %v", queryErr)
-		err = queryErr
+		log.Printf("Failed to list matches: %v", err)
 		return
 	}
-	// array of matches
-	defer rows.Close()
-
-	var results []Match
-
-	for rows.Next() {
-		var result Match
-		scanErr := rows.Scan(&result.SourceEmail, &result.TargetEmail, &result.SourceInterested, &result.TargetInterested, &result.ServerGenerated, &result.Week)
-		if scanErr != nil {
-			http.Error(w, "Failed to scan database results", http.StatusInternalServerError)
-			log.Printf("Failed to scan database results: %v", scanErr)
-			err = scanErr
-			return
-		}
-		if result.SourceEmail != email {
-			result.SourceEmail, result.TargetEmail = result.TargetEmail, result.SourceEmail
-			result.SourceInterested, result.TargetInterested = result.TargetInterested, result.SourceInterested
-		}
-		results = append(results, result)
+	if !filter.paginated() {
+		writeJSON(w, matches)
+		return
 	}
-	errNext := rows.Err()
-	if errNext != nil {
-		http.Error(w, "Error iterating rows", http.StatusInternalServerError)
-		log.Printf("Error iterating rows: %v", errNext)
-		err = errNext
+	writeJSON(w, MatchPage{Matches: matches, NextCursor: next})
+}
+
+// HandleGetCurrentMatches returns this week's recommendations and the user's crush
+func (s *Server) HandleGetCurrentMatches(w http.ResponseWriter, r *http.Request) {
+	email := r.PathValue("email")
+	emailFromToken, err := s.validateOAuthToken(r)
+	if err != nil || emailFromToken != email {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
 
-	err = tx.Commit()
+	week := weekOf(time.Now())
+	// a user has a handful of matches per week, so one page holds them all
+	matches, _, err := s.listMatches(r.Context(), email, matchFilter{from: &week, to: &week, limit: maxPageSize})
 	if err != nil {
-		http.Error(w, "Failed to commit database transaction", http.StatusInternalServerError)
-		log.Printf("Failed to commit database transaction: %v", err)
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to list matches: %v", err)
 		return
 	}
 
-	jsonResponse, err := json.Marshal(results)
+	current := CurrentMatches{Week: Date{week}, Recommendations: []Match{}}
+	for i, match := range matches {
+		switch {
+		case match.ServerGenerated:
+			current.Recommendations = append(current.Recommendations, match)
+		case match.ownCrush:
+			current.Crush = &matches[i]
+		}
+	}
+	writeJSON(w, current)
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	jsonResponse, err := json.Marshal(value)
 	if err != nil {
 		http.Error(w, "Failed to marshal JSON response", http.StatusInternalServerError)
 		log.Printf("Failed to marshal JSON response: %v", err)
@@ -113,10 +381,7 @@ func (s *Server) HandleGetMatch(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	_, err = w.Write(jsonResponse)
-	if err != nil {
-		http.Error(w, "Failed to write response", http.StatusInternalServerError)
+	if _, err := w.Write(jsonResponse); err != nil {
 		log.Printf("Failed to write response: %v", err)
-		return
 	}
 }
@@ -0,0 +1,225 @@
+/***************************************************************************
+ * File Name: match-service/server/outbox.go
+ * Author: Bryan SebaRaj
+ * Description: Transactional outbox for match updates and the relay that
+ *              publishes them
+ * Date Created: 01-07-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	defaultRelayInterval  = time.Second
+	defaultRelayBatchSize = 25
+	relayBaseBackoff      = time.Second
+	relayMaxBackoff       = 5 * time.Minute
+	// attempts before a row is marked failed and left for an operator
+	relayMaxAttempts = 10
+	// how long a claimed row is left to its relay before another may claim it,
+	// in case the first died before recording the outcome
+	relayClaimTimeout = time.Minute
+)
+
+// enqueueMatchUpdate stores msg in match_outbox in tx; the relay publishes it
+// later, so the update survives SQS being unavailable. updates that pick or
+// withdraw a crush also record the crush (see currentCrush).
+func enqueueMatchUpdate(ctx context.Context, tx *sql.Tx, msg SQSMessage, picksCrush bool) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	var crushEmail, crushWeek, crushTarget sql.NullString
+	if picksCrush {
+		crushEmail = sql.NullString{String: msg.EmailSource, Valid: true}
+		crushWeek = sql.NullString{String: msg.Date, Valid: true}
+		crushTarget = sql.NullString{String: msg.EmailTarget, Valid: msg.WantsMatch}
+	}
+	insertSQL := `
+		INSERT INTO match_outbox (idempotency_key, body, crush_email, crush_week, crush_target)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	if _, err := tx.ExecContext(ctx, insertSQL, msg.IdempotencyKey, string(body), crushEmail, crushWeek, crushTarget); err != nil {
+		return fmt.Errorf("failed to write outbox: %w", err)
+	}
+	return nil
+}
+
+// Relay publishes unpublished match_outbox rows, retrying failures with
+// exponential backoff until relayMaxAttempts, when the row is marked failed.
+// several relays can run at once; rows are claimed with SKIP LOCKED. a row
+// whose publish succeeded but wasn't marked published is sent again once its
+// claim times out, which sqs-consumer dedupes by idempotency key.
+type Relay struct {
+	DB        *sql.DB
+	Publisher Publisher
+	Interval  time.Duration
+	BatchSize int
+}
+
+func NewRelay(db *sql.DB, publisher Publisher) *Relay {
+	return &Relay{
+		DB:        db,
+		Publisher: publisher,
+		Interval:  defaultRelayInterval,
+		BatchSize: defaultRelayBatchSize,
+	}
+}
+
+// Run relays until ctx is done
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		// keep draining while full batches come back
+		for {
+			published, err := r.RelayOnce(ctx)
+			if err != nil {
+				log.Printf("Outbox relay failed: %v", err)
+				break
+			}
+			if published < r.BatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RelayOnce publishes up to BatchSize due rows and returns how many it
+// handled. rows are claimed and the claim committed before anything is
+// published, so no row lock is held while SQS is called.
+func (r *Relay) RelayOnce(ctx context.Context) (handled int, err error) {
+	if err := r.failAbandoned(ctx); err != nil {
+		return 0, err
+	}
+
+	// claiming counts the attempt and pushes next_attempt_at past
+	// relayClaimTimeout, in case this relay dies before recording the outcome
+	claimQuery := `
+		UPDATE match_outbox
+		SET attempts = attempts + 1, next_attempt_at = CURRENT_TIMESTAMP + $2 * INTERVAL '1 millisecond'
+		WHERE id IN (
+			SELECT id FROM match_outbox
+			WHERE published_at IS NULL AND failed_at IS NULL AND attempts < $3 AND next_attempt_at <= CURRENT_TIMESTAMP
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, body, attempts
+	`
+	rows, err := r.DB.QueryContext(ctx, claimQuery, r.BatchSize, relayClaimTimeout.Milliseconds(), relayMaxAttempts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim outbox rows: %w", err)
+	}
+	type outboxRow struct {
+		id       int
+		body     string
+		attempts int
+	}
+	var due []outboxRow
+	for rows.Next() {
+		var row outboxRow
+		if err = rows.Scan(&row.id, &row.body, &row.attempts); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan outbox: %w", err)
+		}
+		due = append(due, row)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to iterate outbox: %w", err)
+	}
+	// RETURNING doesn't follow the subquery's order
+	sort.Slice(due, func(i, j int) bool { return due[i].id < due[j].id })
+
+	publishedSQL := `
+		UPDATE match_outbox SET published_at = CURRENT_TIMESTAMP, last_error = NULL WHERE id = $1
+	`
+	for _, row := range due {
+		if pubErr := r.Publisher.Publish(ctx, row.body); pubErr != nil {
+			if err = r.markFailed(ctx, row.id, row.attempts, pubErr); err != nil {
+				return handled, err
+			}
+		} else if _, err = r.DB.ExecContext(ctx, publishedSQL, row.id); err != nil {
+			return handled, fmt.Errorf("failed to mark outbox row %d published: %w", row.id, err)
+		}
+		handled++
+	}
+	return handled, nil
+}
+
+// markFailed schedules a retry after a failed publish, with exponential
+// backoff. a row that has failed relayMaxAttempts times is marked failed.
+func (r *Relay) markFailed(ctx context.Context, id, attempts int, pubErr error) error {
+	if attempts >= relayMaxAttempts {
+		failSQL := `
+			UPDATE match_outbox SET failed_at = CURRENT_TIMESTAMP, last_error = $2 WHERE id = $1
+		`
+		if _, err := r.DB.ExecContext(ctx, failSQL, id, pubErr.Error()); err != nil {
+			return fmt.Errorf("failed to mark outbox row %d failed: %w", id, err)
+		}
+		log.Printf("Outbox row %d failed permanently after %d attempts: %v", id, attempts, pubErr)
+		return nil
+	}
+	log.Printf("Failed to publish outbox row %d (attempt %d): %v", id, attempts, pubErr)
+	retrySQL := `
+		UPDATE match_outbox
+		SET last_error = $2, next_attempt_at = CURRENT_TIMESTAMP + $3 * INTERVAL '1 millisecond'
+		WHERE id = $1
+	`
+	if _, err := r.DB.ExecContext(ctx, retrySQL, id, pubErr.Error(), relayBackoff(attempts).Milliseconds()); err != nil {
+		return fmt.Errorf("failed to reschedule outbox row %d: %w", id, err)
+	}
+	return nil
+}
+
+// failAbandoned marks failed the rows whose last allowed attempt was claimed
+// by a relay that died before recording the outcome
+func (r *Relay) failAbandoned(ctx context.Context) error {
+	failSQL := `
+		UPDATE match_outbox
+		SET failed_at = CURRENT_TIMESTAMP, last_error = COALESCE(last_error, 'relay stopped while publishing')
+		WHERE published_at IS NULL AND failed_at IS NULL AND attempts >= $1 AND next_attempt_at <= CURRENT_TIMESTAMP
+		RETURNING id, attempts
+	`
+	rows, err := r.DB.QueryContext(ctx, failSQL, relayMaxAttempts)
+	if err != nil {
+		return fmt.Errorf("failed to fail abandoned outbox rows: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, attempts int
+		if err := rows.Scan(&id, &attempts); err != nil {
+			return fmt.Errorf("failed to scan outbox: %w", err)
+		}
+		log.Printf("Outbox row %d failed permanently after %d attempts: abandoned while publishing", id, attempts)
+	}
+	return rows.Err()
+}
+
+// relayBackoff doubles the wait after every failed attempt, up to relayMaxBackoff
+func relayBackoff(attempts int) time.Duration {
+	backoff := relayBaseBackoff
+	for i := 1; i < attempts && backoff < relayMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, relayMaxBackoff)
+}
@@ -0,0 +1,69 @@
+/***************************************************************************
+ * File Name: match-service/server/publisher.go
+ * Author: Bryan SebaRaj
+ * Description: Publishers the outbox relay sends match updates through
+ * Date Created: 01-07-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// Publisher delivers a message body to the match queue
+type Publisher interface {
+	Publish(ctx context.Context, body string) error
+}
+
+type SQSPublisher struct {
+	Client   *sqs.Client
+	QueueURL string
+}
+
+func NewSQSPublisher(client *sqs.Client, queueURL string) *SQSPublisher {
+	return &SQSPublisher{Client: client, QueueURL: queueURL}
+}
+
+func (p *SQSPublisher) Publish(ctx context.Context, body string) error {
+	input := &sqs.SendMessageInput{
+		QueueUrl:    aws.String(p.QueueURL),
+		MessageBody: aws.String(body),
+	}
+	_, err := p.Client.SendMessage(ctx, input)
+	return err
+}
+
+// MemoryPublisher keeps published messages in memory, for tests and local runs.
+// if Err is set, Publish fails with it instead.
+type MemoryPublisher struct {
+	mu       sync.Mutex
+	Messages []string
+	Err      error
+}
+
+func (p *MemoryPublisher) Publish(ctx context.Context, body string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Err != nil {
+		return p.Err
+	}
+	p.Messages = append(p.Messages, body)
+	return nil
+}
+
+// Published returns a copy of the messages published so far
+func (p *MemoryPublisher) Published() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.Messages...)
+}
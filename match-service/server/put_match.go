@@ -13,15 +13,13 @@
 package server
 
 import (
-	// "database/sql"
-	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	// "fmt"
 	"log"
 	"net/http"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/sqs"
 )
 
 type SQSMessage struct {
@@ -29,10 +27,23 @@ type SQSMessage struct {
 	EmailTarget string `json:"email_target"`
 	Date        string `json:"date"`
 	WantsMatch  bool   `json:"wants_match"`
+	// lets sqs-consumer skip redelivered copies of the message
+	IdempotencyKey string `json:"idempotency_key"`
+	// empty for interest updates; see the actions in crush.go
+	Action string `json:"action,omitempty"`
+}
+
+// newIdempotencyKey returns 128 random bits, hex encoded
+func newIdempotencyKey() (string, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
 }
 
 func (s *Server) HandleUpdateMatch(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+	ctx := r.Context()
 	printRequestDetails(r)
 	email := r.URL.Path[len("/v1/match/"):]
 	if email == "" {
@@ -60,32 +71,86 @@ func (s *Server) HandleUpdateMatch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	week := incomingMatch.Week.Time
+	if week.IsZero() {
+		http.Error(w, "Week is required", http.StatusBadRequest)
+		return
+	}
 	msg := SQSMessage{
 		EmailSource: incomingMatch.SourceEmail,
 		EmailTarget: incomingMatch.TargetEmail,
-		Date:        incomingMatch.Week,
+		Date:        week.Format("2006-01-02"),
 		WantsMatch:  incomingMatch.SourceInterested || incomingMatch.TargetInterested,
 	}
 
-	body, err := json.Marshal(msg)
+	tx, ok := s.beginLocked(w, r, email)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	// answering a generated match or a returned crush is always allowed;
+	// anything else picks a new crush, which is subject to the one-crush rule.
+	// a hidden crush on the user is treated like no match, so the response
+	// never tells them it exists.
+	rel, err := relationWith(ctx, tx, email, msg.EmailTarget, week)
 	if err != nil {
-		http.Error(w, "Failed to marshal message", http.StatusInternalServerError)
-		log.Printf("Failed to marshal message: %v", err)
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to query match: %v", err)
 		return
 	}
+	switch {
+	case rel == relationOwn && !msg.WantsMatch:
+		http.Error(w, "Withdraw a crush with DELETE /v1/match/"+email+"/crush/current", http.StatusBadRequest)
+		return
+	case rel == relationNone && !msg.WantsMatch:
+		// nothing to decline; answer as if a hidden crush had been declined
+		writeQueued(w)
+		return
+	case rel.hidden() && msg.WantsMatch:
+		_, ok, checkErr := checkNewCrush(ctx, tx, w, email, msg.EmailTarget, week, false)
+		if checkErr != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Printf("Failed to query current crush: %v", checkErr)
+			return
+		}
+		if !ok {
+			return
+		}
+	}
 
-	input := &sqs.SendMessageInput{
-		QueueUrl:    aws.String(s.SQS_URL),
-		MessageBody: aws.String(string(body)),
+	// returning a crush picks it, and declining a returned one frees the pick
+	picksCrush := rel.hidden() && msg.WantsMatch || rel == relationReturned && !msg.WantsMatch
+	s.queueUpdate(w, r, tx, msg, picksCrush)
+}
+
+// queueUpdate writes msg to the outbox under a fresh idempotency key and
+// commits tx. picksCrush marks msg as setting or withdrawing the source's
+// crush, which currentCrush then counts until it is processed.
+func (s *Server) queueUpdate(w http.ResponseWriter, r *http.Request, tx *sql.Tx, msg SQSMessage, picksCrush bool) {
+	idempotencyKey, err := newIdempotencyKey()
+	if err != nil {
+		http.Error(w, "Failed to generate idempotency key", http.StatusInternalServerError)
+		log.Printf("Failed to generate idempotency key: %v", err)
+		return
 	}
+	msg.IdempotencyKey = idempotencyKey
 
-	_, err = s.SQS_Client.SendMessage(ctx, input)
+	err = enqueueMatchUpdate(r.Context(), tx, msg, picksCrush)
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
-		http.Error(w, "Failed to send message to SQS", http.StatusInternalServerError)
-		log.Printf("Failed to send message to SQS: %v", err)
+		http.Error(w, "Failed to queue match update", http.StatusInternalServerError)
+		log.Printf("Failed to queue match update: %v", err)
 		return
 	}
 
+	writeQueued(w)
+}
+
+// writeQueued answers a match update that was accepted
+func writeQueued(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 }
@@ -15,25 +15,36 @@ package server
 import (
 	"database/sql"
 	"net/http"
-
-	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"time"
 )
 
+// match updates reach SQS through the outbox (see outbox.go), not from handlers
 type Server struct {
-	DB         *sql.DB
-	SQS_URL    string
-	SQS_Client *sqs.Client
+	DB *sql.DB
+	// open match streams; see stream.go
+	Hub *Hub
+	// checks request tokens; VerifyGoogleToken outside of tests
+	VerifyToken TokenVerifier
+	// how often open streams re-check their token
+	StreamTokenCheck time.Duration
 }
 
-func NewServer(db *sql.DB, sqs_url string, sqs_client *sqs.Client) *Server {
+func NewServer(db *sql.DB) *Server {
 	return &Server{
-		DB:         db,
-		SQS_URL:    sqs_url,
-		SQS_Client: sqs_client,
+		DB:               db,
+		Hub:              NewHub(),
+		VerifyToken:      VerifyGoogleToken,
+		StreamTokenCheck: streamTokenCheck,
 	}
 }
 
 func (s *Server) InitializeRoutes(router *http.ServeMux) {
-	router.HandleFunc("GET /v1/match/", s.corsMiddleware(s.HandleGetMatch))    // gets all matches belonging to user
-	router.HandleFunc("PUT /v1/match/", s.corsMiddleware(s.HandleUpdateMatch)) // updates match status
+	router.HandleFunc("GET /v1/match/", s.corsMiddleware(s.HandleGetMatch))                              // lists the user's matches, filtered and paginated
+	router.HandleFunc("PUT /v1/match/", s.corsMiddleware(s.HandleUpdateMatch))                           // updates match status
+	router.HandleFunc("GET /v1/match/{email}/explain/{target}", s.corsMiddleware(s.HandleExplainMatch))  // why email was matched with target
+	router.HandleFunc("GET /v1/match/{email}/stream", s.corsMiddleware(s.HandleMatchStream))             // server-sent events of match changes
+	router.HandleFunc("GET /v1/match/{email}/current", s.corsMiddleware(s.HandleGetCurrentMatches))      // this week's recommendations and crush
+	router.HandleFunc("GET /v1/match/{email}/crush/current", s.corsMiddleware(s.HandleGetCurrentCrush))  // this week's crush
+	router.HandleFunc("PUT /v1/match/{email}/crush/current", s.corsMiddleware(s.HandleSetCrush))         // pick or change this week's crush
+	router.HandleFunc("DELETE /v1/match/{email}/crush/current", s.corsMiddleware(s.HandleWithdrawCrush)) // withdraw this week's crush
 }
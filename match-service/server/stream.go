@@ -0,0 +1,293 @@
+/***************************************************************************
+ * File Name: match-service/server/stream.go
+ * Author: Bryan SebaRaj
+ * Description: Server-Sent Events stream of match changes, fed by Postgres
+ *              LISTEN/NOTIFY from sqs-consumer
+ * Date Created: 01-07-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// channel sqs-consumer notifies on after committing a match change
+	matchUpdatesChannel = "match_updates"
+	// comment lines keep proxies from closing idle streams
+	streamHeartbeat = 25 * time.Second
+	// events buffered per stream before a slow client starts losing them
+	streamBuffer = 16
+	// how often an open stream re-checks its token, so it ends soon after the
+	// token expires
+	streamTokenCheck = time.Minute
+)
+
+// matchNotification is the payload sqs-consumer sends on matchUpdatesChannel
+type matchNotification struct {
+	User1 string `json:"user1_email"`
+	User2 string `json:"user2_email"`
+	Week  string `json:"week"`
+	// the user whose action changed the match
+	Source string `json:"source_email"`
+	// the match became or stopped being mutual
+	MutualChanged bool `json:"mutual_changed"`
+}
+
+// MatchEvent is pushed to a stream. Type is "match" with the subscriber's view
+// of the changed match, "match_removed" when a crush is withdrawn, or "resync"
+// when updates may have been missed and the client should refetch.
+type MatchEvent struct {
+	Type  string `json:"type"`
+	Match *Match `json:"match,omitempty"`
+	// set for match_removed
+	TargetEmail string `json:"target_email,omitempty"`
+	Week        *Date  `json:"week,omitempty"`
+}
+
+// Hub fans match events out to the open streams of each user
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan MatchEvent]struct{}
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func NewHub() *Hub {
+	return &Hub{subscribers: map[string]map[chan MatchEvent]struct{}{}, closed: make(chan struct{})}
+}
+
+// Close ends every open stream, and any opened later. streams outlive the
+// requests http.Server.Shutdown waits for, so register it with
+// RegisterOnShutdown.
+func (h *Hub) Close() {
+	h.closeOnce.Do(func() { close(h.closed) })
+}
+
+// Done is closed once the hub is
+func (h *Hub) Done() <-chan struct{} {
+	return h.closed
+}
+
+// Subscribe returns a channel of email's events and a func that closes it
+func (h *Hub) Subscribe(email string) (<-chan MatchEvent, func()) {
+	ch := make(chan MatchEvent, streamBuffer)
+	h.mu.Lock()
+	if h.subscribers[email] == nil {
+		h.subscribers[email] = map[chan MatchEvent]struct{}{}
+	}
+	h.subscribers[email][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subscribers[email], ch)
+		if len(h.subscribers[email]) == 0 {
+			delete(h.subscribers, email)
+		}
+	}
+}
+
+func (h *Hub) HasSubscribers(email string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers[email]) > 0
+}
+
+// Publish sends event to every stream of email, dropping it for streams whose
+// buffer is full rather than blocking the listener
+func (h *Hub) Publish(email string, event MatchEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers[email] {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("Dropping match event for slow stream of %s", email)
+		}
+	}
+}
+
+// PublishAll sends event to every open stream
+func (h *Hub) PublishAll(event MatchEvent) {
+	h.mu.Lock()
+	emails := make([]string, 0, len(h.subscribers))
+	for email := range h.subscribers {
+		emails = append(emails, email)
+	}
+	h.mu.Unlock()
+	for _, email := range emails {
+		h.Publish(email, event)
+	}
+}
+
+// ListenForMatchUpdates forwards notifications on matchUpdatesChannel to the
+// hub until ctx is done. the listener reconnects on its own; since
+// notifications sent while disconnected are lost, streams are told to resync.
+func (s *Server) ListenForMatchUpdates(ctx context.Context, dsn string) {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Match update listener: %v", err)
+		}
+	})
+	defer listener.Close()
+	if err := listener.Listen(matchUpdatesChannel); err != nil {
+		log.Printf("Failed to listen on %s: %v", matchUpdatesChannel, err)
+		return
+	}
+
+	ping := time.NewTicker(90 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-listener.Notify:
+			if n == nil {
+				// reconnected
+				s.Hub.PublishAll(MatchEvent{Type: "resync"})
+				continue
+			}
+			var payload matchNotification
+			if err := json.Unmarshal([]byte(n.Extra), &payload); err != nil {
+				log.Printf("Invalid match update notification %q: %v", n.Extra, err)
+				continue
+			}
+			s.publishMatchChange(ctx, payload)
+		case <-ping.C:
+			// notice dead connections that never error
+			if err := listener.Ping(); err != nil {
+				log.Printf("Match update listener ping failed: %v", err)
+			}
+		}
+	}
+}
+
+// publishMatchChange sends each side of a changed match their own view of it.
+// the other side's view only changes when mutuality does, and pushing them
+// anything else would reveal the source's interest.
+func (s *Server) publishMatchChange(ctx context.Context, payload matchNotification) {
+	week, err := parseWeek(payload.Week)
+	if err != nil {
+		log.Printf("Invalid week in match update notification: %v", err)
+		return
+	}
+	for _, email := range []string{payload.User1, payload.User2} {
+		if email != payload.Source && !payload.MutualChanged {
+			continue
+		}
+		if !s.Hub.HasSubscribers(email) {
+			continue
+		}
+		event, err := s.matchEvent(ctx, email, payload.User1, payload.User2, week)
+		if err != nil {
+			log.Printf("Failed to load match update for %s: %v", email, err)
+			continue
+		}
+		s.Hub.Publish(email, event)
+	}
+}
+
+// matchEvent loads email's view of the (user1, user2, week) match. a match
+// email can no longer see, such as a crush on them that stopped being mutual,
+// is reported as removed.
+func (s *Server) matchEvent(ctx context.Context, email, user1, user2 string, week time.Time) (MatchEvent, error) {
+	query := matchSelect + ` AND m.user1_email = $2 AND m.user2_email = $3 AND m.week = $4`
+	match, _, _, err := scanMatch(s.DB.QueryRowContext(ctx, query, email, user1, user2, week), email)
+	if errors.Is(err, sql.ErrNoRows) {
+		other := user1
+		if other == email {
+			other = user2
+		}
+		return MatchEvent{Type: "match_removed", TargetEmail: other, Week: &Date{week}}, nil
+	}
+	if err != nil {
+		return MatchEvent{}, err
+	}
+	return MatchEvent{Type: "match", Match: &match}, nil
+}
+
+// HandleMatchStream streams the user's match changes as Server-Sent Events.
+// EventSource can't set headers, so the OAuth token may also be passed as
+// ?access_token=.
+func (s *Server) HandleMatchStream(w http.ResponseWriter, r *http.Request) {
+	email := r.PathValue("email")
+	if r.Header.Get("Authorization") == "" {
+		if token := r.URL.Query().Get("access_token"); token != "" {
+			r.Header.Set("Authorization", token)
+		}
+	}
+	emailFromToken, err := s.validateOAuthToken(r)
+	if err != nil || emailFromToken != email {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, unsubscribe := s.Hub.Subscribe(email)
+	defer unsubscribe()
+	log.Printf("Opened match stream for %s", email)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	tokenCheck := time.NewTicker(s.StreamTokenCheck)
+	defer tokenCheck.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Printf("Closed match stream for %s", email)
+			return
+		case <-s.Hub.Done():
+			log.Printf("Closed match stream for %s on shutdown", email)
+			return
+		case <-tokenCheck.C:
+			// the client reconnects with a fresh token, or gets a 401
+			if emailFromToken, err := s.validateOAuthToken(r); err != nil || emailFromToken != email {
+				log.Printf("Closed match stream for %s: token no longer valid", email)
+				return
+			}
+			continue
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Failed to marshal match event: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
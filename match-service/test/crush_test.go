@@ -0,0 +1,338 @@
+/***************************************************************************
+ * File Name: match-service/test/crush_test.go
+ * Author: Bryan SebaRaj
+ * Description: Unit tests for the one-crush-per-week rule
+ * Date Created: 01-07-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sebaraj/crush/match-service/server"
+)
+
+func TestCrushRule(t *testing.T) {
+	week := thisWeek().Format("2006-01-02")
+	lastWeek := thisWeek().AddDate(0, 0, -7).Format("2006-01-02")
+	putMatch := func(target, week string) string {
+		return `{"source_email": "a@yale.edu", "target_email": "` + target + `", "source_interested": true, "week": "` + week + `"}`
+	}
+	cases := map[string]struct {
+		method, target, body string
+		// CRUSH_CUTOFF for the case
+		cutoff string
+		expect func(sqlmock.Sqlmock)
+		status int
+		// reason of a 409, or the action of the queued update
+		reason, action string
+	}{
+		"first pick": {
+			"PUT", "/v1/match/a@yale.edu", putMatch("b@yale.edu", week), "",
+			func(mock sqlmock.Sqlmock) {
+				expectRelation(mock, "", false)
+				expectBlocked(mock, false)
+				expectCurrentCrush(mock, "")
+				expectOutbox(mock, "a@yale.edu", week, "b@yale.edu")
+			},
+			http.StatusOK, "", "",
+		},
+		"second pick is rejected": {
+			"PUT", "/v1/match/a@yale.edu", putMatch("c@yale.edu", week), "",
+			func(mock sqlmock.Sqlmock) {
+				expectRelation(mock, "", false)
+				expectBlocked(mock, false)
+				expectCurrentCrush(mock, "b@yale.edu")
+			},
+			http.StatusConflict, "crush_already_chosen", "",
+		},
+		"pick still in the outbox counts": {
+			"PUT", "/v1/match/a@yale.edu", putMatch("c@yale.edu", week), "",
+			func(mock sqlmock.Sqlmock) {
+				expectRelation(mock, "", false)
+				expectBlocked(mock, false)
+				expectPendingCrush(mock, "b@yale.edu")
+			},
+			http.StatusConflict, "crush_already_chosen", "",
+		},
+		"withdrawal still in the outbox frees the pick": {
+			"PUT", "/v1/match/a@yale.edu", putMatch("c@yale.edu", week), "",
+			func(mock sqlmock.Sqlmock) {
+				expectRelation(mock, "", false)
+				expectBlocked(mock, false)
+				expectPendingCrush(mock, nil)
+				expectOutbox(mock, "a@yale.edu", week, "c@yale.edu")
+			},
+			http.StatusOK, "", "",
+		},
+		"change before the cutoff": {
+			"PUT", "/v1/match/a@yale.edu/crush/current", `{"target_email": "c@yale.edu"}`, "168h",
+			func(mock sqlmock.Sqlmock) {
+				expectRelation(mock, "", false)
+				expectBlocked(mock, false)
+				expectCurrentCrush(mock, "b@yale.edu")
+				expectOutbox(mock, "a@yale.edu", week, "c@yale.edu")
+			},
+			http.StatusOK, "", "change_crush",
+		},
+		"change after the cutoff": {
+			"PUT", "/v1/match/a@yale.edu/crush/current", `{"target_email": "c@yale.edu"}`, "1ns",
+			func(mock sqlmock.Sqlmock) {
+				expectRelation(mock, "", false)
+				expectBlocked(mock, false)
+				expectCurrentCrush(mock, "b@yale.edu")
+			},
+			http.StatusConflict, "crush_cutoff_passed", "",
+		},
+		"withdraw": {
+			"DELETE", "/v1/match/a@yale.edu/crush/current", "", "168h",
+			func(mock sqlmock.Sqlmock) {
+				expectCurrentCrush(mock, "b@yale.edu")
+				expectOutbox(mock, "a@yale.edu", week, nil)
+			},
+			http.StatusOK, "", "withdraw_crush",
+		},
+		"withdraw without a crush": {
+			"DELETE", "/v1/match/a@yale.edu/crush/current", "", "168h",
+			func(mock sqlmock.Sqlmock) { expectCurrentCrush(mock, "") },
+			http.StatusNotFound, "", "",
+		},
+		"withdraw after the cutoff": {
+			"DELETE", "/v1/match/a@yale.edu/crush/current", "", "1ns",
+			func(mock sqlmock.Sqlmock) { expectCurrentCrush(mock, "b@yale.edu") },
+			http.StatusConflict, "crush_cutoff_passed", "",
+		},
+		"blocked": {
+			"PUT", "/v1/match/a@yale.edu/crush/current", `{"target_email": "b@yale.edu"}`, "",
+			func(mock sqlmock.Sqlmock) {
+				expectRelation(mock, "", false)
+				expectBlocked(mock, true)
+			},
+			http.StatusConflict, "crush_blocked", "",
+		},
+		"blocked through an interest update": {
+			"PUT", "/v1/match/a@yale.edu", putMatch("b@yale.edu", week), "",
+			func(mock sqlmock.Sqlmock) {
+				expectRelation(mock, "", false)
+				expectBlocked(mock, true)
+			},
+			http.StatusConflict, "crush_blocked", "",
+		},
+		"self": {
+			"PUT", "/v1/match/a@yale.edu/crush/current", `{"target_email": "a@yale.edu"}`, "",
+			func(mock sqlmock.Sqlmock) { expectRelation(mock, "", false) },
+			http.StatusConflict, "crush_on_self", "",
+		},
+		"past week": {
+			"PUT", "/v1/match/a@yale.edu", putMatch("b@yale.edu", lastWeek), "",
+			func(mock sqlmock.Sqlmock) { expectRelation(mock, "", false) },
+			http.StatusConflict, "crush_week_closed", "",
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			if c.cutoff != "" {
+				t.Setenv("CRUSH_CUTOFF", c.cutoff)
+			}
+			ts := setupTestServer(t)
+			expectLocked(ts.dbMock, "a@yale.edu")
+			c.expect(ts.dbMock)
+			if c.status != http.StatusOK {
+				ts.dbMock.ExpectRollback()
+			}
+
+			w := ts.do(c.method, c.target, "a@yale.edu", c.body)
+			assert.Equal(t, c.status, w.Code, w.Body.String())
+			if c.status == http.StatusConflict {
+				var conflict struct {
+					Reason string `json:"reason"`
+				}
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &conflict))
+				assert.Equal(t, c.reason, conflict.Reason)
+			}
+			assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestCrushQueuesAction(t *testing.T) {
+	t.Setenv("CRUSH_CUTOFF", "168h")
+	ts := setupTestServer(t)
+	expectLocked(ts.dbMock, "a@yale.edu")
+	expectRelation(ts.dbMock, "", false)
+	expectBlocked(ts.dbMock, false)
+	expectCurrentCrush(ts.dbMock, "b@yale.edu")
+	_, body := expectOutbox(ts.dbMock)
+
+	w := ts.do("PUT", "/v1/match/a@yale.edu/crush/current", "a@yale.edu", `{"target_email": "c@yale.edu"}`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var msg server.SQSMessage
+	assert.NoError(t, json.Unmarshal([]byte(body.value.(string)), &msg))
+	assert.Equal(t, "change_crush", msg.Action)
+	assert.Equal(t, "c@yale.edu", msg.EmailTarget)
+	assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+}
+
+func TestCrushWeekTimezone(t *testing.T) {
+	t.Setenv("WEEK_TIMEZONE", "America/New_York")
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("No timezone data: %v", err)
+	}
+	ts := setupTestServer(t)
+	expectCurrentCrush(ts.dbMock, "b@yale.edu")
+
+	w := ts.do("GET", "/v1/match/a@yale.edu/crush/current", "a@yale.edu", "")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var crush server.Crush
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &crush))
+
+	// the week is the sunday of today in New York, and the cutoff is 120h
+	// after midnight there, not after midnight UTC
+	now := time.Now().In(loc)
+	sunday := time.Date(now.Year(), now.Month(), now.Day()-int(now.Weekday()), 0, 0, 0, 0, loc)
+	assert.Equal(t, sunday.Format("2006-01-02"), crush.Week)
+	assert.True(t, sunday.Add(120*time.Hour).Equal(crush.ChangeableUntil), crush.ChangeableUntil)
+}
+
+func TestHiddenCrushLooksLikeNoMatch(t *testing.T) {
+	week := thisWeek().Format("2006-01-02")
+	cases := map[string]struct {
+		method, target, body string
+		// CRUSH_CUTOFF for the case
+		cutoff string
+		// expectations after the relation, given whether b has a crush on a
+		expect func(mock sqlmock.Sqlmock, theirs bool)
+	}{
+		"decline": {
+			"PUT", "/v1/match/a@yale.edu",
+			`{"source_email": "a@yale.edu", "target_email": "b@yale.edu", "source_interested": false, "week": "` + week + `"}`, "",
+			func(mock sqlmock.Sqlmock, theirs bool) {
+				if theirs {
+					expectOutbox(mock, nil, nil, nil)
+				} else {
+					mock.ExpectRollback()
+				}
+			},
+		},
+		"interest with a crush already picked": {
+			"PUT", "/v1/match/a@yale.edu",
+			`{"source_email": "a@yale.edu", "target_email": "b@yale.edu", "source_interested": true, "week": "` + week + `"}`, "",
+			func(mock sqlmock.Sqlmock, theirs bool) {
+				expectBlocked(mock, false)
+				expectCurrentCrush(mock, "c@yale.edu")
+				mock.ExpectRollback()
+			},
+		},
+		"crush after the cutoff": {
+			"PUT", "/v1/match/a@yale.edu/crush/current", `{"target_email": "b@yale.edu"}`, "1ns",
+			func(mock sqlmock.Sqlmock, theirs bool) {
+				expectBlocked(mock, false)
+				expectCurrentCrush(mock, "c@yale.edu")
+				mock.ExpectRollback()
+			},
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			if c.cutoff != "" {
+				t.Setenv("CRUSH_CUTOFF", c.cutoff)
+			}
+			responses := map[bool]*httptest.ResponseRecorder{}
+			for _, theirs := range []bool{false, true} {
+				ts := setupTestServer(t)
+				expectLocked(ts.dbMock, "a@yale.edu")
+				if theirs {
+					expectRelation(ts.dbMock, "b@yale.edu", false)
+				} else {
+					expectRelation(ts.dbMock, "", false)
+				}
+				c.expect(ts.dbMock, theirs)
+
+				responses[theirs] = ts.do(c.method, c.target, "a@yale.edu", c.body)
+				assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+			}
+			none, theirs := responses[false], responses[true]
+			assert.Equal(t, none.Code, theirs.Code)
+			assert.Equal(t, none.Header(), theirs.Header())
+			assert.Equal(t, none.Body.String(), theirs.Body.String())
+		})
+	}
+}
+
+func TestReturnedCrushIsJustInterest(t *testing.T) {
+	ts := setupTestServer(t)
+	expectLocked(ts.dbMock, "a@yale.edu")
+	ts.dbMock.ExpectQuery(queryLike("SELECT user1_email, server_generated")).
+		WillReturnRows(sqlmock.NewRows([]string{"user1_email", "server_generated", "mutual"}).AddRow("b@yale.edu", false, true))
+	// a already has a crush, but re-confirming a mutual match isn't a new pick
+	expectOutbox(ts.dbMock, nil, nil, nil)
+
+	w := ts.do("PUT", "/v1/match/a@yale.edu/crush/current", "a@yale.edu", `{"target_email": "b@yale.edu"}`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+}
+
+func TestReturnedCrushIsTheWeeksPick(t *testing.T) {
+	week := thisWeek().Format("2006-01-02")
+
+	// b's hidden crush on a, returned by a with no crush yet, is a's pick
+	ts := setupTestServer(t)
+	expectLocked(ts.dbMock, "a@yale.edu")
+	expectRelation(ts.dbMock, "b@yale.edu", false)
+	expectBlocked(ts.dbMock, false)
+	expectCurrentCrush(ts.dbMock, "")
+	expectOutbox(ts.dbMock, "a@yale.edu", week, "b@yale.edu")
+	w := ts.do("PUT", "/v1/match/a@yale.edu/crush/current", "a@yale.edu", `{"target_email": "b@yale.edu"}`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+
+	// once applied, a has b as their crush
+	ts = setupTestServer(t)
+	expectCurrentCrush(ts.dbMock, "b@yale.edu")
+	w = ts.do("GET", "/v1/match/a@yale.edu/crush/current", "a@yale.edu", "")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var crush server.Crush
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &crush))
+	assert.Equal(t, "b@yale.edu", crush.TargetEmail)
+
+	// so picking another is a second crush
+	ts = setupTestServer(t)
+	expectLocked(ts.dbMock, "a@yale.edu")
+	expectRelation(ts.dbMock, "", false)
+	expectBlocked(ts.dbMock, false)
+	expectCurrentCrush(ts.dbMock, "b@yale.edu")
+	ts.dbMock.ExpectRollback()
+	w = ts.do("PUT", "/v1/match/a@yale.edu",
+		"a@yale.edu", `{"source_email": "a@yale.edu", "target_email": "c@yale.edu", "source_interested": true, "week": "`+week+`"}`)
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), "crush_already_chosen")
+	assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+
+	// and withdrawing it withdraws the returned crush
+	t.Setenv("CRUSH_CUTOFF", "168h")
+	ts = setupTestServer(t)
+	expectLocked(ts.dbMock, "a@yale.edu")
+	expectCurrentCrush(ts.dbMock, "b@yale.edu")
+	_, body := expectOutbox(ts.dbMock, "a@yale.edu", week, nil)
+	w = ts.do("DELETE", "/v1/match/a@yale.edu/crush/current", "a@yale.edu", "")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var msg server.SQSMessage
+	assert.NoError(t, json.Unmarshal([]byte(body.value.(string)), &msg))
+	assert.Equal(t, "withdraw_crush", msg.Action)
+	assert.Equal(t, "b@yale.edu", msg.EmailTarget)
+	assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+}
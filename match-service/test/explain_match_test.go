@@ -0,0 +1,109 @@
+/***************************************************************************
+ * File Name: match-service/test/explain_match_test.go
+ * Author: Bryan SebaRaj
+ * Description: Unit tests for explaining a generated match
+ * Date Created: 01-07-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sebaraj/crush/match-service/server"
+)
+
+// explanation of b as a's partner, as match-generator stores it
+const storedExplanation = `{
+	"distance": 0.3, "rank": 2, "candidates": 5, "answers": 0.25,
+	"questions": ["low", "low", "medium", "high", "low", "low", "medium", "low", "low", "high", "low", "low"],
+	"terms": {"interests": 0.05}, "shared_interests": ["Music"]
+}`
+
+// expectExplanation answers the explanation query for email and target
+func expectExplanation(mock sqlmock.Sqlmock, email, target string, explanation string) {
+	rows := sqlmock.NewRows([]string{"explanation", "week"})
+	if explanation != "" {
+		rows.AddRow([]byte(explanation), thisWeek())
+	}
+	mock.ExpectQuery(queryLike("SELECT e.explanation, m.week")).WithArgs(email, target).WillReturnRows(rows)
+}
+
+func TestExplainMatch(t *testing.T) {
+	t.Run("the caller's side of the match", func(t *testing.T) {
+		ts := setupTestServer(t)
+		// the explanation is keyed by the caller, so the rank is theirs
+		expectExplanation(ts.dbMock, "a@yale.edu", "b@yale.edu", storedExplanation)
+
+		w := ts.do("GET", "/v1/match/a@yale.edu/explain/b@yale.edu", "a@yale.edu", "")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var explanation server.MatchExplanation
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &explanation))
+		assert.Equal(t, "a@yale.edu", explanation.SourceEmail)
+		assert.Equal(t, "b@yale.edu", explanation.TargetEmail)
+		assert.Equal(t, 2, explanation.Rank)
+		assert.Equal(t, 5, explanation.Candidates)
+		assert.Equal(t, []string{"Music"}, explanation.SharedInterests)
+		assert.Len(t, explanation.Questions, 12)
+		assert.Equal(t, server.QuestionContribution{Question: 4, Contribution: "high"}, explanation.Questions[3])
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("partner answers are withheld", func(t *testing.T) {
+		ts := setupTestServer(t)
+		expectExplanation(ts.dbMock, "a@yale.edu", "b@yale.edu", storedExplanation)
+
+		w := ts.do("GET", "/v1/match/a@yale.edu/explain/b@yale.edu", "a@yale.edu", "")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		// only a level per question, never an answer or an exact part
+		var body struct {
+			Questions []map[string]any `json:"questions"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		for _, question := range body.Questions {
+			assert.ElementsMatch(t, []string{"question", "contribution"}, keys(question))
+			assert.Contains(t, []any{"low", "medium", "high"}, question["contribution"])
+		}
+		var fields map[string]any
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &fields))
+		assert.ElementsMatch(t, []string{"source_email", "target_email", "week", "distance", "rank", "candidates",
+			"answers", "questions", "terms", "shared_interests"}, keys(fields))
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("non-participant", func(t *testing.T) {
+		ts := setupTestServer(t)
+		// c has no generated match with b, so nothing is found for them
+		expectExplanation(ts.dbMock, "c@yale.edu", "b@yale.edu", "")
+
+		w := ts.do("GET", "/v1/match/c@yale.edu/explain/b@yale.edu", "c@yale.edu", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("someone else's match", func(t *testing.T) {
+		ts := setupTestServer(t)
+
+		w := ts.do("GET", "/v1/match/a@yale.edu/explain/b@yale.edu", "c@yale.edu", "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+}
+
+func keys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,122 @@
+/***************************************************************************
+ * File Name: match-service/test/get_match_test.go
+ * Author: Bryan SebaRaj
+ * Description: Unit tests for listing a user's matches
+ * Date Created: 01-07-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sebaraj/crush/match-service/server"
+)
+
+var matchColumns = []string{"user1_email", "user2_email", "user1_interested", "user2_interested", "server_generated", "week",
+	"instagram", "snapchat", "phone_number"}
+
+// matchRows returns generated matches between a@yale.edu and each target,
+// all in week
+func matchRows(week time.Time, targets ...string) *sqlmock.Rows {
+	rows := sqlmock.NewRows(matchColumns)
+	for _, target := range targets {
+		rows.AddRow("a@yale.edu", target, false, false, true, week, nil, nil, nil)
+	}
+	return rows
+}
+
+func TestListMatchesWithoutPaginationIsABareArray(t *testing.T) {
+	ts := setupTestServer(t)
+	week := time.Date(2025, 1, 5, 0, 0, 0, 0, time.UTC)
+	ts.dbMock.ExpectQuery(`ORDER BY m.week DESC, m.user1_email, m.user2_email\s*$`).
+		WithArgs("a@yale.edu").WillReturnRows(matchRows(week, "b@yale.edu", "c@yale.edu"))
+
+	w := ts.do("GET", "/v1/match/a@yale.edu", "a@yale.edu", "")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var matches []server.Match
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &matches))
+	assert.Len(t, matches, 2)
+	assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+}
+
+func TestListMatchesPages(t *testing.T) {
+	ts := setupTestServer(t)
+	week := time.Date(2025, 1, 5, 0, 0, 0, 0, time.UTC)
+	// limit 1 reads 2 rows to know there is a next page
+	ts.dbMock.ExpectQuery(queryLike("LIMIT $2")).WithArgs("a@yale.edu", 2).
+		WillReturnRows(matchRows(week, "b@yale.edu", "c@yale.edu"))
+
+	w := ts.do("GET", "/v1/match/a@yale.edu?limit=1", "a@yale.edu", "")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var page server.MatchPage
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Len(t, page.Matches, 1)
+	assert.NotEmpty(t, page.NextCursor)
+
+	// the cursor resumes after the last match of the page
+	ts.dbMock.ExpectQuery(queryLike("LIMIT $5")).WithArgs("a@yale.edu", "2025-01-05", "a@yale.edu", "b@yale.edu", 2).
+		WillReturnRows(matchRows(week, "c@yale.edu"))
+
+	w = ts.do("GET", "/v1/match/a@yale.edu?limit=1&cursor="+url.QueryEscape(page.NextCursor), "a@yale.edu", "")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	page = server.MatchPage{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Len(t, page.Matches, 1)
+	assert.Empty(t, page.NextCursor)
+	assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+}
+
+func TestListMatchesFilters(t *testing.T) {
+	ts := setupTestServer(t)
+	// a week is every match from its sunday up to the next
+	ts.dbMock.ExpectQuery(queryLike("m.week >= $2 AND m.week < $3 AND m.server_generated = $4")).
+		WithArgs("a@yale.edu", time.Date(2025, 1, 5, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 12, 0, 0, 0, 0, time.UTC), false).
+		WillReturnRows(sqlmock.NewRows(matchColumns))
+
+	w := ts.do("GET", "/v1/match/a@yale.edu?week=2025-01-08&server_generated=false", "a@yale.edu", "")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `[]`, w.Body.String())
+	assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+}
+
+func TestListMatchesRejectsInvalidQueries(t *testing.T) {
+	cursor := func(raw string) string {
+		return url.QueryEscape(base64.RawURLEncoding.EncodeToString([]byte(raw)))
+	}
+	for name, query := range map[string]string{
+		"bad week":               "week=last-week",
+		"bad from":               "from=2025-13-01",
+		"bad to":                 "to=tomorrow",
+		"week with from":         "week=2025-01-05&from=2025-01-05",
+		"week with to":           "week=2025-01-05&to=2025-01-05",
+		"bad server_generated":   "server_generated=maybe",
+		"zero limit":             "limit=0",
+		"limit over the maximum": "limit=201",
+		"non-numeric limit":      "limit=ten",
+		"cursor not base64":      "cursor=***",
+		"cursor not json":        "cursor=" + cursor("week"),
+		"cursor without users":   "cursor=" + cursor(`{"w": "2025-01-05"}`),
+		"cursor with a bad week": "cursor=" + cursor(`{"w": "soon", "a": "a@yale.edu", "b": "b@yale.edu"}`),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ts := setupTestServer(t)
+			w := ts.do("GET", "/v1/match/a@yale.edu?"+query, "a@yale.edu", "")
+			assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+			assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+		})
+	}
+}
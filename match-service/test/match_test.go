@@ -0,0 +1,208 @@
+/***************************************************************************
+ * File Name: match-service/test/match_test.go
+ * Author: Bryan SebaRaj
+ * Description: Unit tests for the match update and crush handlers
+ * Date Created: 01-07-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sebaraj/crush/match-service/server"
+)
+
+type testServer struct {
+	server *server.Server
+	router *http.ServeMux
+	db     *sql.DB
+	dbMock sqlmock.Sqlmock
+}
+
+// setupTestServer returns a server on a mock database that accepts any token
+// as the email it names
+func setupTestServer(t *testing.T) *testServer {
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create db mock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	s := server.NewServer(db)
+	s.VerifyToken = func(ctx context.Context, token string) (string, error) {
+		return token, nil
+	}
+	router := http.NewServeMux()
+	s.InitializeRoutes(router)
+
+	return &testServer{server: s, router: router, db: db, dbMock: dbMock}
+}
+
+// do sends a request as user (no token when empty)
+func (ts *testServer) do(method, target, user, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if user != "" {
+		req.Header.Set("Authorization", user)
+	}
+	w := httptest.NewRecorder()
+	ts.router.ServeHTTP(w, req)
+	return w
+}
+
+// captured matches any argument and keeps it
+type captured struct {
+	value driver.Value
+}
+
+func (c *captured) Match(v driver.Value) bool {
+	c.value = v
+	return true
+}
+
+// queryLike matches a query containing query
+func queryLike(query string) string {
+	return regexp.QuoteMeta(query)
+}
+
+func thisWeek() time.Time {
+	now := time.Now().UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()-int(now.Weekday()), 0, 0, 0, 0, time.UTC)
+}
+
+// expectLocked expects a crush request's transaction and its lock on user
+func expectLocked(mock sqlmock.Sqlmock, user string) {
+	mock.ExpectBegin()
+	mock.ExpectExec(queryLike("SELECT 1 FROM users WHERE email = $1 FOR UPDATE")).WithArgs(user).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// expectRelation answers relationWith: the (user1, server_generated) row
+// between the pair this week, not mutual, or no row when user1 is empty
+func expectRelation(mock sqlmock.Sqlmock, user1 string, generated bool) {
+	rows := sqlmock.NewRows([]string{"user1_email", "server_generated", "mutual"})
+	if user1 != "" {
+		rows.AddRow(user1, generated, false)
+	}
+	mock.ExpectQuery(queryLike("SELECT user1_email, server_generated, user1_interested AND user2_interested FROM matches")).WillReturnRows(rows)
+}
+
+// expectBlocked answers the block check on a new crush
+func expectBlocked(mock sqlmock.Sqlmock, blocked bool) {
+	mock.ExpectQuery(queryLike("SELECT 1 FROM blocks")).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(blocked))
+}
+
+// expectPendingCrush answers currentCrush with an unprocessed outbox crush on
+// target, or a pending withdrawal when target is nil
+func expectPendingCrush(mock sqlmock.Sqlmock, target driver.Value) {
+	mock.ExpectQuery(queryLike("SELECT o.crush_target FROM match_outbox o")).
+		WillReturnRows(sqlmock.NewRows([]string{"crush_target"}).AddRow(target))
+}
+
+// expectCurrentCrush answers currentCrush with nothing pending and target in
+// matches, or no crush when empty
+func expectCurrentCrush(mock sqlmock.Sqlmock, target string) {
+	mock.ExpectQuery(queryLike("SELECT o.crush_target FROM match_outbox o")).
+		WillReturnRows(sqlmock.NewRows([]string{"crush_target"}))
+	rows := sqlmock.NewRows([]string{"target"})
+	if target != "" {
+		rows.AddRow(target)
+	}
+	mock.ExpectQuery(queryLike("SELECT CASE WHEN user1_email = $1 THEN user2_email ELSE user1_email END FROM matches")).WillReturnRows(rows)
+}
+
+// expectOutbox expects one outbox insert and the commit after it, and returns
+// the key and body. crush, when given, is the (crush_email, crush_week,
+// crush_target) recorded with it.
+func expectOutbox(mock sqlmock.Sqlmock, crush ...driver.Value) (key, body *captured) {
+	key, body = &captured{}, &captured{}
+	args := []driver.Value{key, body, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()}
+	if len(crush) > 0 {
+		args = append(args[:2], crush...)
+	}
+	mock.ExpectExec(queryLike("INSERT INTO match_outbox")).WithArgs(args...).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	return key, body
+}
+
+func TestMatchUpdatesCarryIdempotencyKey(t *testing.T) {
+	t.Setenv("CRUSH_CUTOFF", "168h")
+	week := thisWeek().Format("2006-01-02")
+	cases := map[string]struct {
+		method, target, body string
+		expect               func(sqlmock.Sqlmock)
+	}{
+		"interest update": {
+			"PUT", "/v1/match/a@yale.edu",
+			`{"source_email": "a@yale.edu", "target_email": "b@yale.edu", "source_interested": true, "week": "` + week + `"}`,
+			func(mock sqlmock.Sqlmock) {
+				expectLocked(mock, "a@yale.edu")
+				expectRelation(mock, "a@yale.edu", true)
+			},
+		},
+		"new crush": {
+			"PUT", "/v1/match/a@yale.edu/crush/current", `{"target_email": "b@yale.edu"}`,
+			func(mock sqlmock.Sqlmock) {
+				expectLocked(mock, "a@yale.edu")
+				expectRelation(mock, "", false)
+				expectBlocked(mock, false)
+				expectCurrentCrush(mock, "")
+			},
+		},
+		"withdrawn crush": {
+			"DELETE", "/v1/match/a@yale.edu/crush/current", "",
+			func(mock sqlmock.Sqlmock) {
+				expectLocked(mock, "a@yale.edu")
+				expectCurrentCrush(mock, "b@yale.edu")
+			},
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			ts := setupTestServer(t)
+			keys := map[string]bool{}
+			for i := 0; i < 2; i++ {
+				c.expect(ts.dbMock)
+				key, body := expectOutbox(ts.dbMock)
+
+				w := ts.do(c.method, c.target, "a@yale.edu", c.body)
+				assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+				var msg server.SQSMessage
+				assert.NoError(t, json.Unmarshal([]byte(body.value.(string)), &msg))
+				assert.Regexp(t, "^[0-9a-f]{32}$", msg.IdempotencyKey)
+				assert.Equal(t, key.value, msg.IdempotencyKey)
+				keys[msg.IdempotencyKey] = true
+			}
+			// every request is its own update, with its own key
+			assert.Len(t, keys, 2)
+			assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestMatchUpdateUnauthorized(t *testing.T) {
+	ts := setupTestServer(t)
+	for _, path := range []string{"/v1/match/a@yale.edu", "/v1/match/a@yale.edu/crush/current"} {
+		assert.Equal(t, http.StatusUnauthorized, ts.do("PUT", path, "", "{}").Code)
+		assert.Equal(t, http.StatusUnauthorized, ts.do("PUT", path, "b@yale.edu", "{}").Code)
+	}
+	assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+}
@@ -0,0 +1,152 @@
+/***************************************************************************
+ * File Name: match-service/test/outbox_test.go
+ * Author: Bryan SebaRaj
+ * Description: Unit tests for the match update outbox and its relay
+ * Date Created: 01-07-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package test
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sebaraj/crush/match-service/server"
+)
+
+// expectDue expects the relay to find no abandoned rows, then answers its
+// claim with rows of (id, body, attempts), attempts counting the claim
+func expectDue(mock sqlmock.Sqlmock, batchSize int, rows ...[]driver.Value) {
+	mock.ExpectQuery(queryLike("SET failed_at = CURRENT_TIMESTAMP, last_error = COALESCE(last_error")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "attempts"}))
+	due := sqlmock.NewRows([]string{"id", "body", "attempts"})
+	for _, row := range rows {
+		due.AddRow(row...)
+	}
+	mock.ExpectQuery(queryLike("WHERE published_at IS NULL AND failed_at IS NULL AND attempts < $3 AND next_attempt_at <= CURRENT_TIMESTAMP ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED) RETURNING id, body, attempts")).
+		WithArgs(batchSize, sqlmock.AnyArg(), 10).WillReturnRows(due)
+}
+
+func TestRelayOnce(t *testing.T) {
+	cases := map[string]struct {
+		publishErr error
+		attempts   int
+		expect     func(sqlmock.Sqlmock)
+	}{
+		"published rows are marked": {
+			attempts: 1,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(queryLike("UPDATE match_outbox SET published_at = CURRENT_TIMESTAMP")).
+					WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+		},
+		"failed rows back off": {
+			publishErr: errors.New("sqs unavailable"),
+			attempts:   3,
+			expect: func(mock sqlmock.Sqlmock) {
+				// third attempt failed: 1s doubled twice
+				mock.ExpectExec(queryLike("SET last_error = $2, next_attempt_at")).
+					WithArgs(1, "sqs unavailable", int64(4000)).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+		},
+		"rows fail after the last attempt": {
+			publishErr: errors.New("message too long"),
+			attempts:   10,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(queryLike("UPDATE match_outbox SET failed_at = CURRENT_TIMESTAMP, last_error = $2 WHERE id = $1")).
+					WithArgs(1, "message too long").WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			ts := setupTestServer(t)
+			publisher := &server.MemoryPublisher{Err: c.publishErr}
+			relay := server.NewRelay(ts.db, publisher)
+
+			// no transaction: the claim is committed before publishing
+			expectDue(ts.dbMock, relay.BatchSize, []driver.Value{1, `{"email_source": "a@yale.edu"}`, c.attempts})
+			c.expect(ts.dbMock)
+
+			handled, err := relay.RelayOnce(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, 1, handled)
+			if c.publishErr == nil {
+				assert.Equal(t, []string{`{"email_source": "a@yale.edu"}`}, publisher.Published())
+			} else {
+				assert.Empty(t, publisher.Published())
+			}
+			assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestRelayOnceFailsAbandonedRows(t *testing.T) {
+	ts := setupTestServer(t)
+	publisher := &server.MemoryPublisher{}
+	relay := server.NewRelay(ts.db, publisher)
+
+	// a relay died during row 1's last attempt, so it is failed, not claimed
+	ts.dbMock.ExpectQuery(queryLike("SET failed_at = CURRENT_TIMESTAMP, last_error = COALESCE(last_error")).WithArgs(10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "attempts"}).AddRow(1, 10))
+	ts.dbMock.ExpectQuery(queryLike("RETURNING id, body, attempts")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "body", "attempts"}))
+
+	handled, err := relay.RelayOnce(context.Background())
+	assert.NoError(t, err)
+	assert.Zero(t, handled)
+	assert.Empty(t, publisher.Published())
+	assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+}
+
+func TestRelayOnceStopsOnFailedBookkeeping(t *testing.T) {
+	ts := setupTestServer(t)
+	publisher := &server.MemoryPublisher{}
+	relay := server.NewRelay(ts.db, publisher)
+
+	expectDue(ts.dbMock, relay.BatchSize, []driver.Value{2, "second", 1}, []driver.Value{1, "first", 1})
+	ts.dbMock.ExpectExec(queryLike("SET published_at")).WithArgs(1).WillReturnError(errors.New("connection reset"))
+
+	// rows are published in id order. the first stays unpublished, so it is
+	// sent again once its claim times out and deduped downstream
+	_, err := relay.RelayOnce(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, []string{"first"}, publisher.Published())
+	assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+}
+
+func TestUpdateMatchGoesThroughOutbox(t *testing.T) {
+	ts := setupTestServer(t)
+	expectLocked(ts.dbMock, "a@yale.edu")
+	expectRelation(ts.dbMock, "a@yale.edu", true)
+	// answering a generated match doesn't touch the crush
+	_, body := expectOutbox(ts.dbMock, nil, nil, nil)
+
+	week := thisWeek().Format("2006-01-02")
+	w := ts.do("PUT", "/v1/match/a@yale.edu", "a@yale.edu",
+		`{"source_email": "a@yale.edu", "target_email": "b@yale.edu", "source_interested": true, "week": "`+week+`"}`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+
+	// the handler only wrote the outbox; the relay is what publishes it
+	publisher := &server.MemoryPublisher{}
+	relay := server.NewRelay(ts.db, publisher)
+	expectDue(ts.dbMock, relay.BatchSize, []driver.Value{1, body.value, 1})
+	ts.dbMock.ExpectExec(queryLike("SET published_at")).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	_, err := relay.RelayOnce(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{body.value.(string)}, publisher.Published())
+	assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+}
@@ -0,0 +1,80 @@
+/***************************************************************************
+ * File Name: match-service/test/stream_test.go
+ * Author: Bryan SebaRaj
+ * Description: Unit tests for the match event stream's lifetime
+ * Date Created: 01-07-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// openStream opens a's match stream on a live server and returns its body
+func openStream(t *testing.T, ts *testServer) io.ReadCloser {
+	live := httptest.NewServer(ts.router)
+	t.Cleanup(live.Close)
+	req, err := http.NewRequest("GET", live.URL+"/v1/match/a@yale.edu/stream?access_token=a@yale.edu", nil)
+	assert.NoError(t, err)
+	resp, err := live.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	return resp.Body
+}
+
+// assertEnds fails unless the stream ends within a second
+func assertEnds(t *testing.T, body io.Reader) {
+	ended := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, body)
+		ended <- err
+	}()
+	select {
+	case err := <-ended:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Stream stayed open")
+	}
+}
+
+func TestStreamEndsOnShutdown(t *testing.T) {
+	ts := setupTestServer(t)
+	body := openStream(t, ts)
+
+	ts.server.Hub.Close()
+	assertEnds(t, body)
+}
+
+func TestStreamEndsWhenTokenExpires(t *testing.T) {
+	ts := setupTestServer(t)
+	var expired atomic.Bool
+	ts.server.VerifyToken = func(ctx context.Context, token string) (string, error) {
+		if expired.Load() {
+			return "", errors.New("token expired")
+		}
+		return token, nil
+	}
+	ts.server.StreamTokenCheck = 10 * time.Millisecond
+	body := openStream(t, ts)
+
+	expired.Store(true)
+	assertEnds(t, body)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// isBlocked reports whether either user has blocked the other
+func isBlocked(ctx context.Context, tx *sql.Tx, a, b string) (bool, error) {
+	query := `
+      SELECT EXISTS (
+        SELECT 1 FROM blocks
+         WHERE (blocker_email = $1 AND blocked_email = $2)
+            OR (blocker_email = $2 AND blocked_email = $1)
+      )
+    `
+	var blocked bool
+	if err := tx.QueryRowContext(ctx, query, a, b).Scan(&blocked); err != nil {
+		return false, fmt.Errorf("checking blocks failed: %w", err)
+	}
+	return blocked, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/lib/pq"
+)
+
+// invalidMessageError marks a message that will fail the same way however
+// often it is retried
+type invalidMessageError struct {
+	reason string
+}
+
+func (e *invalidMessageError) Error() string { return e.reason }
+
+func invalidMessage(format string, args ...any) error {
+	return &invalidMessageError{reason: fmt.Sprintf(format, args...)}
+}
+
+// validateMessage rejects payloads that could never be applied
+func validateMessage(msg SQSMessage) error {
+	if msg.EmailSource == "" || msg.EmailTarget == "" {
+		return invalidMessage("email_source and email_target are required")
+	}
+	if msg.EmailSource == msg.EmailTarget {
+		return invalidMessage("email_source and email_target are the same user")
+	}
+	if _, err := time.Parse("2006-01-02", msg.Date); err != nil {
+		return invalidMessage("invalid date '%s': %v", msg.Date, err)
+	}
+	return nil
+}
+
+// isPermanent reports whether retrying err can't help: invalid messages, and
+// database errors caused by the data rather than the database, such as
+// unknown users or oversized values
+func isPermanent(err error) bool {
+	var invalid *invalidMessageError
+	if errors.As(err, &invalid) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// 23503 foreign_key_violation; class 22 is data exceptions
+		return pqErr.Code == "23503" || pqErr.Code.Class() == "22"
+	}
+	return false
+}
+
+// writeDeadLetter parks a poison message with the reason it was rejected, so
+// it is removed from the queue but can still be inspected or replayed. its
+// idempotency key is recorded as processed too, so match-service stops
+// counting it as a pending crush; replaying one means deleting that key first.
+func writeDeadLetter(ctx context.Context, record events.SQSMessage, reason error) error {
+	insertSQL := `
+      WITH dead AS (
+           INSERT INTO dead_letters (message_id, body, reason)
+                VALUES ($1, $2, $3)
+           ON CONFLICT (message_id) DO NOTHING
+      )
+      INSERT INTO processed_messages (idempotency_key)
+           VALUES ($4)
+      ON CONFLICT (idempotency_key) DO NOTHING
+    `
+	if _, err := db.ExecContext(ctx, insertSQL, record.MessageId, record.Body, reason.Error(), messageKey(record)); err != nil {
+		return fmt.Errorf("writing dead letter failed: %w", err)
+	}
+	return nil
+}
+
+// messageKey is record's idempotency key, falling back to its message id when
+// the body has none or doesn't parse
+func messageKey(record events.SQSMessage) string {
+	var payload struct {
+		IdempotencyKey string `json:"idempotency_key"`
+	}
+	if err := json.Unmarshal([]byte(record.Body), &payload); err == nil && payload.IdempotencyKey != "" {
+		return payload.IdempotencyKey
+	}
+	return "sqs:" + record.MessageId
+}
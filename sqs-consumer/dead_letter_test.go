@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+const crushBody = `{"email_source": "a@yale.edu", "email_target": "b@yale.edu", "date": "2025-01-08", "wants_match": true, "idempotency_key": "%s"}`
+
+// expectNewCrush expects a new crush under key up to the insert into
+// matches, which fails with insertErr
+func expectNewCrush(mock sqlmock.Sqlmock, key string, insertErr error) {
+	mock.ExpectBegin()
+	mock.ExpectExec(queryLike("INSERT INTO processed_messages")).WithArgs(key).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(queryLike("SELECT user1_email, user2_email, server_generated")).
+		WillReturnRows(sqlmock.NewRows([]string{"user1_email", "user2_email", "server_generated", "user2_interested"}))
+	mock.ExpectQuery(queryLike("SELECT 1 FROM blocks")).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec(queryLike("INSERT INTO matches")).WillReturnError(insertErr)
+	mock.ExpectRollback()
+}
+
+// expectDeadLetter expects the message to be parked and its key, key or the
+// message id fallback, marked processed
+func expectDeadLetter(mock sqlmock.Sqlmock, id, body, key string) {
+	mock.ExpectExec(queryLike("INSERT INTO dead_letters")).WithArgs(id, body, sqlmock.AnyArg(), key).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestHandleSQSEvent(t *testing.T) {
+	cases := map[string]struct {
+		body   string
+		expect func(mock sqlmock.Sqlmock, id, body string)
+		// reported back to SQS for redelivery
+		failed bool
+	}{
+		"malformed json is dead lettered": {
+			body: `{"email_source": `,
+			expect: func(mock sqlmock.Sqlmock, id, body string) {
+				expectDeadLetter(mock, id, body, "sqs:"+id)
+			},
+		},
+		"missing target is dead lettered": {
+			body: `{"email_source": "a@yale.edu", "date": "2025-01-08", "idempotency_key": "k1"}`,
+			expect: func(mock sqlmock.Sqlmock, id, body string) {
+				expectDeadLetter(mock, id, body, "k1")
+			},
+		},
+		"unknown user is dead lettered": {
+			body: fmt.Sprintf(crushBody, "fk"),
+			expect: func(mock sqlmock.Sqlmock, id, body string) {
+				expectNewCrush(mock, "fk", &pq.Error{Code: "23503"})
+				expectDeadLetter(mock, id, body, "fk")
+			},
+		},
+		"data exception is dead lettered": {
+			body: fmt.Sprintf(crushBody, "data"),
+			expect: func(mock sqlmock.Sqlmock, id, body string) {
+				expectNewCrush(mock, "data", &pq.Error{Code: "22001"})
+				expectDeadLetter(mock, id, body, "data")
+			},
+		},
+		"serialization failure is retried": {
+			body: fmt.Sprintf(crushBody, "serial"),
+			expect: func(mock sqlmock.Sqlmock, id, body string) {
+				expectNewCrush(mock, "serial", &pq.Error{Code: "40001"})
+			},
+			failed: true,
+		},
+		"lost connection is retried": {
+			body: fmt.Sprintf(crushBody, "conn"),
+			expect: func(mock sqlmock.Sqlmock, id, body string) {
+				mock.ExpectBegin().WillReturnError(errors.New("connection reset by peer"))
+			},
+			failed: true,
+		},
+		"failing to dead letter is retried": {
+			body: `not json`,
+			expect: func(mock sqlmock.Sqlmock, id, body string) {
+				mock.ExpectExec(queryLike("INSERT INTO dead_letters")).WillReturnError(errors.New("connection reset by peer"))
+			},
+			failed: true,
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			mock := useMockDB(t)
+			c.expect(mock, "m1", c.body)
+			expectNoNotifications(mock)
+
+			response, err := handleSQSEvent(context.Background(), events.SQSEvent{Records: []events.SQSMessage{record("m1", c.body)}})
+			assert.NoError(t, err)
+			if c.failed {
+				assert.Equal(t, []events.SQSBatchItemFailure{{ItemIdentifier: "m1"}}, response.BatchItemFailures)
+			} else {
+				assert.Empty(t, response.BatchItemFailures)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestHandleSQSEventReportsOnlyFailedRecords(t *testing.T) {
+	mock := useMockDB(t)
+	applied := fmt.Sprintf(crushBody, "applied")
+	mock.ExpectBegin()
+	mock.ExpectExec(queryLike("INSERT INTO processed_messages")).WithArgs("applied").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	expectDeadLetter(mock, "poison", "{", "sqs:poison")
+	expectNewCrush(mock, "transient", errors.New("connection reset by peer"))
+	expectNewCrush(mock, "fk", &pq.Error{Code: "23503"})
+	expectDeadLetter(mock, "unknown", fmt.Sprintf(crushBody, "fk"), "fk")
+	expectNewCrush(mock, "transient2", &pq.Error{Code: "57P01"})
+	expectNoNotifications(mock)
+
+	response, err := handleSQSEvent(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		record("ok", applied),
+		record("poison", "{"),
+		record("retry1", fmt.Sprintf(crushBody, "transient")),
+		record("unknown", fmt.Sprintf(crushBody, "fk")),
+		record("retry2", fmt.Sprintf(crushBody, "transient2")),
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, []events.SQSBatchItemFailure{{ItemIdentifier: "retry1"}, {ItemIdentifier: "retry2"}}, response.BatchItemFailures)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestIsPermanent(t *testing.T) {
+	cases := map[string]struct {
+		err       error
+		permanent bool
+	}{
+		"invalid message":         {invalidMessage("email_source and email_target are required"), true},
+		"wrapped invalid message": {fmt.Errorf("insertMatch failed: %w", invalidMessage("blocked")), true},
+		"foreign key violation":   {fmt.Errorf("insert failed: %w", &pq.Error{Code: "23503"}), true},
+		"value too long":          {&pq.Error{Code: "22001"}, true},
+		"invalid text":            {&pq.Error{Code: "22P02"}, true},
+		"unique violation":        {&pq.Error{Code: "23505"}, false},
+		"serialization failure":   {&pq.Error{Code: "40001"}, false},
+		"admin shutdown":          {&pq.Error{Code: "57P01"}, false},
+		"network error":           {errors.New("connection reset by peer"), false},
+	}
+	for name, c := range cases {
+		assert.Equal(t, c.permanent, isPermanent(c.err), name)
+	}
+}
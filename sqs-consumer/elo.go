@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// how far a single decision can move a rating; ELO_K overrides
+const defaultEloK = 32
+
+// eloK reads ELO_K, falling back to defaultEloK
+func eloK() float64 {
+	if k, err := strconv.ParseFloat(GetEnv("ELO_K", ""), 64); err == nil && k >= 0 {
+		return k
+	}
+	return defaultEloK
+}
+
+// expectedScore is the chance Elo gives a user rated `rated` of being wanted
+// by a user rated `rater`
+func expectedScore(rated, rater int) float64 {
+	return 1 / (1 + math.Pow(10, float64(rater-rated)/400))
+}
+
+// eloDelta is the change to the rated user's rating after the rater decides.
+// being wanted by a highly rated user counts for more, and being declined by a
+// low rated one costs more.
+func eloDelta(rated, rater int, wanted bool, k float64) int {
+	score := 0.0
+	if wanted {
+		score = 1
+	}
+	return int(math.Round(k * (score - expectedScore(rated, rater))))
+}
+
+// updateElo moves both ratings the first time the source decides on the
+// target in a week, as in a game the target wins by being wanted: the target
+// gains what the source loses, or the other way around. later changes of mind
+// don't count again, so toggling interest can't be used to pump or sink a
+// rating.
+func updateElo(ctx context.Context, tx *sql.Tx, msg SQSMessage, week time.Time) error {
+	decisionSQL := `
+      INSERT INTO elo_decisions (rater_email, rated_email, week, wanted)
+           VALUES ($1, $2, $3, $4)
+      ON CONFLICT DO NOTHING
+    `
+	res, err := tx.ExecContext(ctx, decisionSQL, msg.EmailSource, msg.EmailTarget, week, msg.WantsMatch)
+	if err != nil {
+		return fmt.Errorf("recording elo decision failed: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+
+	// lock both ratings in a fixed order so concurrent updates can't deadlock
+	lockQuery := `
+      SELECT email, elo FROM elos WHERE email = $1 OR email = $2 ORDER BY email FOR UPDATE
+    `
+	rows, err := tx.QueryContext(ctx, lockQuery, msg.EmailSource, msg.EmailTarget)
+	if err != nil {
+		return fmt.Errorf("locking elos failed: %w", err)
+	}
+	defer rows.Close()
+	elos := map[string]int{}
+	for rows.Next() {
+		var email string
+		var elo int
+		if err := rows.Scan(&email, &elo); err != nil {
+			return fmt.Errorf("scan elos failed: %w", err)
+		}
+		elos[email] = elo
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterating elos failed: %w", err)
+	}
+
+	delta := eloDelta(elos[msg.EmailTarget], elos[msg.EmailSource], msg.WantsMatch, eloK())
+	if delta == 0 {
+		return nil
+	}
+	updateSQL := `
+      UPDATE elos SET elo = elo + CASE WHEN email = $2 THEN $1 ELSE -$1 END
+       WHERE email = $2 OR email = $3
+    `
+	if _, err := tx.ExecContext(ctx, updateSQL, delta, msg.EmailTarget, msg.EmailSource); err != nil {
+		return fmt.Errorf("updating elo failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpectedScore(t *testing.T) {
+	cases := map[string]struct {
+		rated, rater int
+		expected     float64
+	}{
+		"even":                 {1000, 1000, 0.5},
+		"rated 400 higher":     {1400, 1000, 10.0 / 11},
+		"rated 400 lower":      {1000, 1400, 1.0 / 11},
+		"only the gap matters": {0, 400, 1.0 / 11},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.InDelta(t, c.expected, expectedScore(c.rated, c.rater), 1e-9)
+			// either side of a pair adds up to a certainty
+			assert.InDelta(t, 1, expectedScore(c.rated, c.rater)+expectedScore(c.rater, c.rated), 1e-9)
+		})
+	}
+}
+
+func TestEloDelta(t *testing.T) {
+	cases := map[string]struct {
+		rated, rater int
+		wanted       bool
+		k            float64
+		delta        int
+	}{
+		"wanted by an equal":            {1000, 1000, true, 32, 16},
+		"declined by an equal":          {1000, 1000, false, 32, -16},
+		"wanted by a higher rated":      {1000, 1400, true, 32, 29},
+		"declined by a higher rated":    {1000, 1400, false, 32, -3},
+		"wanted by a lower rated":       {1400, 1000, true, 32, 3},
+		"declined by a lower rated":     {1400, 1000, false, 32, -29},
+		"k scales the change":           {1000, 1000, true, 64, 32},
+		"k of zero freezes ratings":     {1000, 1400, true, 0, 0},
+		"wanted by a much higher rated": {0, 2000, true, 32, 32},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, c.delta, eloDelta(c.rated, c.rater, c.wanted, c.k))
+			// wanting and declining differ by exactly k before rounding
+			wanted := c.k * (1 - expectedScore(c.rated, c.rater))
+			declined := c.k * (0 - expectedScore(c.rated, c.rater))
+			assert.InDelta(t, c.k, wanted-declined, 1e-9)
+			// the same result seen from the other side is the opposite change
+			assert.Equal(t, c.delta, -eloDelta(c.rater, c.rated, !c.wanted, c.k))
+		})
+	}
+}
+
+func TestUpdateElo(t *testing.T) {
+	week := time.Date(2025, time.January, 5, 0, 0, 0, 0, time.UTC)
+	msg := SQSMessage{EmailSource: "a@yale.edu", EmailTarget: "b@yale.edu", WantsMatch: true}
+
+	t.Run("first decision moves both ratings", func(t *testing.T) {
+		mock := useMockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectExec(queryLike("INSERT INTO elo_decisions")).WithArgs("a@yale.edu", "b@yale.edu", week, true).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(queryLike("SELECT email, elo FROM elos")).WithArgs("a@yale.edu", "b@yale.edu").
+			WillReturnRows(sqlmock.NewRows([]string{"email", "elo"}).AddRow("a@yale.edu", 1400).AddRow("b@yale.edu", 1000))
+		// b gains 29 for being wanted by a higher rated user, and a loses it
+		mock.ExpectExec(queryLike("UPDATE elos SET elo = elo + CASE WHEN email = $2 THEN $1 ELSE -$1 END")).
+			WithArgs(29, "b@yale.edu", "a@yale.edu").WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectCommit()
+
+		tx, err := db.Begin()
+		assert.NoError(t, err)
+		assert.NoError(t, updateElo(context.Background(), tx, msg, week))
+		assert.NoError(t, tx.Commit())
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("repeat decision in the week leaves ratings alone", func(t *testing.T) {
+		mock := useMockDB(t)
+		mock.ExpectBegin()
+		// the decision is already recorded, so no elos are read or written
+		mock.ExpectExec(queryLike("INSERT INTO elo_decisions")).WithArgs("a@yale.edu", "b@yale.edu", week, false).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+
+		declined := msg
+		declined.WantsMatch = false
+		tx, err := db.Begin()
+		assert.NoError(t, err)
+		assert.NoError(t, updateElo(context.Background(), tx, declined, week))
+		assert.NoError(t, tx.Commit())
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -22,8 +23,19 @@ type SQSMessage struct {
 	EmailTarget string `json:"email_target"`
 	Date        string `json:"date"`
 	WantsMatch  bool   `json:"wants_match"`
+	// set by match-service for every update; messages without one fall back
+	// to the SQS message ID, which only dedupes redeliveries
+	IdempotencyKey string `json:"idempotency_key"`
+	// empty for interest updates and new crushes
+	Action string `json:"action,omitempty"`
 }
 
+// actions set by match-service once it has checked the one-crush rule
+const (
+	actionChangeCrush   = "change_crush"
+	actionWithdrawCrush = "withdraw_crush"
+)
+
 var (
 	db     *sql.DB
 	dbOnce sync.Once
@@ -33,25 +45,50 @@ func main() {
 	lambda.Start(handleSQSEvent)
 }
 
-// remove message on failure? return an error
-func handleSQSEvent(ctx context.Context, event events.SQSEvent) error {
+// handleSQSEvent processes every record on its own. records that fail for a
+// transient reason are reported back so SQS only redelivers those; records
+// that can never succeed are moved to dead_letters instead.
+func handleSQSEvent(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
 	initDB()
 
+	var response events.SQSEventResponse
 	for _, record := range event.Records {
-		var payload SQSMessage
-
-		if err := json.Unmarshal([]byte(record.Body), &payload); err != nil {
-			log.Printf("Failed to unmarshal SQS message ID=%s: %v", record.MessageId, err)
+		err := processRecord(ctx, record)
+		if err == nil {
 			continue
 		}
+		if isPermanent(err) {
+			log.Printf("Dead lettering message ID=%s: %v", record.MessageId, err)
+			if err = writeDeadLetter(ctx, record, err); err == nil {
+				continue
+			}
+		}
+		log.Printf("Failed to process message ID=%s: %v", record.MessageId, err)
+		response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{
+			ItemIdentifier: record.MessageId,
+		})
+	}
 
-		log.Printf("Processing message: Source=%s, Target=%s", payload.EmailSource, payload.EmailTarget)
+	dispatchNotifications(ctx)
+	return response, nil
+}
 
-		if err := insertMatch(ctx, payload); err != nil {
-			return fmt.Errorf("insertMatch failed for msg ID=%s: %w", record.MessageId, err)
-		}
+func processRecord(ctx context.Context, record events.SQSMessage) error {
+	var payload SQSMessage
+	if err := json.Unmarshal([]byte(record.Body), &payload); err != nil {
+		return invalidMessage("failed to unmarshal body: %v", err)
 	}
+	if err := validateMessage(payload); err != nil {
+		return err
+	}
+
+	payload.IdempotencyKey = messageKey(record)
 
+	log.Printf("Processing message: Source=%s, Target=%s, Key=%s", payload.EmailSource, payload.EmailTarget, payload.IdempotencyKey)
+
+	if err := insertMatch(ctx, payload); err != nil {
+		return fmt.Errorf("insertMatch failed: %w", err)
+	}
 	return nil
 }
 
@@ -87,7 +124,7 @@ func initDB() {
 		psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=require",
 			dbIP, dbPort, dbUser, dbPassword, dbName)
 
-		db, err := sql.Open("postgres", psqlInfo)
+		db, err = sql.Open("postgres", psqlInfo)
 		if err != nil {
 			log.Fatalf("Unable to connect to DB: %v", err)
 		}
@@ -99,7 +136,7 @@ func initDB() {
 	})
 }
 
-func insertMatch(ctx context.Context, msg SQSMessage) error {
+func insertMatch(ctx context.Context, msg SQSMessage) (err error) {
 	parsedDate, err := time.Parse("2006-01-02", msg.Date)
 	if err != nil {
 		return fmt.Errorf("invalid date '%s': %w", msg.Date, err)
@@ -124,12 +161,29 @@ func insertMatch(ctx context.Context, msg SQSMessage) error {
 		}
 	}()
 
-	// (source email == user1_email OR user2_email) AND week = sundayOfWeek
+	// claim the key first; a concurrent duplicate blocks here until this tx
+	// finishes, then skips if it committed
+	dedupeSQL := `
+      INSERT INTO processed_messages (idempotency_key) VALUES ($1) ON CONFLICT DO NOTHING
+    `
+	res, dedupeErr := tx.ExecContext(ctx, dedupeSQL, msg.IdempotencyKey)
+	if dedupeErr != nil {
+		return fmt.Errorf("recording idempotency key failed: %w", dedupeErr)
+	}
+	if claimed, rowsErr := res.RowsAffected(); rowsErr != nil {
+		return fmt.Errorf("recording idempotency key failed: %w", rowsErr)
+	} else if claimed == 0 {
+		log.Printf("Skipping already processed message: Key=%s", msg.IdempotencyKey)
+		return nil
+	}
+
+	// lock every match the source has this week, so concurrent updates for
+	// the same user see each other's crush
 	lockQuery := `
-      SELECT user1_email, user2_email, server_generated
+      SELECT user1_email, user2_email, server_generated, user2_interested
         FROM matches
        WHERE (user1_email = $1 OR user2_email = $1)
-         AND date_trunc('week', week) = date_trunc('week', $2::timestamp)
+         AND week = $2
        FOR UPDATE
     `
 	lockRows, lockErr := tx.QueryContext(ctx, lockQuery, msg.EmailSource, sundayOfWeek)
@@ -138,102 +192,81 @@ func insertMatch(ctx context.Context, msg SQSMessage) error {
 	}
 	defer lockRows.Close()
 
-	// var serverGeneratedPairs []string
-	var notServerGeneratedButNotSource []string
-	var countNonServer int
-	var targetMatchIsServerGenerated bool
-	// var targetEmail string
-	var isTarget1 bool
-
+	// what the source already has with the target, and the source's crush,
+	// if any: a user generated match whose user1 is the source, or someone
+	// else's crush the source returned
+	var withTarget, sourceIsUser1, targetGenerated, returned bool
+	var crush string
 	for lockRows.Next() {
 		var u1, u2 string
-		var sg bool
-		if scanErr := lockRows.Scan(&u1, &u2, &sg); scanErr != nil {
+		var sg, u2Interested bool
+		if scanErr := lockRows.Scan(&u1, &u2, &sg, &u2Interested); scanErr != nil {
 			return fmt.Errorf("scan locked rows failed: %w", scanErr)
 		}
-
-		if sg {
-			if u1 == msg.EmailTarget {
-				targetMatchIsServerGenerated = true
-				// targetEmail = u1
-				isTarget1 = true
-				break
-			} else if u2 == msg.EmailTarget {
-				targetMatchIsServerGenerated = true
-				// targetEmail = u2
-				isTarget1 = false
-				break
-			}
-			// serverGeneratedPairs = append(
-			// serverGeneratedPairs,
-			// fmt.Sprintf("(%s, %s)", u1, u2),
-			// )
-		} else {
-			// record ones which do not include EmailSource
-			if u1 == msg.EmailTarget {
-				notServerGeneratedButNotSource = append(
-					notServerGeneratedButNotSource,
-					fmt.Sprintf("(%s, %s)", u1, u2),
-				)
-				isTarget1 = true
-			} else if u2 == msg.EmailTarget {
-				notServerGeneratedButNotSource = append(
-					notServerGeneratedButNotSource,
-					fmt.Sprintf("(%s, %s)", u1, u2),
-				)
-				isTarget1 = false
-			}
-			countNonServer++
+		if u1 == msg.EmailTarget || u2 == msg.EmailTarget {
+			withTarget, sourceIsUser1, targetGenerated = true, u1 == msg.EmailSource, sg
 		}
-	}
-	if targetMatchIsServerGenerated {
-		// update row to set wants_match to val
-		if isTarget1 {
-			updateSQL := `
-                UPDATE matches SET user2_interested = $1 WHERE user1_email = $2 AND user2_email = $3 AND week = $4
-                `
-			if _, updErr := tx.ExecContext(ctx, updateSQL, msg.WantsMatch, msg.EmailTarget, msg.EmailSource, sundayOfWeek); updErr != nil {
-				return fmt.Errorf("update failed: %w", updErr)
-			}
-		} else {
-			updateSQL := `
-                UPDATE matches SET user1_interested = $1 WHERE user1_email = $2 AND user2_email = $3 AND week = $4
-            `
-			if _, updErr := tx.ExecContext(ctx, updateSQL, msg.WantsMatch, msg.EmailSource, msg.EmailTarget, sundayOfWeek); updErr != nil {
-				return fmt.Errorf("update failed: %w", updErr)
-			}
+		switch {
+		case !sg && u1 == msg.EmailSource:
+			crush, returned = u2, false
+		case !sg && u2 == msg.EmailSource && u2Interested && crush == "":
+			crush, returned = u1, true
 		}
-		return nil
 	}
+	if rowsErr := lockRows.Err(); rowsErr != nil {
+		return fmt.Errorf("iterating locked rows failed: %w", rowsErr)
+	}
+	lockRows.Close()
 
-	// target is not server generated
-	if countNonServer > 0 {
-		// check if email_target is already in a insertMatch(
-		if countNonServer > 1 || len(notServerGeneratedButNotSource) == 0 {
-			// can't insert match b/c user already picked one match
+	switch {
+	case msg.Action == actionWithdrawCrush:
+		if crush == "" {
 			return nil
 		}
-		// update row in table to set wants match to val
-		if isTarget1 {
-			updateSQL := `
-                UPDATE matches SET user2_interested = $1 WHERE user1_email = $2 AND user2_email = $3 AND week = $4
-            `
-			if _, updErr := tx.ExecContext(ctx, updateSQL, msg.WantsMatch, msg.EmailTarget, msg.EmailSource, sundayOfWeek); updErr != nil {
-				return fmt.Errorf("update failed: %w", updErr)
+		return withdrawCrush(ctx, tx, msg.EmailSource, crush, returned, sundayOfWeek)
+
+	case withTarget:
+		// answering a generated match or someone's crush, or re-confirming
+		// the source's own crush
+		if !targetGenerated && sourceIsUser1 && !msg.WantsMatch {
+			return deleteCrush(ctx, tx, msg.EmailSource, crush, sundayOfWeek)
+		}
+		if !targetGenerated && !sourceIsUser1 && msg.WantsMatch && crush != "" && crush != msg.EmailTarget {
+			// returning a crush picks it as the source's crush for the week
+			if msg.Action != actionChangeCrush {
+				return invalidMessage("%s already has a crush on %s this week", msg.EmailSource, crush)
 			}
-		} else {
-			updateSQL := `
-                UPDATE matches SET user1_interested = $1 WHERE user1_email = $2 AND user2_email = $3 AND week = $4
-            `
-			if _, updErr := tx.ExecContext(ctx, updateSQL, msg.WantsMatch, msg.EmailSource, msg.EmailTarget, sundayOfWeek); updErr != nil {
-				return fmt.Errorf("update failed: %w", updErr)
+			if err := withdrawCrush(ctx, tx, msg.EmailSource, crush, returned, sundayOfWeek); err != nil {
+				return err
 			}
 		}
+		if err := setInterest(ctx, tx, msg, sundayOfWeek, sourceIsUser1); err != nil {
+			return err
+		}
+		return updateElo(ctx, tx, msg, sundayOfWeek)
 
+	case !msg.WantsMatch:
+		// nothing to decline
 		return nil
 	}
 
-	// insert row into table
+	// a new crush. match-service checks the one-crush rule before queueing,
+	// this re-checks it under the lock
+	blocked, err := isBlocked(ctx, tx, msg.EmailSource, msg.EmailTarget)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return invalidMessage("%s can't pick %s as a crush, one has blocked the other", msg.EmailSource, msg.EmailTarget)
+	}
+	if crush != "" {
+		if msg.Action != actionChangeCrush {
+			return invalidMessage("%s already has a crush on %s this week", msg.EmailSource, crush)
+		}
+		if err := withdrawCrush(ctx, tx, msg.EmailSource, crush, returned, sundayOfWeek); err != nil {
+			return err
+		}
+	}
 	insertSQL := `
       INSERT INTO matches (user1_email, user2_email, user1_interested, week)
            VALUES ($1,        $2,          $3,              $4)
@@ -241,6 +274,79 @@ func insertMatch(ctx context.Context, msg SQSMessage) error {
 	if _, insErr := tx.ExecContext(ctx, insertSQL, msg.EmailSource, msg.EmailTarget, true, sundayOfWeek); insErr != nil {
 		return fmt.Errorf("insert failed: %w", insErr)
 	}
+	if err := notifyMatchChange(ctx, tx, msg.EmailSource, msg.EmailTarget, sundayOfWeek, msg.EmailSource, false); err != nil {
+		return err
+	}
 
+	return updateElo(ctx, tx, msg, sundayOfWeek)
+}
+
+// withdrawCrush withdraws source's crush on target: their own is deleted, and
+// a returned one is declined again
+func withdrawCrush(ctx context.Context, tx *sql.Tx, source, target string, returned bool, week time.Time) error {
+	if returned {
+		return setInterest(ctx, tx, SQSMessage{EmailSource: source, EmailTarget: target}, week, false)
+	}
+	return deleteCrush(ctx, tx, source, target, week)
+}
+
+// deleteCrush withdraws source's crush on target
+func deleteCrush(ctx context.Context, tx *sql.Tx, source, target string, week time.Time) error {
+	deleteSQL := `
+      DELETE FROM matches
+       WHERE user1_email = $1 AND user2_email = $2 AND week = $3 AND server_generated = false
+      RETURNING user2_interested
+    `
+	var wasMutual bool
+	err := tx.QueryRowContext(ctx, deleteSQL, source, target, week).Scan(&wasMutual)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("withdrawing crush failed: %w", err)
+	}
+	log.Printf("Withdrew crush of %s on %s", source, target)
+	return notifyMatchChange(ctx, tx, source, target, week, source, wasMutual)
+}
+
+// setInterest sets the source's interested flag on their match with the
+// target for the week. when that makes the interest mutual, both users are
+// queued a notification in the same transaction.
+func setInterest(ctx context.Context, tx *sql.Tx, msg SQSMessage, week time.Time, sourceIsUser1 bool) error {
+	// the flag only changes if it differs, so RETURNING only sees a transition
+	updateSQL := `
+        UPDATE matches SET user1_interested = $1
+         WHERE user1_email = $2 AND user2_email = $3 AND week = $4 AND user1_interested IS DISTINCT FROM $1
+        RETURNING user1_interested, user2_interested
+    `
+	user1, user2 := msg.EmailSource, msg.EmailTarget
+	if !sourceIsUser1 {
+		updateSQL = `
+        UPDATE matches SET user2_interested = $1
+         WHERE user1_email = $2 AND user2_email = $3 AND week = $4 AND user2_interested IS DISTINCT FROM $1
+        RETURNING user1_interested, user2_interested
+    `
+		user1, user2 = msg.EmailTarget, msg.EmailSource
+	}
+
+	var user1Interested, user2Interested bool
+	err := tx.QueryRowContext(ctx, updateSQL, msg.WantsMatch, user1, user2, week).Scan(&user1Interested, &user2Interested)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("update failed: %w", err)
+	}
+	// the source's flag just flipped, so mutuality flipped iff the target is interested
+	targetInterested := user2Interested
+	if !sourceIsUser1 {
+		targetInterested = user1Interested
+	}
+	if err := notifyMatchChange(ctx, tx, user1, user2, week, msg.EmailSource, targetInterested); err != nil {
+		return err
+	}
+	if user1Interested && user2Interested {
+		return queueMutualMatch(ctx, tx, user1, user2, week)
+	}
 	return nil
 }
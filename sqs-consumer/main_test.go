@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// useMockDB points the consumer at a mock database for the rest of the test
+func useMockDB(t *testing.T) sqlmock.Sqlmock {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create db mock: %v", err)
+	}
+	dbOnce.Do(func() {})
+	prevDB, prevNotifier := db, mutualNotifier
+	db, mutualNotifier = mockDB, nil
+	t.Cleanup(func() {
+		db, mutualNotifier = prevDB, prevNotifier
+		mockDB.Close()
+	})
+	return mock
+}
+
+// queryLike matches a query containing query
+func queryLike(query string) string {
+	return regexp.QuoteMeta(query)
+}
+
+// expectNoNotifications expects the dispatch after a batch to find nothing due
+func expectNoNotifications(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(queryLike("UPDATE notifications n")).WillReturnRows(sqlmock.NewRows(nil))
+}
+
+func record(id, body string) events.SQSMessage {
+	return events.SQSMessage{MessageId: id, Body: body}
+}
+
+func TestRedeliveredMessageIsSkipped(t *testing.T) {
+	cases := map[string]struct {
+		body, key string
+	}{
+		"idempotency key": {
+			`{"email_source": "a@yale.edu", "email_target": "b@yale.edu", "date": "2025-01-08", "wants_match": true, "idempotency_key": "k1"}`,
+			"k1",
+		},
+		"no key falls back to the message id": {
+			`{"email_source": "a@yale.edu", "email_target": "b@yale.edu", "date": "2025-01-08", "wants_match": true}`,
+			"sqs:m1",
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			mock := useMockDB(t)
+			// the key was claimed by the first delivery, so nothing else is
+			// read or written; any statement on matches or elos would fail
+			mock.ExpectBegin()
+			mock.ExpectExec(queryLike("INSERT INTO processed_messages")).WithArgs(c.key).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectCommit()
+			expectNoNotifications(mock)
+
+			response, err := handleSQSEvent(context.Background(), events.SQSEvent{Records: []events.SQSMessage{record("m1", c.body)}})
+			assert.NoError(t, err)
+			assert.Empty(t, response.BatchItemFailures)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestReturnedCrushReplacesPick(t *testing.T) {
+	week := time.Date(2025, time.January, 5, 0, 0, 0, 0, time.UTC)
+	mock := useMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(queryLike("INSERT INTO processed_messages")).WillReturnResult(sqlmock.NewResult(0, 1))
+	// a picked c, and b has a hidden crush on a
+	mock.ExpectQuery(queryLike("SELECT user1_email, user2_email, server_generated")).
+		WillReturnRows(sqlmock.NewRows([]string{"user1_email", "user2_email", "server_generated", "user2_interested"}).
+			AddRow("a@yale.edu", "c@yale.edu", false, false).
+			AddRow("b@yale.edu", "a@yale.edu", false, false))
+	mock.ExpectQuery(queryLike("DELETE FROM matches")).WithArgs("a@yale.edu", "c@yale.edu", week).
+		WillReturnRows(sqlmock.NewRows([]string{"user2_interested"}).AddRow(false))
+	mock.ExpectExec(queryLike("SELECT pg_notify")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(queryLike("UPDATE matches SET user2_interested")).WithArgs(true, "b@yale.edu", "a@yale.edu", week).
+		WillReturnRows(sqlmock.NewRows([]string{"user1_interested", "user2_interested"}).AddRow(true, true))
+	mock.ExpectExec(queryLike("SELECT pg_notify")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(queryLike("INSERT INTO notifications")).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(queryLike("INSERT INTO elo_decisions")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	expectNoNotifications(mock)
+
+	body := `{"email_source": "a@yale.edu", "email_target": "b@yale.edu", "date": "2025-01-08", "wants_match": true, "action": "change_crush", "idempotency_key": "k1"}`
+	response, err := handleSQSEvent(context.Background(), events.SQSEvent{Records: []events.SQSMessage{record("m1", body)}})
+	assert.NoError(t, err)
+	assert.Empty(t, response.BatchItemFailures)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,176 @@
+// Package notifier delivers the notifications queued in the notifications
+// outbox table, honoring each user's notif_pref.
+package notifier
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	KindMutualMatch = "mutual_match"
+
+	DefaultBatchSize = 50
+	// attempts before a notification is given up on
+	maxAttempts = 5
+	// how long a claimed notification is left to its dispatcher before
+	// another may claim it, in case the first died before recording the outcome
+	claimTimeout = 5 * time.Minute
+	// wait before retrying a failed send, doubling every attempt up to maxBackoff
+	baseBackoff = 30 * time.Second
+	maxBackoff  = 30 * time.Minute
+)
+
+// Notification is an outbox row joined with what a Sender needs to reach the user
+type Notification struct {
+	ID          int       `json:"id"`
+	Kind        string    `json:"kind"`
+	Email       string    `json:"email"`
+	Name        string    `json:"name"`
+	Phone       string    `json:"phone,omitempty"`
+	PartnerName string    `json:"partner_name"`
+	Week        time.Time `json:"week"`
+}
+
+// Message is the text shown to the user
+func (n Notification) Message() string {
+	switch n.Kind {
+	case KindMutualMatch:
+		return fmt.Sprintf("Hi %s, you and %s are into each other! Open Crush to see how to reach them.", n.Name, n.PartnerName)
+	default:
+		return fmt.Sprintf("Hi %s, you have a new update on Crush.", n.Name)
+	}
+}
+
+type Notifier struct {
+	DB     *sql.DB
+	Sender Sender
+}
+
+func New(db *sql.DB, sender Sender) *Notifier {
+	return &Notifier{DB: db, Sender: sender}
+}
+
+// Dispatch sends up to limit due notifications and returns how many were
+// sent. users who opted out of notifications are marked skipped instead.
+// notifications are claimed and the claim committed before anything is sent,
+// so no row lock is held while a Sender runs and several consumers can
+// dispatch at once.
+func (n *Notifier) Dispatch(ctx context.Context, limit int) (sent int, err error) {
+	// claiming counts the attempt and pushes next_attempt_at past claimTimeout.
+	// rows already tried maxAttempts times aren't claimed; once their last
+	// claim times out, the dispatcher must have died sending them, and they
+	// are marked failed.
+	claimQuery := `
+      WITH abandoned AS (
+        UPDATE notifications
+           SET status = 'failed',
+               last_error = COALESCE(last_error, 'dispatcher stopped while sending')
+         WHERE status = 'pending' AND attempts >= $3 AND next_attempt_at <= CURRENT_TIMESTAMP
+      )
+      UPDATE notifications n
+         SET attempts = n.attempts + 1,
+             next_attempt_at = CURRENT_TIMESTAMP + $2 * INTERVAL '1 millisecond'
+        FROM users u, users p
+       WHERE n.id IN (
+               SELECT id FROM notifications
+                WHERE status = 'pending' AND attempts < $3 AND next_attempt_at <= CURRENT_TIMESTAMP
+                ORDER BY id
+                LIMIT $1
+                  FOR UPDATE SKIP LOCKED)
+         AND u.email = n.email AND p.email = n.partner_email
+      RETURNING n.id, n.kind, n.email, u.name, COALESCE(u.phone_number, ''), u.notif_pref, p.name, n.week, n.attempts
+    `
+	rows, err := n.DB.QueryContext(ctx, claimQuery, limit, claimTimeout.Milliseconds(), maxAttempts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim notifications: %w", err)
+	}
+	type claimed struct {
+		Notification
+		wantsNotifications bool
+		attempts           int
+	}
+	var due []claimed
+	for rows.Next() {
+		var c claimed
+		if err = rows.Scan(&c.ID, &c.Kind, &c.Email, &c.Name, &c.Phone, &c.wantsNotifications,
+			&c.PartnerName, &c.Week, &c.attempts); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan notification: %w", err)
+		}
+		due = append(due, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to iterate notifications: %w", err)
+	}
+	// RETURNING doesn't follow the subquery's order
+	sort.Slice(due, func(i, j int) bool { return due[i].ID < due[j].ID })
+
+	for _, c := range due {
+		if !c.wantsNotifications {
+			if err = n.markDone(ctx, c.ID, "skipped"); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		if sendErr := n.Sender.Send(ctx, c.Notification); sendErr != nil {
+			if err = n.markFailed(ctx, c.ID, c.attempts, sendErr); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		if err = n.markDone(ctx, c.ID, "sent"); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// markDone records that a notification was sent or skipped
+func (n *Notifier) markDone(ctx context.Context, id int, status string) error {
+	updateSQL := `
+      UPDATE notifications
+         SET status = $2::text,
+             last_error = NULL,
+             sent_at = CASE WHEN $2::text = 'sent' THEN CURRENT_TIMESTAMP END
+       WHERE id = $1
+    `
+	if _, err := n.DB.ExecContext(ctx, updateSQL, id, status); err != nil {
+		return fmt.Errorf("failed to update notification %d: %w", id, err)
+	}
+	return nil
+}
+
+// markFailed schedules a retry after a failed send, with exponential backoff.
+// a notification that has failed maxAttempts times is marked failed.
+func (n *Notifier) markFailed(ctx context.Context, id, attempts int, sendErr error) error {
+	updateSQL := `
+      UPDATE notifications
+         SET status = $2,
+             last_error = $3,
+             next_attempt_at = CURRENT_TIMESTAMP + $4 * INTERVAL '1 millisecond'
+       WHERE id = $1
+    `
+	status := "pending"
+	if attempts >= maxAttempts {
+		status = "failed"
+	}
+	if _, err := n.DB.ExecContext(ctx, updateSQL, id, status, sendErr.Error(), backoff(attempts).Milliseconds()); err != nil {
+		return fmt.Errorf("failed to update notification %d: %w", id, err)
+	}
+	return nil
+}
+
+// backoff is the wait after the attempts-th failed send
+func backoff(attempts int) time.Duration {
+	wait := baseBackoff
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, maxBackoff)
+}
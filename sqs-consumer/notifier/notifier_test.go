@@ -0,0 +1,122 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"log"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingSender struct {
+	sent []int
+	err  error
+}
+
+func (s *recordingSender) Send(ctx context.Context, n Notification) error {
+	s.sent = append(s.sent, n.ID)
+	return s.err
+}
+
+var claimColumns = []string{"id", "kind", "email", "name", "phone_number", "notif_pref", "name", "week", "attempts"}
+
+// expectClaim answers the claim with a notification per id, all for users
+// with the given notif_pref, on their given attempt
+func expectClaim(mock sqlmock.Sqlmock, pref bool, attempts int, ids ...int) {
+	rows := sqlmock.NewRows(claimColumns)
+	for _, id := range ids {
+		rows.AddRow(id, KindMutualMatch, "a@yale.edu", "Ada", "+12035550123", pref, "Grace", time.Now(), attempts)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("UPDATE notifications n")).
+		WithArgs(DefaultBatchSize, claimTimeout.Milliseconds(), maxAttempts).WillReturnRows(rows)
+}
+
+func TestDispatch(t *testing.T) {
+	sendErr := errors.New("sms gateway unavailable")
+	cases := map[string]struct {
+		pref     bool
+		attempts int
+		sendErr  error
+		// the outcome recorded for notification 7
+		mark []driver.Value
+		sent int
+	}{
+		"sent":                  {pref: true, attempts: 1, mark: []driver.Value{7, "sent"}, sent: 1},
+		"notif_pref off":        {pref: false, attempts: 1, mark: []driver.Value{7, "skipped"}},
+		"failure backs off":     {pref: true, attempts: 2, sendErr: sendErr, mark: []driver.Value{7, "pending", sendErr.Error(), int64(60_000)}},
+		"last attempt gives up": {pref: true, attempts: maxAttempts, sendErr: sendErr, mark: []driver.Value{7, "failed", sendErr.Error(), int64(480_000)}},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("Failed to create db mock: %v", err)
+			}
+			defer db.Close()
+			// no transaction is expected: the claim commits on its own
+			// before anything is sent
+			expectClaim(mock, c.pref, c.attempts, 7)
+			mock.ExpectExec(regexp.QuoteMeta("UPDATE notifications")).WithArgs(c.mark...).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			sender := &recordingSender{err: c.sendErr}
+			sent, err := New(db, sender).Dispatch(context.Background(), DefaultBatchSize)
+			assert.NoError(t, err)
+			assert.Equal(t, c.sent, sent)
+			if c.pref {
+				assert.Equal(t, []int{7}, sender.sent)
+			} else {
+				assert.Empty(t, sender.sent, "opted out users must not be sent anything")
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestClaimStopsAtMaxAttempts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create db mock: %v", err)
+	}
+	defer db.Close()
+	// a row claimed for its last attempt by a dispatcher that died is failed
+	// rather than claimed again
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"SET status = 'failed', last_error = COALESCE(last_error, 'dispatcher stopped while sending') "+
+			"WHERE status = 'pending' AND attempts >= $3 AND next_attempt_at <= CURRENT_TIMESTAMP")+
+		`[\s\S]*`+regexp.QuoteMeta("WHERE status = 'pending' AND attempts < $3 AND next_attempt_at <= CURRENT_TIMESTAMP")).
+		WithArgs(DefaultBatchSize, claimTimeout.Milliseconds(), maxAttempts).WillReturnRows(sqlmock.NewRows(claimColumns))
+
+	sender := &recordingSender{}
+	sent, err := New(db, sender).Dispatch(context.Background(), DefaultBatchSize)
+	assert.NoError(t, err)
+	assert.Zero(t, sent)
+	assert.Empty(t, sender.sent)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, baseBackoff, backoff(1))
+	assert.Equal(t, 4*baseBackoff, backoff(3))
+	assert.Equal(t, maxBackoff, backoff(20))
+}
+
+func TestLogSenderRedacts(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	n := Notification{ID: 42, Kind: KindMutualMatch, Email: "a@yale.edu", Name: "Ada", Phone: "+12035550123", PartnerName: "Grace"}
+	assert.NoError(t, LogSender{}.Send(context.Background(), n))
+	assert.Contains(t, logs.String(), "42")
+	for _, private := range []string{n.Email, n.Phone, n.Name, n.PartnerName} {
+		assert.NotContains(t, logs.String(), private)
+	}
+}
@@ -0,0 +1,69 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// Sender delivers a notification over some channel (email, SMS, ...)
+type Sender interface {
+	Send(ctx context.Context, n Notification) error
+}
+
+// LogSender stands in for a real channel by logging that each notification
+// was sent. logs end up in CloudWatch, so only the notification's id is
+// logged, never who it is for or the message.
+type LogSender struct{}
+
+func (LogSender) Send(ctx context.Context, n Notification) error {
+	log.Printf("Notify: sent %s notification %d", n.Kind, n.ID)
+	return nil
+}
+
+// FileSender stands in for a real channel by appending each notification to a
+// file as a JSON line
+type FileSender struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (f *FileSender) Send(ctx context.Context, n Notification) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(struct {
+		Notification
+		Message string `json:"message"`
+	}{n, n.Message()})
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// SenderFromEnv picks a sender by name: "log", or "file" writing to path
+func SenderFromEnv(name, path string) (Sender, error) {
+	switch name {
+	case "", "log":
+		return LogSender{}, nil
+	case "file":
+		if path == "" {
+			return nil, fmt.Errorf("file sender needs a path")
+		}
+		return &FileSender{Path: path}, nil
+	default:
+		return nil, fmt.Errorf("unknown sender %q", name)
+	}
+}
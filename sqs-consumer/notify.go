@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/sebaraj/crush/sqs-consumer/notifier"
+)
+
+// built on first use, after initDB
+var mutualNotifier *notifier.Notifier
+
+// queueMutualMatch writes a notification for each side of a newly mutual
+// match to the outbox. toggling interest off and on again in the same week
+// doesn't queue a second one.
+func queueMutualMatch(ctx context.Context, tx *sql.Tx, user1, user2 string, week time.Time) error {
+	insertSQL := `
+      INSERT INTO notifications (email, partner_email, kind, week)
+           VALUES ($1, $2, $3, $4), ($2, $1, $3, $4)
+      ON CONFLICT (email, partner_email, kind, week) DO NOTHING
+    `
+	if _, err := tx.ExecContext(ctx, insertSQL, user1, user2, notifier.KindMutualMatch, week); err != nil {
+		return fmt.Errorf("queueing mutual match notifications failed: %w", err)
+	}
+	log.Printf("Mutual match between %s and %s; notifications queued", user1, user2)
+	return nil
+}
+
+// dispatchNotifications drains the outbox after a batch. failed sends are
+// retried with backoff by a later batch, so they never fail the batch itself.
+func dispatchNotifications(ctx context.Context) {
+	if mutualNotifier == nil {
+		sender, err := notifier.SenderFromEnv(GetEnv("NOTIFY_SENDER", "log"), GetEnv("NOTIFY_FILE", ""))
+		if err != nil {
+			log.Printf("Notifications disabled: %v", err)
+			return
+		}
+		mutualNotifier = notifier.New(db, sender)
+	}
+	sent, err := mutualNotifier.Dispatch(ctx, notifier.DefaultBatchSize)
+	if err != nil {
+		log.Printf("Failed to dispatch notifications: %v", err)
+	}
+	if sent > 0 {
+		log.Printf("Sent %d notifications", sent)
+	}
+}
+
+// channel match-service listens on to push changes to open streams
+const matchUpdatesChannel = "match_updates"
+
+// matchChange is the payload sent on matchUpdatesChannel
+type matchChange struct {
+	User1 string `json:"user1_email"`
+	User2 string `json:"user2_email"`
+	Week  string `json:"week"`
+	// the user whose action changed the match
+	Source string `json:"source_email"`
+	// the match became or stopped being mutual. the other user only sees a
+	// partner's interest once it is mutual, so only then is it news to them.
+	MutualChanged bool `json:"mutual_changed"`
+}
+
+// notifyMatchChange tells listeners the (user1, user2, week) match changed.
+// postgres only delivers the notification if tx commits.
+func notifyMatchChange(ctx context.Context, tx *sql.Tx, user1, user2 string, week time.Time, source string, mutualChanged bool) error {
+	payload, err := json.Marshal(matchChange{
+		User1:         user1,
+		User2:         user2,
+		Week:          week.Format("2006-01-02"),
+		Source:        source,
+		MutualChanged: mutualChanged,
+	})
+	if err != nil {
+		return fmt.Errorf("encoding match notification failed: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `SELECT pg_notify($1, $2)`, matchUpdatesChannel, string(payload)); err != nil {
+		return fmt.Errorf("notifying match change failed: %w", err)
+	}
+	return nil
+}
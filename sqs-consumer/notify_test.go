@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sebaraj/crush/sqs-consumer/notifier"
+)
+
+func TestMutualMatchQueuesNotifications(t *testing.T) {
+	week := time.Date(2025, time.January, 5, 0, 0, 0, 0, time.UTC)
+	cases := map[string]struct {
+		// the match's flags after the update, or nil when it didn't change
+		flags  []bool
+		mutual bool
+	}{
+		"becomes mutual":           {flags: []bool{true, true}, mutual: true},
+		"interest not returned":    {flags: []bool{false, true}},
+		"already interested again": {},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			mock := useMockDB(t)
+			mock.ExpectBegin()
+			mock.ExpectExec(queryLike("INSERT INTO processed_messages")).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery(queryLike("SELECT user1_email, user2_email, server_generated")).
+				WillReturnRows(sqlmock.NewRows([]string{"user1_email", "user2_email", "server_generated", "user2_interested"}).
+					AddRow("b@yale.edu", "a@yale.edu", true, false))
+			flags := sqlmock.NewRows([]string{"user1_interested", "user2_interested"})
+			if c.flags != nil {
+				flags.AddRow(c.flags[0], c.flags[1])
+			}
+			mock.ExpectQuery(queryLike("UPDATE matches SET user2_interested")).
+				WithArgs(true, "b@yale.edu", "a@yale.edu", week).WillReturnRows(flags)
+			if c.flags != nil {
+				mock.ExpectExec(queryLike("SELECT pg_notify")).WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+			if c.mutual {
+				// one statement, writing one row for each side
+				mock.ExpectExec(queryLike("INSERT INTO notifications")).
+					WithArgs("b@yale.edu", "a@yale.edu", notifier.KindMutualMatch, week).
+					WillReturnResult(sqlmock.NewResult(0, 2))
+			}
+			// the elo decision was already made this week
+			mock.ExpectExec(queryLike("INSERT INTO elo_decisions")).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectCommit()
+			expectNoNotifications(mock)
+
+			body := fmt.Sprintf(crushBody, "mutual")
+			response, err := handleSQSEvent(context.Background(), events.SQSEvent{Records: []events.SQSMessage{record("m1", body)}})
+			assert.NoError(t, err)
+			assert.Empty(t, response.BatchItemFailures)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -34,17 +34,6 @@ resource "aws_opensearch_domain" "opensearch" {
   }
 }
 
-# resource "aws_security_group_rule" "opensearch_to_dms" {
-#   type                     = "ingress"
-#   from_port                = 443
-#   to_port                  = 443
-#   protocol                 = "tcp"
-#   security_group_id        = aws_security_group.opensearch_sg.id
-#   source_security_group_id = aws_security_group.dms_sg.id
-#   description              = "Allow OpenSearch to respond to DMS"
-# }
-
-
 resource "aws_security_group" "opensearch_sg" {
   name   = "opensearch-sg"
   vpc_id = module.vpc.vpc_id
@@ -57,14 +46,6 @@ resource "aws_security_group" "opensearch_sg" {
     description     = "Allow HTTPS access from EKS worker nodes"
   }
 
-  ingress {
-    from_port       = 443
-    to_port         = 443
-    protocol        = "tcp"
-    security_groups = [aws_security_group.dms_sg.id]
-    description     = "Allow HTTPS access from DMS"
-  }
-
   egress {
     from_port   = 0
     to_port     = 0
@@ -84,20 +65,6 @@ resource "aws_opensearch_domain_policy" "main" {
         Principal = "*",
         Action    = ["es:ESHttpGet", "es:ESHttpPut", "es:ESHttpPost", "es:ESHttpDelete"],
         Resource  = "${aws_opensearch_domain.opensearch.arn}/*"
-      },
-      {
-        Effect = "Allow"
-        Principal = {
-          AWS = [aws_iam_role.dms_access_role.arn]
-        }
-        Action = [
-          "opensearch:ESHttpGet",
-          "opensearch:ESHttpPut",
-          "opensearch:ESHttpPost",
-          "opensearch:ESHttpDelete",
-          "opensearch:ESHttpHead"
-        ]
-        Resource = "${aws_opensearch_domain.opensearch.arn}/*"
       }
     ]
   })
@@ -13,29 +13,36 @@ resource "aws_s3_bucket_cors_configuration" "images_bucket_cors" {
   }
 }
 
-resource "aws_s3_bucket_public_access_block" "public_access_block" {
+# uploads are deleted once confirmed; this expires the ones that never are
+resource "aws_s3_bucket_lifecycle_configuration" "images_bucket_lifecycle" {
   bucket = aws_s3_bucket.images_bucket.id
 
-  block_public_acls       = false
-  block_public_policy     = false
-  ignore_public_acls      = false
-  restrict_public_buckets = false
-}
+  rule {
+    id     = "expire-unconfirmed-uploads"
+    status = "Enabled"
 
-data "aws_iam_policy_document" "images_bucket_policy" {
-  statement {
-    sid    = "PublicReadGetObject"
-    effect = "Allow"
-
-    principals {
-      type        = "AWS"
-      identifiers = ["*"]
+    filter {
+      prefix = "uploads/"
     }
 
-    actions   = ["s3:GetObject"]
-    resources = ["${aws_s3_bucket.images_bucket.arn}/*"]
+    expiration {
+      days = 1
+    }
   }
+}
+
+resource "aws_s3_bucket_public_access_block" "public_access_block" {
+  bucket = aws_s3_bucket.images_bucket.id
+
+  block_public_acls       = true
+  block_public_policy     = true
+  ignore_public_acls      = true
+  restrict_public_buckets = true
+}
 
+data "aws_iam_policy_document" "images_bucket_policy" {
+  # nothing is public: photos are only read through URLs the user-service
+  # presigns for viewers allowed to see them
   statement {
     sid    = "AllowPutObjectForPresignRole"
     effect = "Allow"
@@ -61,6 +68,7 @@ data "aws_iam_policy_document" "s3_presign_policy" {
     actions = [
       "s3:PutObject",
       "s3:GetObject",
+      "s3:DeleteObject",
     ]
     resources = [
       "${aws_s3_bucket.images_bucket.arn}/*"
@@ -110,6 +110,9 @@ resource "aws_lambda_event_source_mapping" "sqs_trigger" {
   function_name    = aws_lambda_function.sqs_consumer.arn
   enabled          = true
   batch_size       = 10
+
+  # only redeliver the records listed in the handler's BatchItemFailures
+  function_response_types = ["ReportBatchItemFailures"]
 }
 
 
@@ -0,0 +1,106 @@
+// searchindex manages the versioned users indices behind the users alias in
+// OpenSearch (OPENSEARCH_ENDPOINT). status and reindex read Postgres with the
+// same env vars as the user-service.
+//
+//	go run ./cmd/searchindex status
+//	go run ./cmd/searchindex reindex              # build users_v<MappingVersion> and promote it
+//	go run ./cmd/searchindex create -version 2
+//	go run ./cmd/searchindex promote -version 1   # roll back to an older index
+//	go run ./cmd/searchindex drop -version 1
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/opensearch-project/opensearch-go"
+	"github.com/sebaraj/crush/user-service/searchindex"
+	"github.com/sebaraj/crush/user-service/server"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	command := os.Args[1]
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	version := flags.Int("version", searchindex.MappingVersion, "index version, users_v<version>")
+	batchSize := flags.Int("batch", searchindex.DefaultBatchSize, "documents per bulk request when reindexing")
+	flags.Parse(os.Args[2:])
+
+	client, err := opensearch.NewClient(opensearch.Config{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		Addresses: []string{server.GetEnv("OPENSEARCH_ENDPOINT", "")},
+	})
+	if err != nil {
+		log.Fatalf("Error creating the OpenSearch client: %s", err)
+	}
+	manager := &searchindex.Manager{Client: client}
+	ctx := context.Background()
+
+	switch command {
+	case "status":
+		db := server.ConnectToDB()
+		defer db.Close()
+		err = status(ctx, manager, db)
+	case "create":
+		err = manager.Create(ctx, *version)
+	case "promote":
+		err = manager.Promote(ctx, *version)
+	case "drop":
+		err = manager.Drop(ctx, *version)
+	case "reindex":
+		db := server.ConnectToDB()
+		defer db.Close()
+		_, err = manager.Reindex(ctx, db, *version, *batchSize)
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatalf("%s failed: %v", command, err)
+	}
+}
+
+func status(ctx context.Context, manager *searchindex.Manager, db *sql.DB) error {
+	indexer, err := searchindex.Status(ctx, db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("indexer: %d changes pending", indexer.Pending)
+	if !indexer.UpdatedAt.IsZero() {
+		fmt.Printf(", %d applied through change %d as of %s", indexer.Applied, indexer.LastChangeID, indexer.UpdatedAt.Format(time.RFC3339))
+	}
+	fmt.Println()
+
+	targets, err := manager.Targets(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("mapping version: %d (%s)\n", searchindex.MappingVersion, searchindex.IndexName(searchindex.MappingVersion))
+	if len(targets) > 0 {
+		fmt.Printf("%s -> %v\n", searchindex.Alias, targets)
+		return nil
+	}
+	legacy, err := manager.Exists(ctx, searchindex.Alias)
+	if err != nil {
+		return err
+	}
+	if legacy {
+		fmt.Printf("%s is an unversioned index; run reindex to replace it with an alias\n", searchindex.Alias)
+	} else {
+		fmt.Printf("%s does not exist; run reindex to create it\n", searchindex.Alias)
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: searchindex status|create|promote|drop|reindex [-version n] [-batch n]")
+	os.Exit(2)
+}
@@ -3,7 +3,7 @@
  * File Name: user-service/main.go
  * Author: Bryan SebaRaj
  * Description: Entrypoint for user service pod; initializes server and its dependencies/
- * connections to PostgreSQL (DMS), S3, and OpenSearch.
+ * connections to PostgreSQL, S3, and OpenSearch.
  * Date Created: 01-01-2025
  *
  * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
@@ -29,6 +29,7 @@ import (
 	_ "github.com/lib/pq"
 
 	"github.com/opensearch-project/opensearch-go"
+	"github.com/sebaraj/crush/user-service/searchindex"
 	"github.com/sebaraj/crush/user-service/server"
 )
 
@@ -59,6 +60,14 @@ func main() {
 	}
 	log.Printf("OpenSearch client created")
 
+	// apply search_changes to the users index in the background
+	indexerCtx, stopIndexer := context.WithCancel(context.Background())
+	indexerDone := make(chan struct{})
+	go func() {
+		defer close(indexerDone)
+		searchindex.NewIndexer(db, &searchindex.Manager{Client: osClient}).Run(indexerCtx)
+	}()
+
 	// connect to s3
 	sess := session.Must(session.NewSession(&aws.Config{
 		Region: aws.String(s3Region),
@@ -93,6 +102,8 @@ func main() {
 	if err := server.Shutdown(ctx); err != nil {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
+	stopIndexer()
+	<-indexerDone
 	if err := app.DB.Close(); err != nil {
 		log.Fatalf("Error closing DB: %v", err)
 	}
@@ -0,0 +1,78 @@
+/***************************************************************************
+ * File Name: user-service/pictures/moderation.go
+ * Author: Bryan SebaRaj
+ * Description: Pluggable moderation check run on every processed picture
+ * Date Created: 01-01-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package pictures
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+type Verdict struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Moderator decides whether a processed picture may become a user's profile
+// picture. an error means no decision was made and the upload can be
+// confirmed again later.
+type Moderator interface {
+	Moderate(ctx context.Context, email string, picture []byte) (Verdict, error)
+}
+
+// AllowAll approves every picture; it is used when no moderation service is
+// configured
+type AllowAll struct{}
+
+func (AllowAll) Moderate(context.Context, string, []byte) (Verdict, error) {
+	return Verdict{Allowed: true}, nil
+}
+
+// Webhook posts the processed JPEG to URL, with the uploader in the X-User-Email
+// header, and expects a Verdict back
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewWebhook(url string) *Webhook {
+	return &Webhook{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (m *Webhook) Moderate(ctx context.Context, email string, picture []byte) (Verdict, error) {
+	var verdict Verdict
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.URL, bytes.NewReader(picture))
+	if err != nil {
+		return verdict, err
+	}
+	req.Header.Set("Content-Type", "image/jpeg")
+	req.Header.Set("X-User-Email", email)
+
+	res, err := m.Client.Do(req)
+	if err != nil {
+		return verdict, fmt.Errorf("moderation request failed: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return verdict, fmt.Errorf("moderation service returned %d: %s", res.StatusCode, body)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&verdict); err != nil {
+		return verdict, fmt.Errorf("failed to decode moderation verdict: %w", err)
+	}
+	return verdict, nil
+}
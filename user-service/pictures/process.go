@@ -0,0 +1,280 @@
+/***************************************************************************
+ * File Name: user-service/pictures/process.go
+ * Author: Bryan SebaRaj
+ * Description: Validates uploaded profile pictures and re-encodes them,
+ *              without metadata, at display and thumbnail sizes
+ * Date Created: 01-01-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package pictures
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png"
+)
+
+const (
+	// MaxUploadBytes is the largest upload accepted, enforced by the presigned
+	// POST policy and again when the upload is read back
+	MaxUploadBytes = 10 << 20
+	// MaxPixels bounds the decoded size, so a small file can't expand into a
+	// huge bitmap. processing holds the decoded image and one RGBA copy of it,
+	// up to 8 bytes a pixel, so about 200 MB at the limit.
+	MaxPixels = 24_000_000
+	MinSide   = 200
+	// the longest side of the display image
+	FullSide = 1080
+	// thumbnails are square, cropped from the center
+	ThumbnailSide = 256
+	jpegQuality   = 85
+)
+
+// ContentTypes are the accepted upload types and the image.Decode format
+// names they must decode as
+var ContentTypes = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+}
+
+// ErrInvalidPicture is wrapped by every error caused by the upload itself
+// rather than by the service
+var ErrInvalidPicture = errors.New("invalid picture")
+
+// Processed holds the re-encoded JPEGs of an upload. nothing of the original
+// file but its pixels survives, so EXIF (including GPS location) is dropped.
+type Processed struct {
+	Full          []byte
+	Thumbnail     []byte
+	Width, Height int
+}
+
+func invalid(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidPicture, fmt.Sprintf(format, args...))
+}
+
+// Process checks that data is an image of contentType within the size limits,
+// applies its EXIF orientation, and renders the display image and thumbnail
+func Process(data []byte, contentType string) (*Processed, error) {
+	want, ok := ContentTypes[contentType]
+	if !ok {
+		return nil, invalid("unsupported content type %q", contentType)
+	}
+	if len(data) > MaxUploadBytes {
+		return nil, invalid("larger than %d bytes", MaxUploadBytes)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, invalid("not an image")
+	}
+	if format != want {
+		return nil, invalid("uploaded as %s but is %s", contentType, format)
+	}
+	if config.Width < MinSide || config.Height < MinSide {
+		return nil, invalid("smaller than %dx%d", MinSide, MinSide)
+	}
+	if config.Width*config.Height > MaxPixels {
+		return nil, invalid("more than %d pixels", MaxPixels)
+	}
+
+	img, err := decodeRGBA(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// scaling and cropping don't depend on orientation, so the image is only
+	// turned upright once it is small
+	full := img
+	if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w > FullSide || h > FullSide {
+		if w >= h {
+			full = resize(img, FullSide, max(1, h*FullSide/w))
+		} else {
+			full = resize(img, max(1, w*FullSide/h), FullSide)
+		}
+	}
+	thumbnail := resize(centerSquare(img), ThumbnailSide, ThumbnailSide)
+	if format == "jpeg" {
+		orientation := jpegOrientation(data)
+		full, thumbnail = orient(full, orientation), orient(thumbnail, orientation)
+	}
+
+	processed := &Processed{Width: full.Bounds().Dx(), Height: full.Bounds().Dy()}
+	if processed.Full, err = encode(full); err != nil {
+		return nil, err
+	}
+	if processed.Thumbnail, err = encode(thumbnail); err != nil {
+		return nil, err
+	}
+	return processed, nil
+}
+
+// decodeRGBA decodes data into an RGBA. the decoder's own image is garbage
+// once this returns, so only the copy stays alive while processing.
+func decodeRGBA(data []byte) (*image.RGBA, error) {
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, invalid("failed to decode: %v", err)
+	}
+	return toRGBA(decoded), nil
+}
+
+func encode(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, fmt.Errorf("failed to encode jpeg: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// toRGBA copies img into an RGBA with its origin at 0,0, flattening any
+// transparency onto white since JPEG has no alpha
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Over)
+	return rgba
+}
+
+func centerSquare(img *image.RGBA) *image.RGBA {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	side := min(w, h)
+	x, y := (w-side)/2, (h-side)/2
+	return img.SubImage(image.Rect(x, y, x+side, y+side)).(*image.RGBA)
+}
+
+// resize scales img to w x h, averaging the source pixels under each
+// destination pixel (a box filter), which is enough for downscaling photos
+func resize(img *image.RGBA, w, h int) *image.RGBA {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max((y+1)*sh/h, y*sh/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max((x+1)*sw/w, x*sw/w+1)
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				i := img.PixOffset(b.Min.X+x0, b.Min.Y+sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(img.Pix[i])
+					g += uint32(img.Pix[i+1])
+					bl += uint32(img.Pix[i+2])
+					a += uint32(img.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+			j := dst.PixOffset(x, y)
+			dst.Pix[j], dst.Pix[j+1], dst.Pix[j+2], dst.Pix[j+3] = uint8(r/n), uint8(g/n), uint8(bl/n), uint8(a/n)
+		}
+	}
+	return dst
+}
+
+// orient turns img upright according to an EXIF orientation (1-8), since the
+// tag itself is dropped on re-encoding
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	// source returns the pixel of img that lands at x, y
+	source := map[int]func(x, y int) (int, int){
+		2: func(x, y int) (int, int) { return w - 1 - x, y },
+		3: func(x, y int) (int, int) { return w - 1 - x, h - 1 - y },
+		4: func(x, y int) (int, int) { return x, h - 1 - y },
+		5: func(x, y int) (int, int) { return y, x },
+		6: func(x, y int) (int, int) { return y, h - 1 - x },
+		7: func(x, y int) (int, int) { return w - 1 - y, h - 1 - x },
+		8: func(x, y int) (int, int) { return w - 1 - y, x },
+	}[orientation]
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := source(x, y)
+			i, j := img.PixOffset(sx, sy), dst.PixOffset(x, y)
+			copy(dst.Pix[j:j+4], img.Pix[i:i+4])
+		}
+	}
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, or 1 if it has
+// none. only the APP1 segments before the image data are read.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		// start of scan: no metadata after this
+		if marker == 0xDA {
+			return 1
+		}
+		length := int(data[i+2])<<8 | int(data[i+3])
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			if orientation := exifOrientation(segment[6:]); orientation != 0 {
+				return orientation
+			}
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation reads tag 0x0112 from the first IFD of a TIFF header, or
+// returns 0
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var u16 func([]byte) int
+	var u32 func([]byte) int
+	switch string(tiff[:2]) {
+	case "II":
+		u16 = func(b []byte) int { return int(b[0]) | int(b[1])<<8 }
+		u32 = func(b []byte) int { return u16(b) | u16(b[2:])<<16 }
+	case "MM":
+		u16 = func(b []byte) int { return int(b[0])<<8 | int(b[1]) }
+		u32 = func(b []byte) int { return u16(b)<<16 | u16(b[2:]) }
+	default:
+		return 0
+	}
+	ifd := u32(tiff[4:])
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	entries := u16(tiff[ifd:])
+	for e := 0; e < entries; e++ {
+		entry := ifd + 2 + 12*e
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		// a SHORT, stored in the first two bytes of the value field
+		if u16(tiff[entry:]) == 0x0112 {
+			return u16(tiff[entry+8:])
+		}
+	}
+	return 0
+}
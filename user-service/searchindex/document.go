@@ -0,0 +1,88 @@
+/***************************************************************************
+ * File Name: user-service/searchindex/document.go
+ * Author: Bryan SebaRaj
+ * Description: Public search document projected from a users row
+ * Date Created: 01-01-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package searchindex
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Document is everything about a user that may be searched. contact info,
+// genders, preferences, answers, and photos never leave Postgres.
+type Document struct {
+	Email              string `json:"email"`
+	IsActive           bool   `json:"is_active"`
+	Name               string `json:"name"`
+	ResidentialCollege string `json:"residential_college,omitempty"`
+	GraduatingYear     int    `json:"graduating_year,omitempty"`
+	Interest1          string `json:"interest_1,omitempty"`
+	Interest2          string `json:"interest_2,omitempty"`
+	Interest3          string `json:"interest_3,omitempty"`
+	Interest4          string `json:"interest_4,omitempty"`
+	Interest5          string `json:"interest_5,omitempty"`
+}
+
+// DocumentColumns are the users columns a Document is built from, in
+// scanDocument's order
+const DocumentColumns = `email, is_active, name, residential_college, graduating_year,
+       interest_1, interest_2, interest_3, interest_4, interest_5`
+
+// Querier is satisfied by both *sql.DB and *sql.Tx
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// scanDocument reads a row of DocumentColumns
+func scanDocument(rows *sql.Rows) (Document, error) {
+	var doc Document
+	var name, college sql.NullString
+	var year sql.NullInt64
+	var interests [5]sql.NullString
+	err := rows.Scan(&doc.Email, &doc.IsActive, &name, &college, &year,
+		&interests[0], &interests[1], &interests[2], &interests[3], &interests[4])
+	if err != nil {
+		return doc, err
+	}
+	doc.Name = name.String
+	doc.ResidentialCollege = college.String
+	doc.GraduatingYear = int(year.Int64)
+	doc.Interest1, doc.Interest2, doc.Interest3 = interests[0].String, interests[1].String, interests[2].String
+	doc.Interest4, doc.Interest5 = interests[3].String, interests[4].String
+	return doc, nil
+}
+
+// LoadDocuments calls fn with the document of every user, in email order
+func LoadDocuments(ctx context.Context, q Querier, fn func(Document) error) error {
+	rows, err := q.QueryContext(ctx, "SELECT "+DocumentColumns+" FROM users ORDER BY email")
+	if err != nil {
+		return fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		doc, err := scanDocument(rows)
+		if err != nil {
+			return fmt.Errorf("failed to scan user: %w", err)
+		}
+		if err := fn(doc); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterate users: %w", err)
+	}
+	return nil
+}
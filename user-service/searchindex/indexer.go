@@ -0,0 +1,218 @@
+/***************************************************************************
+ * File Name: user-service/searchindex/indexer.go
+ * Author: Bryan SebaRaj
+ * Description: Keeps the users index in sync with Postgres by draining the
+ *              trigger-fed search_changes table
+ * Date Created: 01-01-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package searchindex
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultIndexerInterval = 2 * time.Second
+	// arbitrary key of the advisory lock that lets one indexer run at a time
+	indexerLockKey = 0x5ea4c4
+	// search_checkpoints row of the indexer
+	indexerCheckpoint = "indexer"
+)
+
+// Indexer applies search_changes to the users alias. the trigger on users
+// queues an email whenever one of its public columns changes; the indexer
+// rebuilds those users' documents from their current rows, or deletes them if
+// the row is gone, so documents never hold anything Document doesn't project.
+//
+// a batch's changes are only deleted, and the checkpoint advanced, in the
+// transaction that commits after OpenSearch acknowledged the batch, so a
+// crashed or restarted indexer resumes from the first unapplied change. an
+// advisory lock keeps replicas from applying batches out of order.
+type Indexer struct {
+	DB        *sql.DB
+	Manager   *Manager
+	Interval  time.Duration
+	BatchSize int
+}
+
+func NewIndexer(db *sql.DB, manager *Manager) *Indexer {
+	return &Indexer{
+		DB:        db,
+		Manager:   manager,
+		Interval:  defaultIndexerInterval,
+		BatchSize: DefaultBatchSize,
+	}
+}
+
+// Run indexes until ctx is done
+func (ix *Indexer) Run(ctx context.Context) {
+	ticker := time.NewTicker(ix.Interval)
+	defer ticker.Stop()
+	for {
+		// keep draining while full batches come back
+		for {
+			applied, err := ix.IndexOnce(ctx)
+			if err != nil {
+				log.Printf("Search indexer failed: %v", err)
+				break
+			}
+			if applied < ix.BatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// IndexOnce applies up to BatchSize changes and returns how many it applied
+func (ix *Indexer) IndexOnce(ctx context.Context) (applied int, err error) {
+	tx, err := ix.DB.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin tx: %w", err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	var locked bool
+	if err = tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock($1)", indexerLockKey).Scan(&locked); err != nil {
+		return 0, fmt.Errorf("failed to take indexer lock: %w", err)
+	}
+	if !locked {
+		// another replica is indexing
+		return 0, nil
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, email FROM search_changes ORDER BY id LIMIT $1", ix.BatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query search changes: %w", err)
+	}
+	var ids []int64
+	var emails []string
+	seen := map[string]bool{}
+	for rows.Next() {
+		var id int64
+		var email string
+		if err = rows.Scan(&id, &email); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan search change: %w", err)
+		}
+		ids = append(ids, id)
+		if !seen[email] {
+			seen[email] = true
+			emails = append(emails, email)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to iterate search changes: %w", err)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	docs, err := loadDocumentsFor(ctx, tx, emails)
+	if err != nil {
+		return 0, err
+	}
+	var deletes []string
+	for _, email := range emails {
+		if !containsEmail(docs, email) {
+			deletes = append(deletes, email)
+		}
+	}
+	if err = ix.Manager.Bulk(ctx, Alias, docs, deletes); err != nil {
+		return 0, err
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM search_changes WHERE id = ANY($1)", pq.Array(ids)); err != nil {
+		return 0, fmt.Errorf("failed to delete search changes: %w", err)
+	}
+	checkpointSQL := `
+		INSERT INTO search_checkpoints (name, last_change_id, applied, updated_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
+		ON CONFLICT (name) DO UPDATE
+		SET last_change_id = EXCLUDED.last_change_id,
+		    applied = search_checkpoints.applied + EXCLUDED.applied,
+		    updated_at = EXCLUDED.updated_at
+	`
+	if _, err = tx.ExecContext(ctx, checkpointSQL, indexerCheckpoint, ids[len(ids)-1], len(ids)); err != nil {
+		return 0, fmt.Errorf("failed to advance checkpoint: %w", err)
+	}
+	log.Printf("Indexed %d users and removed %d from %d search changes", len(docs), len(deletes), len(ids))
+	return len(ids), nil
+}
+
+// IndexerStatus is how far the indexer has got
+type IndexerStatus struct {
+	Pending      int
+	LastChangeID int64
+	Applied      int64
+	// zero before the first batch
+	UpdatedAt time.Time
+}
+
+// Status counts the unapplied search_changes and reads the indexer checkpoint
+func Status(ctx context.Context, q Querier) (IndexerStatus, error) {
+	var status IndexerStatus
+	if err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM search_changes").Scan(&status.Pending); err != nil {
+		return status, fmt.Errorf("failed to count search changes: %w", err)
+	}
+	err := q.QueryRowContext(ctx, "SELECT last_change_id, applied, updated_at FROM search_checkpoints WHERE name = $1", indexerCheckpoint).
+		Scan(&status.LastChangeID, &status.Applied, &status.UpdatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return status, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	return status, nil
+}
+
+// loadDocumentsFor returns the documents of the emails that still have a users row
+func loadDocumentsFor(ctx context.Context, tx *sql.Tx, emails []string) ([]Document, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT "+DocumentColumns+" FROM users WHERE email = ANY($1)", pq.Array(emails))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	var docs []Document
+	for rows.Next() {
+		doc, err := scanDocument(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
+
+func containsEmail(docs []Document, email string) bool {
+	for _, doc := range docs {
+		if doc.Email == email {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,264 @@
+/***************************************************************************
+ * File Name: user-service/searchindex/manager.go
+ * Author: Bryan SebaRaj
+ * Description: Versioned users indices behind the users alias
+ * Date Created: 01-01-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package searchindex
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/opensearch-project/opensearch-go"
+	"github.com/opensearch-project/opensearch-go/opensearchapi"
+)
+
+// Alias is the name the user-service searches and writers index into. it
+// points at exactly one users_v<version> index, so a reindex builds the next
+// version alongside and swaps the alias in one atomic request.
+const Alias = "users"
+
+const DefaultBatchSize = 500
+
+func IndexName(version int) string {
+	return fmt.Sprintf("%s_v%d", Alias, version)
+}
+
+type Manager struct {
+	Client *opensearch.Client
+}
+
+// do runs req and decodes a successful response into result (if not nil).
+// ok statuses other than 2xx, such as 404 on lookups, are returned as is.
+func (m *Manager) do(ctx context.Context, req opensearchapi.Request, result any, ok ...int) (int, error) {
+	res, err := req.Do(ctx, m.Client)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	for _, status := range ok {
+		if res.StatusCode == status {
+			return status, nil
+		}
+	}
+	if res.IsError() {
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, fmt.Errorf("opensearch returned %d: %s", res.StatusCode, body)
+	}
+	if result != nil {
+		if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+			return res.StatusCode, fmt.Errorf("failed to decode opensearch response: %w", err)
+		}
+	}
+	return res.StatusCode, nil
+}
+
+// Exists reports whether an index or alias called name exists
+func (m *Manager) Exists(ctx context.Context, name string) (bool, error) {
+	status, err := m.do(ctx, opensearchapi.IndicesExistsRequest{Index: []string{name}}, nil, http.StatusNotFound)
+	return status == http.StatusOK, err
+}
+
+// Create creates users_v<version> with Mapping
+func (m *Manager) Create(ctx context.Context, version int) error {
+	index := IndexName(version)
+	req := opensearchapi.IndicesCreateRequest{Index: index, Body: bytes.NewReader([]byte(Mapping))}
+	if _, err := m.do(ctx, req, nil); err != nil {
+		return fmt.Errorf("failed to create %s: %w", index, err)
+	}
+	log.Printf("Created index %s", index)
+	return nil
+}
+
+// Targets returns the indices Alias points at, sorted
+func (m *Manager) Targets(ctx context.Context) ([]string, error) {
+	var aliases map[string]json.RawMessage
+	status, err := m.do(ctx, opensearchapi.IndicesGetAliasRequest{Name: []string{Alias}}, &aliases, http.StatusNotFound)
+	if err != nil || status == http.StatusNotFound {
+		return nil, err
+	}
+	targets := make([]string, 0, len(aliases))
+	for index := range aliases {
+		targets = append(targets, index)
+	}
+	sort.Strings(targets)
+	return targets, nil
+}
+
+// Promote points Alias at users_v<version> and away from every other index in
+// one request. an unversioned index called users, as DMS used to create, is
+// deleted in the same request, since the alias can't be added beside it.
+func (m *Manager) Promote(ctx context.Context, version int) error {
+	index := IndexName(version)
+	targets, err := m.Targets(ctx)
+	if err != nil {
+		return err
+	}
+	actions := []any{}
+	for _, target := range targets {
+		if target != index {
+			actions = append(actions, map[string]any{"remove": map[string]any{"index": target, "alias": Alias}})
+		}
+	}
+	if len(targets) == 0 {
+		legacy, err := m.Exists(ctx, Alias)
+		if err != nil {
+			return err
+		}
+		if legacy {
+			actions = append(actions, map[string]any{"remove_index": map[string]any{"index": Alias}})
+		}
+	}
+	actions = append(actions, map[string]any{"add": map[string]any{"index": index, "alias": Alias, "is_write_index": true}})
+
+	body, err := json.Marshal(map[string]any{"actions": actions})
+	if err != nil {
+		return err
+	}
+	if _, err := m.do(ctx, opensearchapi.IndicesUpdateAliasesRequest{Body: bytes.NewReader(body)}, nil); err != nil {
+		return fmt.Errorf("failed to point %s at %s: %w", Alias, index, err)
+	}
+	log.Printf("Pointed %s at %s (was %v)", Alias, index, targets)
+	return nil
+}
+
+// Drop deletes users_v<version>, unless Alias points at it
+func (m *Manager) Drop(ctx context.Context, version int) error {
+	index := IndexName(version)
+	targets, err := m.Targets(ctx)
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		if target == index {
+			return fmt.Errorf("%s is live behind %s, promote another version first", index, Alias)
+		}
+	}
+	if _, err := m.do(ctx, opensearchapi.IndicesDeleteRequest{Index: []string{index}}, nil); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", index, err)
+	}
+	log.Printf("Deleted index %s", index)
+	return nil
+}
+
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		ID     string          `json:"_id"`
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// Bulk indexes docs into index, keyed by email, and deletes the documents of
+// the emails in deletes
+func (m *Manager) Bulk(ctx context.Context, index string, docs []Document, deletes []string) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, doc := range docs {
+		encoder.Encode(map[string]any{"index": map[string]any{"_id": doc.Email}})
+		if err := encoder.Encode(doc); err != nil {
+			return err
+		}
+	}
+	for _, email := range deletes {
+		encoder.Encode(map[string]any{"delete": map[string]any{"_id": email}})
+	}
+	if body.Len() == 0 {
+		return nil
+	}
+
+	var response bulkResponse
+	if _, err := m.do(ctx, opensearchapi.BulkRequest{Index: index, Body: &body}, &response); err != nil {
+		return fmt.Errorf("bulk request to %s failed: %w", index, err)
+	}
+	if !response.Errors {
+		return nil
+	}
+	for _, item := range response.Items {
+		for action, result := range item {
+			// deleting a document that was never indexed is fine
+			if result.Status > 299 && !(action == "delete" && result.Status == http.StatusNotFound) {
+				return fmt.Errorf("bulk %s of %s failed: %s", action, result.ID, result.Error)
+			}
+		}
+	}
+	return nil
+}
+
+// Reindex builds users_v<version> from every users row and promotes it. the
+// index is created if needed; reindexing into an existing one overwrites its
+// documents. users updated while the rows are read are queued in
+// search_changes once the alias moves, so the Indexer brings the new index up
+// to date; users deleted meanwhile are only dropped by the next reindex.
+func (m *Manager) Reindex(ctx context.Context, q Querier, version, batchSize int) (int, error) {
+	index := IndexName(version)
+	// users.updated_at is a timestamp without time zone
+	var started time.Time
+	if err := q.QueryRowContext(ctx, "SELECT LOCALTIMESTAMP").Scan(&started); err != nil {
+		return 0, fmt.Errorf("failed to read database time: %w", err)
+	}
+
+	exists, err := m.Exists(ctx, index)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		if err := m.Create(ctx, version); err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+	batch := make([]Document, 0, batchSize)
+	flush := func() error {
+		if err := m.Bulk(ctx, index, batch, nil); err != nil {
+			return err
+		}
+		count += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	err = LoadDocuments(ctx, q, func(doc Document) error {
+		batch = append(batch, doc)
+		if len(batch) == batchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return count, err
+	}
+	log.Printf("Indexed %d users into %s", count, index)
+
+	if _, err := m.do(ctx, opensearchapi.IndicesRefreshRequest{Index: []string{index}}, nil); err != nil {
+		return count, fmt.Errorf("failed to refresh %s: %w", index, err)
+	}
+	if err := m.Promote(ctx, version); err != nil {
+		return count, err
+	}
+
+	requeueSQL := `INSERT INTO search_changes (email) SELECT email FROM users WHERE updated_at >= $1`
+	if _, err := q.ExecContext(ctx, requeueSQL, started); err != nil {
+		return count, fmt.Errorf("failed to queue users changed during the reindex: %w", err)
+	}
+	return count, nil
+}
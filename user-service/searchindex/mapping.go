@@ -0,0 +1,61 @@
+/***************************************************************************
+ * File Name: user-service/searchindex/mapping.go
+ * Author: Bryan SebaRaj
+ * Description: Settings and mapping of the users OpenSearch index
+ * Date Created: 01-01-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package searchindex
+
+// MappingVersion is bumped whenever Mapping changes, so a reindex builds a
+// fresh users_v<version> index next to the live one
+const MappingVersion = 2
+
+// Mapping is the body every users index is created with. names
+// are folded to lowercase ascii; name.suggest also indexes every prefix of
+// each word (edge n-grams) so typeahead is a plain match, and name.keyword
+// sorts. documents only hold public fields, and dynamic is off so any other
+// column written to the index is kept in _source but never searchable.
+const Mapping = `{
+  "settings": {
+    "analysis": {
+      "filter": {
+        "name_prefix": {"type": "edge_ngram", "min_gram": 1, "max_gram": 20}
+      },
+      "normalizer": {
+        "folded": {"type": "custom", "filter": ["lowercase", "asciifolding"]}
+      },
+      "analyzer": {
+        "folded": {"type": "custom", "tokenizer": "standard", "filter": ["lowercase", "asciifolding"]},
+        "name_prefix": {"type": "custom", "tokenizer": "standard", "filter": ["lowercase", "asciifolding", "name_prefix"]}
+      }
+    }
+  },
+  "mappings": {
+    "dynamic": false,
+    "properties": {
+      "email": {"type": "keyword"},
+      "is_active": {"type": "boolean"},
+      "name": {
+        "type": "text",
+        "analyzer": "folded",
+        "fields": {
+          "keyword": {"type": "keyword", "normalizer": "folded"},
+          "suggest": {"type": "text", "analyzer": "name_prefix", "search_analyzer": "folded"}
+        }
+      },
+      "residential_college": {"type": "keyword"},
+      "graduating_year": {"type": "integer"},
+      "interest_1": {"type": "text", "analyzer": "folded"},
+      "interest_2": {"type": "text", "analyzer": "folded"},
+      "interest_3": {"type": "text", "analyzer": "folded"},
+      "interest_4": {"type": "text", "analyzer": "folded"},
+      "interest_5": {"type": "text", "analyzer": "folded"}
+    }
+  }
+}`
@@ -0,0 +1,52 @@
+/***************************************************************************
+ * File Name: user-service/server/api_error.go
+ * Author: Bryan SebaRaj
+ * Description: JSON error envelope for endpoints that report field errors
+ * Date Created: 01-01-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// error codes of APIError
+const (
+	codeInvalidJSON      = "invalid_json"
+	codeValidationFailed = "validation_failed"
+	codeNotFound         = "not_found"
+	codeInternal         = "internal_error"
+)
+
+// FieldErrors maps a request field to what is wrong with it
+type FieldErrors map[string]string
+
+// APIError is written as {"error": {...}}. Fields is only set for
+// validation_failed.
+type APIError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Fields  FieldErrors `json:"fields,omitempty"`
+}
+
+func writeAPIError(w http.ResponseWriter, status int, apiErr APIError) {
+	body, err := json.Marshal(map[string]APIError{"error": apiErr})
+	if err != nil {
+		http.Error(w, apiErr.Message, status)
+		log.Printf("Failed to marshal error response: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+/***************************************************************************
+ * File Name: user-service/server/blocks.go
+ * Author: Bryan SebaRaj
+ * Description: Handlers for blocking and reporting users
+ * Date Created: 01-01-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/lib/pq"
+)
+
+// reasons accepted by POST /v1/user/reports
+var reportReasons = map[string]bool{
+	"harassment":    true,
+	"spam":          true,
+	"fake_profile":  true,
+	"inappropriate": true,
+	"underage":      true,
+	"other":         true,
+}
+
+const maxReportDetails = 1000
+
+type Block struct {
+	BlockedEmail string `json:"blocked_email"`
+}
+
+type Report struct {
+	ReportedEmail string `json:"reported_email"`
+	Reason        string `json:"reason"`
+	Details       string `json:"details"`
+	// also block the reported user
+	Block bool `json:"block"`
+}
+
+// HandleBlocks lists the user's blocks (GET /v1/user/blocks/), or blocks or
+// unblocks the user in the path (POST or DELETE /v1/user/blocks/{email}).
+// the blocker is always the token's user.
+func (s *Server) HandleBlocks(w http.ResponseWriter, r *http.Request) {
+	printRequestDetails(r)
+	target := r.URL.Path[len("/v1/user/blocks/"):]
+	emailFromToken, err := s.validateOAuthToken(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && target == "":
+		s.handleListBlocks(w, r, emailFromToken)
+	case target == "":
+		http.Error(w, "Email is required", http.StatusBadRequest)
+	case target == emailFromToken:
+		http.Error(w, "You can't block yourself", http.StatusBadRequest)
+	case r.Method == http.MethodPost:
+		s.handleBlockUser(w, r, emailFromToken, target)
+	case r.Method == http.MethodDelete:
+		s.handleUnblockUser(w, r, emailFromToken, target)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleListBlocks(w http.ResponseWriter, r *http.Request, email string) {
+	log.Printf("GET request for blocks of user: %s", email)
+
+	rows, err := s.DB.QueryContext(r.Context(), "SELECT blocked_email FROM blocks WHERE blocker_email = $1 ORDER BY created_at", email)
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to query blocks: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	blocks := []Block{}
+	for rows.Next() {
+		var block Block
+		if err := rows.Scan(&block.BlockedEmail); err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Printf("Failed to scan block: %v", err)
+			return
+		}
+		blocks = append(blocks, block)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to iterate blocks: %v", err)
+		return
+	}
+
+	jsonResponse, err := json.Marshal(blocks)
+	if err != nil {
+		http.Error(w, "Failed to marshal JSON response", http.StatusInternalServerError)
+		log.Printf("Failed to marshal JSON response: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(jsonResponse); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+func (s *Server) handleBlockUser(w http.ResponseWriter, r *http.Request, email, target string) {
+	log.Printf("POST request for %s to block %s", email, target)
+
+	if err := insertBlock(r.Context(), s.DB, email, target); err != nil {
+		if isUnknownUser(err) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to block user", http.StatusInternalServerError)
+		log.Printf("Failed to insert block: %v", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	log.Printf("User %s blocked %s", email, target)
+}
+
+func (s *Server) handleUnblockUser(w http.ResponseWriter, r *http.Request, email, target string) {
+	log.Printf("DELETE request for %s to unblock %s", email, target)
+
+	result, err := s.DB.ExecContext(r.Context(), "DELETE FROM blocks WHERE blocker_email = $1 AND blocked_email = $2", email, target)
+	if err != nil {
+		http.Error(w, "Failed to unblock user", http.StatusInternalServerError)
+		log.Printf("Failed to delete block: %v", err)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		http.Error(w, "User is not blocked", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	log.Printf("User %s unblocked %s", email, target)
+}
+
+// HandleReports files a report against another user, optionally blocking them
+// in the same transaction
+func (s *Server) HandleReports(w http.ResponseWriter, r *http.Request) {
+	printRequestDetails(r)
+	emailFromToken, err := s.validateOAuthToken(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var report Report
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		log.Printf("Failed to decode request body: %v", err)
+		return
+	}
+	switch {
+	case report.ReportedEmail == "":
+		http.Error(w, "reported_email is required", http.StatusBadRequest)
+		return
+	case report.ReportedEmail == emailFromToken:
+		http.Error(w, "You can't report yourself", http.StatusBadRequest)
+		return
+	case !reportReasons[report.Reason]:
+		http.Error(w, "Invalid reason: "+report.Reason, http.StatusBadRequest)
+		return
+	case len(report.Details) > maxReportDetails:
+		http.Error(w, "details is too long", http.StatusBadRequest)
+		return
+	}
+	log.Printf("POST request for %s to report %s for %s", emailFromToken, report.ReportedEmail, report.Reason)
+
+	if err := s.insertReport(r.Context(), emailFromToken, report); err != nil {
+		if isUnknownUser(err) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to report user", http.StatusInternalServerError)
+		log.Printf("Failed to insert report: %v", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	log.Printf("User %s reported %s", emailFromToken, report.ReportedEmail)
+}
+
+func (s *Server) insertReport(ctx context.Context, email string, report Report) (err error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	details := sql.NullString{String: report.Details, Valid: report.Details != ""}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO reports (reporter_email, reported_email, reason, details)
+		VALUES ($1, $2, $3, $4)
+	`, email, report.ReportedEmail, report.Reason, details)
+	if err != nil {
+		return err
+	}
+	if report.Block {
+		err = insertBlock(ctx, tx, email, report.ReportedEmail)
+	}
+	return err
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// insertBlock blocks target for email; blocking twice is a no-op
+func insertBlock(ctx context.Context, db execer, email, target string) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO blocks (blocker_email, blocked_email)
+		VALUES ($1, $2)
+		ON CONFLICT (blocker_email, blocked_email) DO NOTHING
+	`, email, target)
+	return err
+}
+
+// blockedWith returns everyone email has blocked or been blocked by
+func (s *Server) blockedWith(ctx context.Context, email string) (map[string]bool, error) {
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT blocked_email FROM blocks WHERE blocker_email = $1
+		UNION
+		SELECT blocker_email FROM blocks WHERE blocked_email = $1
+	`, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocked := map[string]bool{}
+	for rows.Next() {
+		var other string
+		if err := rows.Scan(&other); err != nil {
+			return nil, err
+		}
+		blocked[other] = true
+	}
+	return blocked, rows.Err()
+}
+
+// isUnknownUser reports whether err is a foreign key violation, which on
+// blocks and reports means the other user doesn't exist
+func isUnknownUser(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
@@ -21,19 +21,15 @@ import (
 	"google.golang.org/api/idtoken"
 )
 
-// middleware to validate OAuth token using client key. use on any protected routes
-// returns (email|"", nil|error)
-func (s *Server) validateOAuthToken(r *http.Request) (string, error) {
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		return "", errors.New("no token provided")
-	}
+// TokenVerifier checks an OAuth ID token and returns the email it was issued to
+type TokenVerifier func(ctx context.Context, token string) (string, error)
 
+// VerifyGoogleToken validates a Google ID token issued to OAUTH_CLIENT
+func VerifyGoogleToken(ctx context.Context, token string) (string, error) {
 	oauthClient := os.Getenv("OAUTH_CLIENT")
 	if oauthClient == "" {
 		return "", errors.New("OAUTH_CLIENT not set")
 	}
-	ctx := context.Background()
 	payload, err := idtoken.Validate(ctx, token, oauthClient)
 	if err != nil {
 		return "", err
@@ -47,10 +43,20 @@ func (s *Server) validateOAuthToken(r *http.Request) (string, error) {
 	return email, nil
 }
 
+// middleware to validate OAuth token using client key. use on any protected routes
+// returns (email|"", nil|error)
+func (s *Server) validateOAuthToken(r *http.Request) (string, error) {
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		return "", errors.New("no token provided")
+	}
+	return s.VerifyToken(r.Context(), token)
+}
+
 func (s *Server) corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*") // change to yalecrush.com for prod
-		w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, PATCH, POST, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 		w.Header().Set("Cross-Origin-Opener-Policy", "unsafe-none")
 
@@ -0,0 +1,468 @@
+/***************************************************************************
+ * File Name: user-service/server/photos.go
+ * Author: Bryan SebaRaj
+ * Description: Handlers for listing, reordering, and deleting a user's photos
+ * Date Created: 01-01-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/lib/pq"
+)
+
+const (
+	MaxPhotos = 6
+	// photo URLs are signed for photoURLExpiry and handed out from
+	// Server.PhotoURLs while they have photoURLMinRemaining left. the cache is
+	// shared by every viewer, and a URL can't be revoked, so someone who loses
+	// access (a block or an unmatch) keeps the URLs they already have for at
+	// most photoURLExpiry.
+	photoURLExpiry       = 10 * time.Minute
+	photoURLMinRemaining = 3 * time.Minute
+)
+
+var (
+	errTooManyPhotos = fmt.Errorf("a user can have at most %d photos", MaxPhotos)
+	errPhotoNotFound = errors.New("photo not found")
+	errUserNotFound  = errors.New("user not found")
+	errConfirmed     = errors.New("upload already confirmed")
+	errInvalidOrder  = errors.New("order must list each photo exactly once")
+)
+
+// Photo is one of a user's photos. URL and ThumbnailURL are presigned GET
+// URLs, valid for at least photoURLMinRemaining; the bucket itself is private.
+type Photo struct {
+	ID           string `json:"id"`
+	Position     int    `json:"position"`
+	Primary      bool   `json:"primary"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+
+	key          string
+	thumbnailKey string
+}
+
+// PhotoOrder lists every one of a user's photo ids, primary first
+type PhotoOrder struct {
+	Order []string `json:"order"`
+}
+
+// HandlePhotos lists (GET /v1/user/photos/{email}) or reorders (PUT, with a
+// PhotoOrder) a user's photos, makes one primary (PUT
+// /v1/user/photos/{email}/{id}/primary), or deletes one (DELETE
+// /v1/user/photos/{email}/{id}). photos are added through HandlePicture.
+// other users may only list them, and only if canViewPhotos allows it.
+func (s *Server) HandlePhotos(w http.ResponseWriter, r *http.Request) {
+	printRequestDetails(r)
+	userEmail, rest, _ := strings.Cut(r.URL.Path[len("/v1/user/photos/"):], "/")
+	photoID, action, _ := strings.Cut(rest, "/")
+
+	emailFromToken, err := s.validateOAuthToken(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case userEmail != emailFromToken && photoID == "" && r.Method == http.MethodGet:
+		s.handleViewPhotos(w, r, emailFromToken, userEmail)
+	case userEmail != emailFromToken:
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+	case photoID == "" && r.Method == http.MethodGet:
+		s.handleListPhotos(w, r, userEmail)
+	case photoID == "" && r.Method == http.MethodPut:
+		s.handleReorderPhotos(w, r, userEmail)
+	case photoID != "" && action == "" && r.Method == http.MethodDelete:
+		s.handleDeletePhoto(w, r, userEmail, photoID)
+	case photoID != "" && action == "primary" && r.Method == http.MethodPut:
+		s.handleSetPrimaryPhoto(w, r, userEmail, photoID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleListPhotos(w http.ResponseWriter, r *http.Request, email string) {
+	log.Printf("GET request for photos of user: %s", email)
+
+	photos, err := loadPhotos(r.Context(), s.DB, email)
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to query photos: %v", err)
+		return
+	}
+	s.writePhotos(w, photos)
+}
+
+func (s *Server) handleViewPhotos(w http.ResponseWriter, r *http.Request, viewer, email string) {
+	log.Printf("GET request from %s for photos of user: %s", viewer, email)
+
+	allowed, err := s.canViewPhotos(r.Context(), viewer, email)
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to check photo access: %v", err)
+		return
+	}
+	if !allowed {
+		// the same answer as for a user that doesn't exist
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	photos, err := loadPhotos(r.Context(), s.DB, email)
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to query photos: %v", err)
+		return
+	}
+	s.writePhotos(w, photos)
+}
+
+// canViewPhotos reports whether viewer may see email's photos, full size or
+// as a thumbnail in search (see photosVisible)
+func (s *Server) canViewPhotos(ctx context.Context, viewer, email string) (bool, error) {
+	var allowed bool
+	err := s.DB.QueryRowContext(ctx, `SELECT `+photosVisible("$1", "$2"), viewer, email).Scan(&allowed)
+	return allowed, err
+}
+
+// photosVisible is the SQL condition that viewer may see owner's photos: only
+// if they share a match that viewer can see, as match-service shows it (a
+// generated match, viewer's own crush, or a mutual match), and neither has
+// blocked the other
+func photosVisible(viewer, owner string) string {
+	return fmt.Sprintf(`
+		EXISTS (
+			SELECT 1 FROM matches m
+			WHERE ((m.user1_email = %[1]s AND m.user2_email = %[2]s) OR (m.user1_email = %[2]s AND m.user2_email = %[1]s))
+			  AND (m.server_generated OR m.user1_email = %[1]s OR (m.user1_interested AND m.user2_interested))
+		) AND NOT EXISTS (
+			SELECT 1 FROM blocks b
+			WHERE (b.blocker_email = %[1]s AND b.blocked_email = %[2]s) OR (b.blocker_email = %[2]s AND b.blocked_email = %[1]s)
+		)
+	`, viewer, owner)
+}
+
+func (s *Server) handleReorderPhotos(w http.ResponseWriter, r *http.Request, email string) {
+	log.Printf("PUT request to reorder photos of user: %s", email)
+
+	var order PhotoOrder
+	if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		log.Printf("Failed to decode request body: %v", err)
+		return
+	}
+
+	var photos []Photo
+	err := s.withPhotosLocked(r.Context(), email, func(tx *sql.Tx) error {
+		current, err := loadPhotos(r.Context(), tx, email)
+		if err != nil {
+			return err
+		}
+		if !samePhotos(current, order.Order) {
+			return errInvalidOrder
+		}
+		if err := s.applyPhotoOrder(r.Context(), tx, email, order.Order); err != nil {
+			return err
+		}
+		photos, err = loadPhotos(r.Context(), tx, email)
+		return err
+	})
+	if err != nil {
+		s.photoError(w, err, errInvalidOrder)
+		return
+	}
+	s.writePhotos(w, photos)
+}
+
+func (s *Server) handleSetPrimaryPhoto(w http.ResponseWriter, r *http.Request, email, photoID string) {
+	log.Printf("PUT request to make photo %s primary: %s", photoID, email)
+
+	var photos []Photo
+	err := s.withPhotosLocked(r.Context(), email, func(tx *sql.Tx) error {
+		current, err := loadPhotos(r.Context(), tx, email)
+		if err != nil {
+			return err
+		}
+		order := []string{photoID}
+		for _, photo := range current {
+			if photo.ID != photoID {
+				order = append(order, photo.ID)
+			}
+		}
+		if len(order) != len(current) {
+			return errPhotoNotFound
+		}
+		if err := s.applyPhotoOrder(r.Context(), tx, email, order); err != nil {
+			return err
+		}
+		photos, err = loadPhotos(r.Context(), tx, email)
+		return err
+	})
+	if err != nil {
+		s.photoError(w, err)
+		return
+	}
+	s.writePhotos(w, photos)
+}
+
+func (s *Server) handleDeletePhoto(w http.ResponseWriter, r *http.Request, email, photoID string) {
+	log.Printf("DELETE request for photo %s: %s", photoID, email)
+
+	var deleted Photo
+	err := s.withPhotosLocked(r.Context(), email, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(r.Context(), `
+			DELETE FROM user_photos WHERE id = $1 AND email = $2
+			RETURNING s3_key, thumbnail_s3_key, position
+		`, photoID, email).Scan(&deleted.key, &deleted.thumbnailKey, &deleted.Position)
+		if err == sql.ErrNoRows {
+			return errPhotoNotFound
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(r.Context(), `
+			UPDATE user_photos SET position = position - 1 WHERE email = $1 AND position > $2
+		`, email, deleted.Position)
+		return err
+	})
+	if err != nil {
+		s.photoError(w, err)
+		return
+	}
+
+	// the row is gone, so a failure here only leaves an unreferenced object
+	for _, key := range []string{deleted.key, deleted.thumbnailKey} {
+		s.PhotoURLs.Forget(key)
+		s.deleteObject(r.Context(), key)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	log.Printf("Deleted photo %s of user %s", photoID, email)
+}
+
+// addPhoto appends photo to the user's photos, making it primary if it is
+// the first. a photo whose upload was already confirmed, by a concurrent
+// confirm of the same upload, is errConfirmed.
+func (s *Server) addPhoto(ctx context.Context, email string, photo *Photo) error {
+	return s.withPhotosLocked(ctx, email, func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM user_photos WHERE id = $1)", photo.ID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return errConfirmed
+		}
+		count, err := countPhotos(ctx, tx, email)
+		if err != nil {
+			return err
+		}
+		if count >= MaxPhotos {
+			return errTooManyPhotos
+		}
+		photo.Position, photo.Primary = count, count == 0
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO user_photos (id, email, s3_key, thumbnail_s3_key, position, width, height)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`, photo.ID, email, photo.key, photo.thumbnailKey, photo.Position, photo.Width, photo.Height)
+		return err
+	})
+}
+
+// withPhotosLocked runs fn in a transaction holding the user's row lock, so
+// concurrent changes to their photos apply one at a time
+func (s *Server) withPhotosLocked(ctx context.Context, email string, fn func(tx *sql.Tx) error) (err error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	var locked string
+	err = tx.QueryRowContext(ctx, "SELECT email FROM users WHERE email = $1 FOR UPDATE", email).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return errUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return fn(tx)
+}
+
+// applyPhotoOrder moves each photo in order to its index. positions are
+// only unique at commit, so the photos can trade places in one statement.
+func (s *Server) applyPhotoOrder(ctx context.Context, tx *sql.Tx, email string, order []string) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE user_photos p
+		SET position = o.position - 1
+		FROM unnest($2::text[]) WITH ORDINALITY AS o(id, position)
+		WHERE p.id = o.id AND p.email = $1
+	`, email, pq.Array(order))
+	return err
+}
+
+func countPhotos(ctx context.Context, q queryer, email string) (int, error) {
+	var count int
+	err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM user_photos WHERE email = $1", email).Scan(&count)
+	return count, err
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// loadPhotos returns the user's photos in order, without URLs
+func loadPhotos(ctx context.Context, q queryer, email string) ([]Photo, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT id, s3_key, thumbnail_s3_key, position, width, height
+		FROM user_photos
+		WHERE email = $1
+		ORDER BY position
+	`, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	photos := []Photo{}
+	for rows.Next() {
+		var photo Photo
+		if err := rows.Scan(&photo.ID, &photo.key, &photo.thumbnailKey, &photo.Position, &photo.Width, &photo.Height); err != nil {
+			return nil, err
+		}
+		photo.Primary = photo.Position == 0
+		photos = append(photos, photo)
+	}
+	return photos, rows.Err()
+}
+
+// samePhotos reports whether order lists each of photos exactly once
+func samePhotos(photos []Photo, order []string) bool {
+	if len(order) != len(photos) {
+		return false
+	}
+	listed := map[string]bool{}
+	for _, id := range order {
+		listed[id] = true
+	}
+	for _, photo := range photos {
+		if !listed[photo.ID] {
+			return false
+		}
+	}
+	return true
+}
+
+// signPhotos fills in the presigned URLs of photos
+func (s *Server) signPhotos(photos []Photo) error {
+	for i := range photos {
+		var err error
+		if photos[i].URL, err = s.PhotoURLs.Get(photos[i].key); err != nil {
+			return err
+		}
+		if photos[i].ThumbnailURL, err = s.PhotoURLs.Get(photos[i].thumbnailKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// primaryThumbnails returns the presigned thumbnail URL of the primary photo
+// of each of emails that has one and whose photos viewer may see
+func (s *Server) primaryThumbnails(ctx context.Context, viewer string, emails []string) (map[string]string, error) {
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT p.email, p.thumbnail_s3_key FROM user_photos p
+		WHERE p.email = ANY($2) AND p.position = 0 AND (p.email = $1 OR`+photosVisible("$1", "p.email")+`)
+	`, viewer, pq.Array(emails))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	thumbnails := map[string]string{}
+	for rows.Next() {
+		var email, key string
+		if err := rows.Scan(&email, &key); err != nil {
+			return nil, err
+		}
+		if thumbnails[email], err = s.PhotoURLs.Get(key); err != nil {
+			return nil, err
+		}
+	}
+	return thumbnails, rows.Err()
+}
+
+func (s *Server) presignGet(key string, expiry time.Duration) (string, error) {
+	req, _ := s.S3Client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.S3Bucket),
+		Key:    aws.String(key),
+	})
+	return req.Presign(expiry)
+}
+
+func (s *Server) writePhotos(w http.ResponseWriter, photos []Photo) {
+	if err := s.signPhotos(photos); err != nil {
+		http.Error(w, "Failed to sign photo URLs", http.StatusInternalServerError)
+		log.Printf("Failed to sign photo URLs: %v", err)
+		return
+	}
+	jsonResponse, err := json.Marshal(photos)
+	if err != nil {
+		http.Error(w, "Failed to marshal JSON response", http.StatusInternalServerError)
+		log.Printf("Failed to marshal JSON response: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(jsonResponse); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// photoError reports err from a photo change; errors in badRequest are the
+// client's
+func (s *Server) photoError(w http.ResponseWriter, err error, badRequest ...error) {
+	for _, target := range badRequest {
+		if errors.Is(err, target) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	switch {
+	case errors.Is(err, errUserNotFound):
+		http.Error(w, "User not found", http.StatusNotFound)
+	case errors.Is(err, errPhotoNotFound):
+		http.Error(w, "Photo not found", http.StatusNotFound)
+	case errors.Is(err, errTooManyPhotos), errors.Is(err, errConfirmed):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "Failed to update photos", http.StatusInternalServerError)
+		log.Printf("Failed to update photos: %v", err)
+	}
+}
@@ -1,7 +1,8 @@
 /***************************************************************************
  * File Name: user-service/server/picture.go
  * Author: Bryan SebaRaj
- * Description: Handler for generating signed s3 URLs for user pictures
+ * Description: Handlers for uploading user pictures to s3: a presigned upload
+ *              followed by a confirm that processes and moderates it
  * Date Created: 01-01-2025
  *
  * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
@@ -13,19 +14,55 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
-	// "encoding/json"
-	// "io"
+
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sebaraj/crush/user-service/pictures"
 )
 
+const uploadExpiry = 5 * time.Minute
+
+// photos are only served through presigned URLs, so browsers may cache them
+// for as long as a URL lasts, but shared caches must not keep them at all
+var photoCacheControl = fmt.Sprintf("private, max-age=%d", int(photoURLExpiry.Seconds()))
+
+type PictureUploadRequest struct {
+	ContentType string `json:"content_type"`
+}
+
+// PictureUpload is a presigned POST: send a multipart/form-data request to
+// URL with Fields, then the file as the last field, named "file"
+type PictureUpload struct {
+	UploadID  string            `json:"upload_id"`
+	URL       string            `json:"url"`
+	Fields    map[string]string `json:"fields"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// HandlePicture starts an upload (POST /v1/user/picture/{email}) or confirms
+// one (POST /v1/user/picture/{email}/{upload_id}), which adds it to the
+// user's photos once it has been processed and passed moderation. the
+// upload id becomes the photo's id.
 func (s *Server) HandlePicture(w http.ResponseWriter, r *http.Request) {
 	printRequestDetails(r)
-	userEmail := r.URL.Path[len("/v1/user/picture/"):]
-	log.Printf("Search: %s", userEmail)
+	userEmail, uploadID, _ := strings.Cut(r.URL.Path[len("/v1/user/picture/"):], "/")
 
 	emailFromToken, err := s.validateOAuthToken(r)
 	if err != nil || userEmail != emailFromToken {
@@ -33,51 +70,287 @@ func (s *Server) HandlePicture(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	switch r.Method {
-	case http.MethodGet:
-		s.handleS3URLRequest(w, r, userEmail)
-	default:
+	switch {
+	case r.Method != http.MethodPost:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case uploadID == "":
+		s.handleStartUpload(w, r, userEmail)
+	default:
+		s.handleConfirmUpload(w, r, userEmail, uploadID)
 	}
 }
 
-func (s *Server) handleS3URLRequest(w http.ResponseWriter, r *http.Request, userEmail string) {
-	log.Printf("GET request for S3 signed url: %s", userEmail)
+func (s *Server) handleStartUpload(w http.ResponseWriter, r *http.Request, userEmail string) {
+	log.Printf("POST request for picture upload: %s", userEmail)
 
-	// generate S3 signed URL
-	objectKey := "user-images/" + userEmail + ".jpg"
-	expires := 5 * time.Minute
+	var request PictureUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		log.Printf("Failed to decode request body: %v", err)
+		return
+	}
+	if _, ok := pictures.ContentTypes[request.ContentType]; !ok {
+		http.Error(w, "content_type must be image/jpeg or image/png", http.StatusBadRequest)
+		return
+	}
+	// checked again when the upload is confirmed
+	count, err := countPhotos(r.Context(), s.DB, userEmail)
+	if err != nil {
+		log.Printf("Failed to count photos: %v", err)
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
+	if count >= MaxPhotos {
+		http.Error(w, errTooManyPhotos.Error(), http.StatusConflict)
+		return
+	}
 
-	req, _ := s.S3Client.PutObjectRequest(&s3.PutObjectInput{
-		Bucket: aws.String(s.S3Bucket),
-		Key:    aws.String(objectKey),
-	})
-	log.Printf("req: %v", req)
-	// log.Printf("output: %v", output)
-	url, err := req.Presign(expires)
+	uploadID, err := newUploadID()
+	if err != nil {
+		log.Printf("Failed to generate upload id: %v", err)
+		http.Error(w, "Failed to sign request", http.StatusInternalServerError)
+		return
+	}
+	upload, err := s.presignPost(r.Context(), uploadKey(userEmail, uploadID), request.ContentType, time.Now().UTC())
 	if err != nil {
 		log.Printf("Failed to sign request: %v", err)
 		http.Error(w, "Failed to sign request", http.StatusInternalServerError)
 		return
 	}
+	upload.UploadID = uploadID
 
-	// update user's picture S3 URL in database
-	s3PublicURL := "https://" + s.S3Bucket + ".s3.amazonaws.com/" + objectKey
-	_, err = s.DB.Exec("UPDATE users SET picture_s3_url = $1 WHERE email = $2", s3PublicURL, userEmail)
-	log.Printf("S3 URL: %s", s3PublicURL)
+	jsonResponse, err := json.Marshal(upload)
 	if err != nil {
-		log.Printf("Failed to update user's picture S3 URL: %v", err)
-		http.Error(w, "Failed to update user's picture S3 URL", http.StatusInternalServerError)
+		http.Error(w, "Failed to marshal JSON response", http.StatusInternalServerError)
+		log.Printf("Failed to marshal JSON response: %v", err)
 		return
 	}
-
-	// return S3 signed URL to client
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	_, err = w.Write([]byte(`{"url": "` + url + `"}`))
-	if err != nil {
+	if _, err := w.Write(jsonResponse); err != nil {
 		log.Printf("Failed to write response: %v", err)
-		http.Error(w, "Failed to write response", http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) handleConfirmUpload(w http.ResponseWriter, r *http.Request, userEmail, uploadID string) {
+	log.Printf("POST request to confirm picture upload %s: %s", uploadID, userEmail)
+	if !validUploadID(uploadID) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
 		return
 	}
+	ctx := r.Context()
+	key := uploadKey(userEmail, uploadID)
+
+	object, err := s.S3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.S3Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to get upload %s: %v", key, err)
+		http.Error(w, "Failed to read upload", http.StatusInternalServerError)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(object.Body, pictures.MaxUploadBytes+1))
+	object.Body.Close()
+	if err != nil {
+		log.Printf("Failed to read upload %s: %v", key, err)
+		http.Error(w, "Failed to read upload", http.StatusInternalServerError)
+		return
+	}
+
+	processed, err := pictures.Process(data, aws.StringValue(object.ContentType))
+	if err != nil {
+		if errors.Is(err, pictures.ErrInvalidPicture) {
+			s.deleteObject(ctx, key)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		log.Printf("Failed to process upload %s: %v", key, err)
+		http.Error(w, "Failed to process picture", http.StatusInternalServerError)
+		return
+	}
+
+	verdict, err := s.Moderator.Moderate(ctx, userEmail, processed.Full)
+	if err != nil {
+		// keep the upload so the confirm can be retried
+		log.Printf("Failed to moderate upload %s: %v", key, err)
+		http.Error(w, "Failed to moderate picture", http.StatusServiceUnavailable)
+		return
+	}
+	if !verdict.Allowed {
+		log.Printf("Upload %s rejected by moderation: %s", key, verdict.Reason)
+		s.deleteObject(ctx, key)
+		http.Error(w, "Picture rejected: "+verdict.Reason, http.StatusUnprocessableEntity)
+		return
+	}
+
+	photo := &Photo{
+		ID:     uploadID,
+		Width:  processed.Width,
+		Height: processed.Height,
+		key:    "user-images/" + userEmail + "/" + uploadID + ".jpg",
+	}
+	photo.thumbnailKey = thumbnailKey(photo.key)
+	for objectKey, body := range map[string][]byte{
+		photo.key:          processed.Full,
+		photo.thumbnailKey: processed.Thumbnail,
+	} {
+		_, err := s.S3Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:       aws.String(s.S3Bucket),
+			Key:          aws.String(objectKey),
+			Body:         bytes.NewReader(body),
+			ContentType:  aws.String("image/jpeg"),
+			CacheControl: aws.String(photoCacheControl),
+		})
+		if err != nil {
+			log.Printf("Failed to put %s: %v", objectKey, err)
+			http.Error(w, "Failed to store picture", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := s.addPhoto(ctx, userEmail, photo); err != nil {
+		// a concurrent confirm of this upload stored the same picture under
+		// the same keys, which are now its photo's
+		if errors.Is(err, errTooManyPhotos) {
+			// another upload was confirmed since this one started
+			for _, objectKey := range []string{photo.key, photo.thumbnailKey, key} {
+				s.deleteObject(ctx, objectKey)
+			}
+		}
+		s.photoError(w, err)
+		return
+	}
+	s.deleteObject(ctx, key)
+	log.Printf("Added photo %s for user %s", photo.ID, userEmail)
+
+	photos := []Photo{*photo}
+	if err := s.signPhotos(photos); err != nil {
+		http.Error(w, "Failed to sign photo URLs", http.StatusInternalServerError)
+		log.Printf("Failed to sign photo URLs: %v", err)
+		return
+	}
+	jsonResponse, err := json.Marshal(photos[0])
+	if err != nil {
+		http.Error(w, "Failed to marshal JSON response", http.StatusInternalServerError)
+		log.Printf("Failed to marshal JSON response: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write(jsonResponse); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// uploads live under uploads/, which isn't publicly readable and expires
+// unconfirmed objects (see terraform/s3.tf)
+func uploadKey(email, uploadID string) string {
+	return "uploads/" + email + "/" + uploadID
+}
+
+func thumbnailKey(pictureKey string) string {
+	return strings.TrimSuffix(pictureKey, ".jpg") + "_thumb.jpg"
+}
+
+func newUploadID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func validUploadID(id string) bool {
+	decoded, err := hex.DecodeString(id)
+	return err == nil && len(decoded) == 16
+}
+
+// deleteObject removes key from the bucket, only logging failures. uploads
+// left behind expire by themselves (see terraform/s3.tf).
+func (s *Server) deleteObject(ctx context.Context, key string) {
+	_, err := s.S3Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.S3Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		log.Printf("Failed to delete %s: %v", key, err)
+	}
+}
+
+// presignPost signs a POST policy that only accepts a single object at key,
+// of contentType and at most pictures.MaxUploadBytes. aws-sdk-go v1 has no
+// helper for POST policies, and a presigned PUT can't limit the size.
+func (s *Server) presignPost(ctx context.Context, key, contentType string, now time.Time) (*PictureUpload, error) {
+	creds, err := s.S3Client.Config.Credentials.GetWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credentials: %w", err)
+	}
+	region := aws.StringValue(s.S3Client.Config.Region)
+	date := now.Format("20060102")
+	credential := fmt.Sprintf("%s/%s/%s/s3/aws4_request", creds.AccessKeyID, date, region)
+	expiresAt := now.Add(uploadExpiry)
+
+	fields := map[string]string{
+		"key":              key,
+		"Content-Type":     contentType,
+		"x-amz-algorithm":  "AWS4-HMAC-SHA256",
+		"x-amz-credential": credential,
+		"x-amz-date":       now.Format("20060102T150405Z"),
+	}
+	if creds.SessionToken != "" {
+		fields["x-amz-security-token"] = creds.SessionToken
+	}
+	conditions := []any{
+		map[string]string{"bucket": s.S3Bucket},
+		[]any{"content-length-range", 1, pictures.MaxUploadBytes},
+	}
+	for name, value := range fields {
+		conditions = append(conditions, []string{"eq", "$" + name, value})
+	}
+	policy, err := json.Marshal(map[string]any{
+		"expiration": expiresAt.Format("2006-01-02T15:04:05.000Z"),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return nil, err
+	}
+	fields["policy"] = base64.StdEncoding.EncodeToString(policy)
+
+	signingKey := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	fields["x-amz-signature"] = hex.EncodeToString(hmacSHA256(signingKey, fields["policy"]))
+
+	endpoint, err := url.Parse(s.S3Client.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+	if aws.BoolValue(s.S3Client.Config.S3ForcePathStyle) {
+		endpoint.Path = "/" + s.S3Bucket + "/"
+	} else {
+		endpoint.Host = s.S3Bucket + "." + endpoint.Host
+		endpoint.Path = "/"
+	}
+	return &PictureUpload{URL: endpoint.String(), Fields: fields, ExpiresAt: expiresAt}, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// moderatorFromEnv posts pictures to PICTURE_MODERATION_URL if it is set
+func moderatorFromEnv() pictures.Moderator {
+	if url := GetEnv("PICTURE_MODERATION_URL", ""); url != "" {
+		return pictures.NewWebhook(url)
+	}
+	return pictures.AllowAll{}
 }
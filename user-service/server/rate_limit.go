@@ -0,0 +1,77 @@
+/***************************************************************************
+ * File Name: user-service/server/rate_limit.go
+ * Author: Bryan SebaRaj
+ * Description: Per-user token bucket rate limiter
+ * Date Created: 01-01-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimiter allows each key Rate requests per second on average, in bursts
+// of up to Burst. state is per replica, so the limit scales with the number
+// of pods; it only needs to stop a single client hammering one endpoint.
+type RateLimiter struct {
+	Rate  float64
+	Burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{Rate: rate, Burst: burst, buckets: map[string]*tokenBucket{}}
+}
+
+// Allow takes a token from key's bucket. when it is empty it returns false
+// and how long until the next token
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(l.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*l.Rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / l.Rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep forgets buckets that have refilled, which behave like new ones
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
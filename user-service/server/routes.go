@@ -20,6 +20,7 @@ import (
 	// "github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/opensearch-project/opensearch-go"
+	"github.com/sebaraj/crush/user-service/pictures"
 )
 
 type Server struct {
@@ -28,21 +29,35 @@ type Server struct {
 	S3Region         string
 	S3Client         *s3.S3
 	OpenSearchClient *opensearch.Client
+	SuggestLimiter   *RateLimiter
+	Moderator        pictures.Moderator
+	PhotoURLs        *SignedURLCache
+	// checks request tokens; VerifyGoogleToken outside of tests
+	VerifyToken TokenVerifier
 }
 
 func NewServer(db *sql.DB, bucket string, s3Region string, s3Client *s3.S3, opensearchClient *opensearch.Client) *Server {
-	return &Server{
+	s := &Server{
 		DB:               db,
 		S3Bucket:         bucket,
 		S3Region:         s3Region,
 		S3Client:         s3Client,
 		OpenSearchClient: opensearchClient,
+		SuggestLimiter:   suggestLimiterFromEnv(),
+		Moderator:        moderatorFromEnv(),
+		VerifyToken:      VerifyGoogleToken,
 	}
+	s.PhotoURLs = NewSignedURLCache(photoURLExpiry, photoURLMinRemaining, s.presignGet)
+	return s
 }
 
 func (s *Server) InitializeRoutes(router *http.ServeMux) {
 	router.HandleFunc("/v1/user/info/", s.corsMiddleware(s.HandleUser))
 	router.HandleFunc("/v1/user/answers/", s.corsMiddleware(s.HandleAnswers))
 	router.HandleFunc("/v1/user/search/", s.corsMiddleware(s.HandleSearch))
+	router.HandleFunc("/v1/user/suggest", s.corsMiddleware(s.HandleSuggest))
 	router.HandleFunc("/v1/user/picture/", s.corsMiddleware(s.HandlePicture))
+	router.HandleFunc("/v1/user/photos/", s.corsMiddleware(s.HandlePhotos))
+	router.HandleFunc("/v1/user/blocks/", s.corsMiddleware(s.HandleBlocks))
+	router.HandleFunc("/v1/user/reports", s.corsMiddleware(s.HandleReports))
 }
@@ -16,74 +16,318 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/sebaraj/crush/user-service/searchindex"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+	// opensearch's default index.max_result_window
+	maxSearchWindow = 10000
+	maxNameQuery    = 50
 )
 
+// publicFields are the only fields of the users index a search reads or
+// returns; everything else in a document stays private
+var publicFields = []string{
+	"email", "name", "residential_college", "graduating_year",
+	"interest_1", "interest_2", "interest_3", "interest_4", "interest_5",
+}
+
+var interestFields = []string{"interest_1", "interest_2", "interest_3", "interest_4", "interest_5"}
+
+// UserCard is the public view of another user returned by search.
+// ThumbnailURL is a presigned URL of their primary photo's thumbnail, only
+// set when the searcher may see their photos.
+type UserCard struct {
+	Email              string   `json:"email"`
+	Name               string   `json:"name"`
+	ResidentialCollege string   `json:"residential_college,omitempty"`
+	GraduatingYear     int      `json:"graduating_year,omitempty"`
+	ThumbnailURL       string   `json:"thumbnail_url,omitempty"`
+	Interests          []string `json:"interests,omitempty"`
+}
+
+type SearchResults struct {
+	Results []UserCard `json:"results"`
+	Total   int        `json:"total"`
+	// pass as ?offset= for the next page; omitted on the last page
+	NextOffset int `json:"next_offset,omitempty"`
+}
+
+// SearchParams is a parsed search query string. every set field narrows the
+// results; interests must all be among a user's interests.
+type SearchParams struct {
+	// prefix of the user's name, matched word by word
+	Name               string
+	ResidentialCollege string
+	GraduatingYear     int
+	Interests          []string
+	Limit              int
+	Offset             int
+}
+
+// ParseSearchParams reads name, residential_college, graduating_year,
+// interest (repeatable), limit, and offset, rejecting any other parameter
+func ParseSearchParams(query url.Values) (SearchParams, error) {
+	params := SearchParams{Limit: defaultSearchLimit}
+	for key, values := range query {
+		if len(values) > 1 && key != "interest" {
+			return params, fmt.Errorf("%s: expected one value", key)
+		}
+		value := strings.TrimSpace(values[0])
+		switch key {
+		case "name":
+			if len(value) > maxNameQuery {
+				return params, fmt.Errorf("name: expected at most %d characters", maxNameQuery)
+			}
+			params.Name = value
+		case "residential_college":
+			params.ResidentialCollege = value
+		case "graduating_year":
+			year, err := strconv.Atoi(value)
+			if err != nil || year < 1900 || year > 2200 {
+				return params, fmt.Errorf("graduating_year: expected a year")
+			}
+			params.GraduatingYear = year
+		case "interest":
+			if len(values) > NumInterests {
+				return params, fmt.Errorf("interest: expected at most %d", NumInterests)
+			}
+			for _, interest := range values {
+				if interest = strings.TrimSpace(interest); interest != "" {
+					params.Interests = append(params.Interests, interest)
+				}
+			}
+		case "limit":
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 1 || limit > maxSearchLimit {
+				return params, fmt.Errorf("limit: expected 1 to %d", maxSearchLimit)
+			}
+			params.Limit = limit
+		case "offset":
+			offset, err := strconv.Atoi(value)
+			if err != nil || offset < 0 {
+				return params, fmt.Errorf("offset: expected a non-negative integer")
+			}
+			params.Offset = offset
+		default:
+			return params, fmt.Errorf("unknown search parameter %q", key)
+		}
+	}
+	if params.Offset+params.Limit > maxSearchWindow {
+		return params, fmt.Errorf("offset: results past %d can't be paged to, narrow the search", maxSearchWindow)
+	}
+	return params, nil
+}
+
+// Query builds the OpenSearch request body for params. only active users are
+// returned, never the users in exclude (matched by document id, which is the
+// email), and only publicFields are read.
+func (p SearchParams) Query(exclude []string) map[string]any {
+	filter := []any{
+		map[string]any{"term": map[string]any{"is_active": true}},
+	}
+	must := []any{}
+	if p.Name != "" {
+		must = append(must, map[string]any{
+			"match_phrase_prefix": map[string]any{"name": map[string]any{"query": p.Name}},
+		})
+	}
+	if p.ResidentialCollege != "" {
+		filter = append(filter, map[string]any{
+			"match": map[string]any{"residential_college": map[string]any{"query": p.ResidentialCollege, "operator": "and"}},
+		})
+	}
+	if p.GraduatingYear != 0 {
+		filter = append(filter, map[string]any{"term": map[string]any{"graduating_year": p.GraduatingYear}})
+	}
+	for _, interest := range p.Interests {
+		must = append(must, map[string]any{
+			"multi_match": map[string]any{"query": interest, "fields": interestFields, "operator": "and"},
+		})
+	}
+
+	boolQuery := map[string]any{"filter": filter}
+	if len(must) > 0 {
+		boolQuery["must"] = must
+	}
+	if len(exclude) > 0 {
+		boolQuery["must_not"] = []any{map[string]any{"ids": map[string]any{"values": exclude}}}
+	}
+	return map[string]any{
+		"from":             p.Offset,
+		"size":             p.Limit,
+		"track_total_hits": true,
+		"_source":          publicFields,
+		"query":            map[string]any{"bool": boolQuery},
+	}
+}
+
+// searchDocument is the public part of a users index document
+type searchDocument struct {
+	Email              string `json:"email"`
+	Name               string `json:"name"`
+	ResidentialCollege string `json:"residential_college"`
+	GraduatingYear     int    `json:"graduating_year"`
+	Interest1          string `json:"interest_1"`
+	Interest2          string `json:"interest_2"`
+	Interest3          string `json:"interest_3"`
+	Interest4          string `json:"interest_4"`
+	Interest5          string `json:"interest_5"`
+}
+
+func (d searchDocument) card() UserCard {
+	card := UserCard{
+		Email:              d.Email,
+		Name:               d.Name,
+		ResidentialCollege: d.ResidentialCollege,
+		GraduatingYear:     d.GraduatingYear,
+	}
+	for _, interest := range []string{d.Interest1, d.Interest2, d.Interest3, d.Interest4, d.Interest5} {
+		if interest != "" {
+			card.Interests = append(card.Interests, interest)
+		}
+	}
+	return card
+}
+
+type searchResponse struct {
+	Hits struct {
+		Total struct {
+			Value int `json:"value"`
+		} `json:"total"`
+		Hits []struct {
+			Source searchDocument `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
 func (s *Server) HandleSearch(w http.ResponseWriter, r *http.Request) {
 	printRequestDetails(r)
-	_, err := s.validateOAuthToken(r)
+	emailFromToken, err := s.validateOAuthToken(r)
 	if err != nil {
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
 
-	// search := r.URL.Path[len("/v1/user/search/"):]
-
 	switch r.Method {
 	case http.MethodGet:
-		s.handleElasticSearch(w, r)
+		s.handleSearchUsers(w, r, emailFromToken)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func (s *Server) handleElasticSearch(w http.ResponseWriter, r *http.Request) {
-	// copy json body from reader (which will be in proper opensearch format to send to opensearch)
-	body, err := io.ReadAll(r.Body)
+func (s *Server) handleSearchUsers(w http.ResponseWriter, r *http.Request, email string) {
+	params, err := ParseSearchParams(r.URL.Query())
 	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		http.Error(w, "Error reading request", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer r.Body.Close()
 
-	if !json.Valid(body) {
-		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+	exclude, err := s.hiddenFrom(r.Context(), email)
+	if err != nil {
+		log.Printf("Error querying blocks: %v", err)
+		http.Error(w, "Error performing search", http.StatusInternalServerError)
 		return
 	}
 
-	res, err := s.OpenSearchClient.Search(
-		s.OpenSearchClient.Search.WithContext(context.Background()),
-		s.OpenSearchClient.Search.WithIndex("users"),
-		s.OpenSearchClient.Search.WithBody(io.NopCloser(io.Reader(bytes.NewBuffer(body)))),
-	)
-	if err != nil {
+	var response searchResponse
+	if err := s.searchUsers(r.Context(), params.Query(exclude), &response); err != nil {
 		log.Printf("Error searching OpenSearch: %v", err)
 		http.Error(w, "Error performing search", http.StatusInternalServerError)
 		return
 	}
-	defer res.Body.Close()
 
-	responseBody, err := io.ReadAll(res.Body)
-	if err != nil {
-		log.Printf("Error reading response body: %v", err)
-		http.Error(w, "Error reading search results", http.StatusInternalServerError)
-		return
+	results := SearchResults{Results: []UserCard{}, Total: response.Hits.Total.Value}
+	for _, hit := range response.Hits.Hits {
+		results.Results = append(results.Results, hit.Source.card())
 	}
-
-	if res.StatusCode > 299 {
-		log.Printf("OpenSearch error: %s", string(responseBody))
-		http.Error(w, "Error from search service", http.StatusInternalServerError)
+	if err := s.addThumbnails(r.Context(), email, results.Results); err != nil {
+		log.Printf("Error signing thumbnails: %v", err)
+		http.Error(w, "Error performing search", http.StatusInternalServerError)
 		return
 	}
+	if next := params.Offset + len(response.Hits.Hits); len(response.Hits.Hits) == params.Limit && next < results.Total && next+params.Limit <= maxSearchWindow {
+		results.NextOffset = next
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	_, err = w.Write(responseBody)
+	jsonResponse, err := json.Marshal(results)
 	if err != nil {
-		log.Printf("Error writing response: %v", err)
+		http.Error(w, "Failed to marshal JSON response", http.StatusInternalServerError)
+		log.Printf("Failed to marshal JSON response: %v", err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(jsonResponse); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// addThumbnails sets the ThumbnailURL of each card with a primary photo that
+// viewer may see
+func (s *Server) addThumbnails(ctx context.Context, viewer string, cards []UserCard) error {
+	if len(cards) == 0 {
+		return nil
+	}
+	emails := make([]string, len(cards))
+	for i, card := range cards {
+		emails[i] = card.Email
+	}
+	thumbnails, err := s.primaryThumbnails(ctx, viewer, emails)
+	if err != nil {
+		return err
+	}
+	for i := range cards {
+		cards[i].ThumbnailURL = thumbnails[cards[i].Email]
+	}
+	return nil
+}
+
+// hiddenFrom lists the users email never sees in search: themself and anyone
+// blocked either way
+func (s *Server) hiddenFrom(ctx context.Context, email string) ([]string, error) {
+	blocked, err := s.blockedWith(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	hidden := []string{email}
+	for other := range blocked {
+		hidden = append(hidden, other)
+	}
+	return hidden, nil
+}
+
+// searchUsers runs query against the users index and decodes the response
+// into result
+func (s *Server) searchUsers(ctx context.Context, query map[string]any, result any) error {
+	body, err := json.Marshal(query)
+	if err != nil {
+		return err
+	}
+	res, err := s.OpenSearchClient.Search(
+		s.OpenSearchClient.Search.WithContext(ctx),
+		s.OpenSearchClient.Search.WithIndex(searchindex.Alias),
+		s.OpenSearchClient.Search.WithBody(bytes.NewReader(body)),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode > 299 {
+		responseBody, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("opensearch returned %d: %s", res.StatusCode, responseBody)
+	}
+	return json.NewDecoder(res.Body).Decode(result)
 }
@@ -0,0 +1,139 @@
+/***************************************************************************
+ * File Name: user-service/server/suggest.go
+ * Author: Bryan SebaRaj
+ * Description: Typeahead on names, for picking a crush
+ * Date Created: 01-01-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSuggestLimit = 8
+	maxSuggestLimit     = 20
+	// requests per second per user, and burst; overridden by SUGGEST_RATE
+	// and SUGGEST_BURST
+	defaultSuggestRate  = 5
+	defaultSuggestBurst = 10
+)
+
+var suggestFields = []string{"email", "name", "residential_college", "graduating_year"}
+
+// SuggestQuery builds the typeahead request body: every word of q must prefix
+// a word of an active user's name (see name.suggest in searchindex.Mapping),
+// closest names first. users in exclude are never returned.
+func SuggestQuery(q string, limit int, exclude []string) map[string]any {
+	boolQuery := map[string]any{
+		"filter": []any{map[string]any{"term": map[string]any{"is_active": true}}},
+		"must": []any{map[string]any{
+			"match": map[string]any{"name.suggest": map[string]any{"query": q, "operator": "and"}},
+		}},
+		// exact word matches rank above prefixes
+		"should": []any{map[string]any{"match": map[string]any{"name": q}}},
+	}
+	if len(exclude) > 0 {
+		boolQuery["must_not"] = []any{map[string]any{"ids": map[string]any{"values": exclude}}}
+	}
+	return map[string]any{
+		"size":    limit,
+		"_source": suggestFields,
+		"query":   map[string]any{"bool": boolQuery},
+		"sort":    []any{"_score", map[string]any{"name.keyword": "asc"}},
+	}
+}
+
+// HandleSuggest returns up to limit (default 8) user cards whose name starts
+// with ?q=, for the crush picker. requests are rate limited per user.
+func (s *Server) HandleSuggest(w http.ResponseWriter, r *http.Request) {
+	emailFromToken, err := s.validateOAuthToken(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ok, wait := s.SuggestLimiter.Allow(emailFromToken); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" || len(q) > maxNameQuery {
+		http.Error(w, fmt.Sprintf("q: expected 1 to %d characters", maxNameQuery), http.StatusBadRequest)
+		return
+	}
+	limit := defaultSuggestLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxSuggestLimit {
+			http.Error(w, fmt.Sprintf("limit: expected 1 to %d", maxSuggestLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	exclude, err := s.hiddenFrom(r.Context(), emailFromToken)
+	if err != nil {
+		log.Printf("Error querying blocks: %v", err)
+		http.Error(w, "Error performing search", http.StatusInternalServerError)
+		return
+	}
+	var response searchResponse
+	if err := s.searchUsers(r.Context(), SuggestQuery(q, limit, exclude), &response); err != nil {
+		log.Printf("Error searching OpenSearch: %v", err)
+		http.Error(w, "Error performing search", http.StatusInternalServerError)
+		return
+	}
+
+	cards := []UserCard{}
+	for _, hit := range response.Hits.Hits {
+		card := hit.Source.card()
+		card.Interests = nil
+		cards = append(cards, card)
+	}
+	if err := s.addThumbnails(r.Context(), emailFromToken, cards); err != nil {
+		log.Printf("Error signing thumbnails: %v", err)
+		http.Error(w, "Error performing search", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse, err := json.Marshal(cards)
+	if err != nil {
+		http.Error(w, "Failed to marshal JSON response", http.StatusInternalServerError)
+		log.Printf("Failed to marshal JSON response: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(jsonResponse); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// suggestLimiterFromEnv reads SUGGEST_RATE and SUGGEST_BURST
+func suggestLimiterFromEnv() *RateLimiter {
+	rate, err := strconv.ParseFloat(GetEnv("SUGGEST_RATE", ""), 64)
+	if err != nil || rate <= 0 {
+		rate = defaultSuggestRate
+	}
+	burst, err := strconv.Atoi(GetEnv("SUGGEST_BURST", ""))
+	if err != nil || burst < 1 {
+		burst = defaultSuggestBurst
+	}
+	return NewRateLimiter(rate, burst)
+}
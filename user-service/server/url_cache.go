@@ -0,0 +1,84 @@
+/***************************************************************************
+ * File Name: user-service/server/url_cache.go
+ * Author: Bryan SebaRaj
+ * Description: In-memory cache of presigned S3 GET URLs
+ * Date Created: 01-01-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// SignedURLCache hands out a presigned URL per object key, signing a new one
+// only once the cached URL has less than MinRemaining left, so a URL is
+// always good for at least MinRemaining after it is returned. like
+// RateLimiter, the cache is per replica.
+type SignedURLCache struct {
+	Expiry       time.Duration
+	MinRemaining time.Duration
+	// Sign presigns a GET of key valid for expiry
+	Sign func(key string, expiry time.Duration) (string, error)
+
+	mu        sync.Mutex
+	urls      map[string]signedURL
+	lastSweep time.Time
+}
+
+type signedURL struct {
+	url       string
+	expiresAt time.Time
+}
+
+func NewSignedURLCache(expiry, minRemaining time.Duration, sign func(string, time.Duration) (string, error)) *SignedURLCache {
+	return &SignedURLCache{Expiry: expiry, MinRemaining: minRemaining, Sign: sign, urls: map[string]signedURL{}}
+}
+
+// Get returns a URL for key valid for at least MinRemaining
+func (c *SignedURLCache) Get(key string) (string, error) {
+	now := time.Now()
+	c.mu.Lock()
+	c.sweep(now)
+	cached, ok := c.urls[key]
+	c.mu.Unlock()
+	if ok && cached.expiresAt.Sub(now) >= c.MinRemaining {
+		return cached.url, nil
+	}
+
+	// signing is local, so concurrent misses on a key just sign twice
+	url, err := c.Sign(key, c.Expiry)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.urls[key] = signedURL{url: url, expiresAt: now.Add(c.Expiry)}
+	c.mu.Unlock()
+	return url, nil
+}
+
+// Forget drops key's URL, for objects that were deleted
+func (c *SignedURLCache) Forget(key string) {
+	c.mu.Lock()
+	delete(c.urls, key)
+	c.mu.Unlock()
+}
+
+// sweep drops URLs too close to expiring to be returned again
+func (c *SignedURLCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	c.lastSweep = now
+	for key, cached := range c.urls {
+		if cached.expiresAt.Sub(now) < c.MinRemaining {
+			delete(c.urls, key)
+		}
+	}
+}
@@ -13,12 +13,16 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	// "io"
 	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
+	"time"
 	// "github.com/lib/pq"
 )
 
@@ -34,9 +38,9 @@ type User struct {
 	Instagram          string   `json:"instagram"`
 	Snapchat           string   `json:"snapchat"`
 	PhoneNumber        string   `json:"phone_number"`
-	PictureS3URL       string   `json:"picture_s3_url"`
 	Interests          []string `json:"interests"`
 	Answers            []int    `json:"answers"`
+	Photos             []Photo  `json:"photos"`
 }
 
 const (
@@ -61,7 +65,8 @@ func (s *Server) HandleUser(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		s.handleGetUser(w, r, email)
-	case http.MethodPut:
+	// PUT is kept for older clients and means the same as PATCH
+	case http.MethodPatch, http.MethodPut:
 		s.handleUpdateUser(w, r, email)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -71,19 +76,43 @@ func (s *Server) HandleUser(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request, email string) {
 	log.Printf("GET request for user: %s", email)
 
-	tx, err := s.DB.Begin()
+	result, err := s.loadUser(r.Context(), email)
+	if errors.Is(err, errUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to start database transaction", http.StatusInternalServerError)
-		log.Printf("Failed to start database transaction: %v", err)
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to load user: %v", err)
+		return
+	}
+
+	jsonResponse, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "Failed to marshal JSON response", http.StatusInternalServerError)
+		log.Printf("Failed to marshal JSON response: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonResponse)
+	if err != nil {
+		http.Error(w, "Failed to write response", http.StatusInternalServerError)
+		log.Printf("Failed to write response: %v", err)
 		return
 	}
+}
+
+// loadUser reads email's profile, answers and signed photos, or
+// errUserNotFound
+func (s *Server) loadUser(ctx context.Context, email string) (User, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, fmt.Errorf("start transaction: %w", err)
+	}
 	// no-op in psql if tx.Commit is called first
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-			log.Printf("Transaction rolled back: %v", err)
-		}
-	}()
+	defer tx.Rollback()
 
 	var result User
 	var name sql.NullString
@@ -94,7 +123,6 @@ func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request, email str
 	var instagram sql.NullString
 	var snapchat sql.NullString
 	var phoneNumber sql.NullString
-	var pictureS3URL sql.NullString
 	var interests [NumInterests]sql.NullString
 	var answers [NumQuestions]sql.NullInt64
 
@@ -111,7 +139,6 @@ func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request, email str
 			u.instagram, 
 			u.snapchat, 
 			u.phone_number, 
-			u.picture_s3_url, 
 			u.interest_1, 
 			u.interest_2, 
 			u.interest_3, 
@@ -133,7 +160,7 @@ func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request, email str
 		LEFT JOIN answers a ON u.email = a.email
 		WHERE u.email = $1
 	`
-	row := tx.QueryRow(query, email)
+	row := tx.QueryRowContext(ctx, query, email)
 
 	err = row.Scan(
 		&result.Email,
@@ -147,7 +174,6 @@ func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request, email str
 		&instagram,
 		&snapchat,
 		&phoneNumber,
-		&pictureS3URL,
 		&interests[0],
 		&interests[1],
 		&interests[2],
@@ -166,14 +192,11 @@ func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request, email str
 		&answers[10],
 		&answers[11],
 	)
+	if err == sql.ErrNoRows {
+		return User{}, errUserNotFound
+	}
 	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "User not found", http.StatusNotFound)
-			return
-		}
-		http.Error(w, "Failed to query database", http.StatusInternalServerError)
-		log.Printf("Failed to query database: %v", err)
-		return
+		return User{}, fmt.Errorf("query user: %w", err)
 	}
 
 	result.ResidentialCollege = getStringValue(residentialCollege)
@@ -184,104 +207,120 @@ func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request, email str
 	result.Instagram = getStringValue(instagram)
 	result.Snapchat = getStringValue(snapchat)
 	result.PhoneNumber = getStringValue(phoneNumber)
-	result.PictureS3URL = getStringValue(pictureS3URL)
 	result.Interests = filterNullStrings(interests[:])
 	result.Answers = filterNullInts(answers[:])
 
-	err = tx.Commit()
+	result.Photos, err = loadPhotos(ctx, tx, email)
 	if err != nil {
-		http.Error(w, "Failed to commit database transaction", http.StatusInternalServerError)
-		log.Printf("Failed to commit database transaction: %v", err)
-		return
+		return User{}, fmt.Errorf("query photos: %w", err)
 	}
-
-	jsonResponse, err := json.Marshal(result)
-	if err != nil {
-		http.Error(w, "Failed to marshal JSON response", http.StatusInternalServerError)
-		log.Printf("Failed to marshal JSON response: %v", err)
-		return
+	if err = s.signPhotos(result.Photos); err != nil {
+		return User{}, fmt.Errorf("sign photo URLs: %w", err)
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write(jsonResponse)
-	if err != nil {
-		http.Error(w, "Failed to write response", http.StatusInternalServerError)
-		log.Printf("Failed to write response: %v", err)
-		return
+	if err = tx.Commit(); err != nil {
+		return User{}, fmt.Errorf("commit transaction: %w", err)
 	}
+	return result, nil
 }
 
+// handleUpdateUser applies a PATCH of the user's profile (see
+// ParseUserUpdate) and responds with the updated user. errors use the
+// APIError envelope.
 func (s *Server) handleUpdateUser(w http.ResponseWriter, r *http.Request, email string) {
-	log.Printf("PUT request to update user: %s", email)
+	log.Printf("%s request to update user: %s", r.Method, email)
 
-	var updates map[string]interface{}
-	err := json.NewDecoder(r.Body).Decode(&updates)
-	if err != nil {
-		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: codeInvalidJSON, Message: "Body must be a JSON object"})
 		log.Printf("Failed to decode request body: %v", err)
 		return
 	}
+	update, fieldErrors := ParseUserUpdate(body, time.Now())
+	if len(fieldErrors) == 0 && len(update) == 0 {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: codeValidationFailed, Message: "No fields to update"})
+		return
+	}
 
-	tx, err := s.DB.Begin()
+	tx, err := s.DB.BeginTx(r.Context(), nil)
 	if err != nil {
-		http.Error(w, "Failed to start database transaction", http.StatusInternalServerError)
+		writeAPIError(w, http.StatusInternalServerError, APIError{Code: codeInternal, Message: "Failed to start database transaction"})
 		log.Printf("Failed to start database transaction: %v", err)
 		return
 	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-			log.Printf("Transaction rolled back: %v", err)
-		}
-	}()
-
-	updateFields := []string{}
-	updateValues := []interface{}{}
-	i := 1
-
-	for field, value := range updates {
-		if field == "email" || field == "is_active" || field == "picture_s3_url" {
-			continue
-		}
+	// no-op in psql if tx.Commit is called first
+	defer tx.Rollback()
 
-		// prevent SQL injection... more rigorous way?
-		switch field {
-		case "name", "residential_college", "graduating_year", "gender",
-			"partner_genders", "instagram", "snapchat", "phone_number",
-			"interest_1", "interest_2", "interest_3", "interest_4", "interest_5", "notif_pref":
-			updateFields = append(updateFields, field+" = $"+fmt.Sprint(i))
-			updateValues = append(updateValues, value)
-			i++
-		default:
-			http.Error(w, "Invalid field in request body: "+field, http.StatusBadRequest)
-			log.Printf("Invalid field in request body: %s", field)
+	if college, ok := update["residential_college"].(string); ok {
+		var exists bool
+		err = tx.QueryRowContext(r.Context(), "SELECT EXISTS (SELECT 1 FROM res_colleges WHERE name = $1)", college).Scan(&exists)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, APIError{Code: codeInternal, Message: "Failed to query database"})
+			log.Printf("Failed to query residential colleges: %v", err)
 			return
 		}
+		if !exists {
+			fieldErrors["residential_college"] = "must be a residential college"
+		}
 	}
-
-	if len(updateFields) == 0 {
-		http.Error(w, "No valid fields to update", http.StatusBadRequest)
+	if len(fieldErrors) > 0 {
+		writeAPIError(w, http.StatusUnprocessableEntity, APIError{
+			Code:    codeValidationFailed,
+			Message: "Some fields are invalid",
+			Fields:  fieldErrors,
+		})
 		return
 	}
 
+	// sorted so the same update always builds the same statement
+	columns := make([]string, 0, len(update))
+	for column := range update {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	updateFields := make([]string, len(columns))
+	updateValues := make([]any, len(columns), len(columns)+1)
+	for i, column := range columns {
+		updateFields[i] = column + " = $" + fmt.Sprint(i+1)
+		updateValues[i] = update[column]
+	}
 	updateValues = append(updateValues, email)
-	query := "UPDATE users SET " + joinFields(updateFields, ", ") + " WHERE email = $" + fmt.Sprint(i)
+	query := "UPDATE users SET " + joinFields(updateFields, ",") + " WHERE email = $" + fmt.Sprint(len(updateValues))
 
-	_, err = tx.Exec(query, updateValues...)
+	result, err := tx.ExecContext(r.Context(), query, updateValues...)
 	if err != nil {
-		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		writeAPIError(w, http.StatusInternalServerError, APIError{Code: codeInternal, Message: "Failed to update user"})
 		log.Printf("Failed to execute update query: %v", err)
 		return
 	}
-
-	err = tx.Commit()
-	if err != nil {
-		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: codeNotFound, Message: "User not found"})
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, APIError{Code: codeInternal, Message: "Failed to commit transaction"})
 		log.Printf("Failed to commit transaction: %v", err)
 		return
 	}
-
-	w.WriteHeader(http.StatusOK)
 	log.Printf("User updated successfully: %s", email)
+
+	user, err := s.loadUser(r.Context(), email)
+	if errors.Is(err, errUserNotFound) {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: codeNotFound, Message: "User not found"})
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, APIError{Code: codeInternal, Message: "Failed to read updated user"})
+		log.Printf("Failed to load updated user: %v", err)
+		return
+	}
+	jsonResponse, err := json.Marshal(user)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, APIError{Code: codeInternal, Message: "Failed to marshal JSON response"})
+		log.Printf("Failed to marshal JSON response: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(jsonResponse); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
 }
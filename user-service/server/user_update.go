@@ -0,0 +1,197 @@
+/***************************************************************************
+ * File Name: user-service/server/user_update.go
+ * Author: Bryan SebaRaj
+ * Description: Typed, validated PATCH of a user's profile
+ * Date Created: 01-01-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxNameLength     = 50
+	maxCollegeLength  = 30
+	maxInterestLength = 20
+	// graduating_year may be this year or up to maxYearsToGraduate after it
+	maxYearsToGraduate = 5
+	// gender and partner_genders set bits of the five genders described in
+	// rds_schema.sql
+	allGenders = 1<<5 - 1
+)
+
+var (
+	instagramHandle = regexp.MustCompile(`^[A-Za-z0-9._]{1,30}$`)
+	snapchatHandle  = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9._-]{2,14}$`)
+	// E.164, up to the 15 characters phone_number holds
+	e164Number      = regexp.MustCompile(`^\+[1-9][0-9]{6,13}$`)
+	phoneFormatting = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "", ".", "")
+)
+
+// UserUpdate is a validated PATCH of a user's profile: the users columns to
+// set, where nil clears a column
+type UserUpdate map[string]any
+
+// ParseUserUpdate validates a PATCH body. fields left out stay unchanged,
+// null clears the optional ones, and every invalid field is reported.
+// interests sets interest_1 to interest_5 at once, as GET returns them.
+// residential_college is only checked against res_colleges by the handler.
+func ParseUserUpdate(body map[string]json.RawMessage, now time.Time) (UserUpdate, FieldErrors) {
+	update := UserUpdate{}
+	errs := FieldErrors{}
+	for field, raw := range body {
+		null := bytes.Equal(bytes.TrimSpace(raw), []byte("null"))
+		var value any
+		var problem string
+		switch field {
+		case "email", "is_active":
+			problem = "can't be changed"
+		case "name":
+			value, problem = parseText(raw, null, maxNameLength, true)
+		case "residential_college":
+			value, problem = parseText(raw, null, maxCollegeLength, false)
+		case "interest_1", "interest_2", "interest_3", "interest_4", "interest_5":
+			value, problem = parseText(raw, null, maxInterestLength, false)
+		case "interests":
+			interests, problem := parseInterests(raw, null)
+			if problem != "" {
+				errs[field] = problem
+				continue
+			}
+			for i, interest := range interests {
+				update[fmt.Sprintf("interest_%d", i+1)] = interest
+			}
+			continue
+		case "notif_pref":
+			var pref bool
+			if null || json.Unmarshal(raw, &pref) != nil {
+				problem = "must be true or false"
+			}
+			value = pref
+		case "graduating_year":
+			value, problem = parseInt(raw, null, now.Year(), now.Year()+maxYearsToGraduate)
+		case "gender", "partner_genders":
+			value, problem = parseInt(raw, null, 1, allGenders)
+		case "instagram":
+			value, problem = parseHandle(raw, null, "must be an Instagram username", func(handle string) (string, bool) {
+				handle = strings.TrimPrefix(handle, "@")
+				return handle, instagramHandle.MatchString(handle)
+			})
+		case "snapchat":
+			value, problem = parseHandle(raw, null, "must be a Snapchat username", func(handle string) (string, bool) {
+				return handle, snapchatHandle.MatchString(handle)
+			})
+		case "phone_number":
+			value, problem = parseHandle(raw, null, "must be an E.164 number, like +12035550123", func(number string) (string, bool) {
+				number = phoneFormatting.Replace(number)
+				return number, e164Number.MatchString(number)
+			})
+		default:
+			problem = "unknown field"
+		}
+		if problem != "" {
+			errs[field] = problem
+			continue
+		}
+		update[field] = value
+	}
+	if _, ok := body["interests"]; ok {
+		for i := 1; i <= NumInterests; i++ {
+			if _, ok := body[fmt.Sprintf("interest_%d", i)]; ok {
+				errs["interests"] = "can't be combined with interest_1 to interest_5"
+				break
+			}
+		}
+	}
+	return update, errs
+}
+
+// parseInterests reads an array of at most NumInterests interests into the
+// interest columns in order, leaving the rest null. blank interests are
+// dropped, and null clears them all.
+func parseInterests(raw json.RawMessage, null bool) ([NumInterests]any, string) {
+	var interests [NumInterests]any
+	if null {
+		return interests, ""
+	}
+	var items []json.RawMessage
+	if json.Unmarshal(raw, &items) != nil {
+		return interests, "must be an array of strings"
+	}
+	if len(items) > NumInterests {
+		return interests, fmt.Sprintf("must have at most %d interests", NumInterests)
+	}
+	n := 0
+	for i, item := range items {
+		interest, problem := parseText(item, false, maxInterestLength, false)
+		if problem != "" {
+			return interests, fmt.Sprintf("interest %d %s", i+1, problem)
+		}
+		if interest != nil {
+			interests[n] = interest
+			n++
+		}
+	}
+	return interests, ""
+}
+
+// parseText reads a string of at most max characters. blank strings count as
+// null, which only optional fields accept.
+func parseText(raw json.RawMessage, null bool, max int, required bool) (any, string) {
+	var text string
+	if !null && json.Unmarshal(raw, &text) != nil {
+		return nil, "must be a string"
+	}
+	text = strings.TrimSpace(text)
+	switch {
+	case text == "" && required:
+		return nil, "is required"
+	case text == "":
+		return nil, ""
+	case utf8.RuneCountInString(text) > max:
+		return nil, fmt.Sprintf("must be at most %d characters", max)
+	}
+	return text, ""
+}
+
+// parseInt reads an integer from min to max, or null
+func parseInt(raw json.RawMessage, null bool, min, max int) (any, string) {
+	if null {
+		return nil, ""
+	}
+	var n int
+	if json.Unmarshal(raw, &n) != nil || n < min || n > max {
+		return nil, fmt.Sprintf("must be an integer from %d to %d", min, max)
+	}
+	return n, ""
+}
+
+// parseHandle reads a contact handle, normalized and checked by valid, or
+// null or blank to remove it. expected is the problem reported otherwise.
+func parseHandle(raw json.RawMessage, null bool, expected string, valid func(string) (string, bool)) (any, string) {
+	var handle string
+	if !null && json.Unmarshal(raw, &handle) != nil {
+		return nil, "must be a string"
+	}
+	if handle = strings.TrimSpace(handle); handle == "" {
+		return nil, ""
+	}
+	handle, ok := valid(handle)
+	if !ok {
+		return nil, expected
+	}
+	return handle, ""
+}
@@ -0,0 +1,191 @@
+/***************************************************************************
+ * File Name: user-service/test/blocks_test.go
+ * Author: Bryan SebaRaj
+ * Description: Unit tests for blocking and reporting users
+ * Date Created: 01-01-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/opensearch-project/opensearch-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// authorize makes ts accept any token as the email it names
+func authorize(ts *testServer) {
+	ts.server.VerifyToken = func(ctx context.Context, token string) (string, error) {
+		return token, nil
+	}
+}
+
+// do sends a request as user to handler
+func do(handler http.HandlerFunc, method, target, user, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", user)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func TestBlock(t *testing.T) {
+	ts := setupTestServer(t)
+	defer ts.db.Close()
+	authorize(ts)
+
+	t.Run("block writes the pair", func(t *testing.T) {
+		ts.dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO blocks (blocker_email, blocked_email)")).
+			WithArgs("me@yale.edu", "other@yale.edu").WillReturnResult(sqlmock.NewResult(0, 1))
+
+		w := do(ts.server.HandleBlocks, "POST", "/v1/user/blocks/other@yale.edu", "me@yale.edu", "")
+		assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("block of an unknown user", func(t *testing.T) {
+		ts.dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO blocks")).WillReturnError(&pq.Error{Code: "23503"})
+
+		w := do(ts.server.HandleBlocks, "POST", "/v1/user/blocks/nobody@yale.edu", "me@yale.edu", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("unblock deletes the pair", func(t *testing.T) {
+		ts.dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM blocks WHERE blocker_email = $1 AND blocked_email = $2")).
+			WithArgs("me@yale.edu", "other@yale.edu").WillReturnResult(sqlmock.NewResult(0, 1))
+
+		w := do(ts.server.HandleBlocks, "DELETE", "/v1/user/blocks/other@yale.edu", "me@yale.edu", "")
+		assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("unblock of someone not blocked", func(t *testing.T) {
+		ts.dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM blocks")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		w := do(ts.server.HandleBlocks, "DELETE", "/v1/user/blocks/other@yale.edu", "me@yale.edu", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("block yourself", func(t *testing.T) {
+		w := do(ts.server.HandleBlocks, "POST", "/v1/user/blocks/me@yale.edu", "me@yale.edu", "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+}
+
+func TestReport(t *testing.T) {
+	ts := setupTestServer(t)
+	defer ts.db.Close()
+	authorize(ts)
+
+	t.Run("report with block also blocks", func(t *testing.T) {
+		ts.dbMock.ExpectBegin()
+		ts.dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO reports")).
+			WithArgs("me@yale.edu", "other@yale.edu", "harassment", "sent threats").WillReturnResult(sqlmock.NewResult(1, 1))
+		ts.dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO blocks")).
+			WithArgs("me@yale.edu", "other@yale.edu").WillReturnResult(sqlmock.NewResult(0, 1))
+		ts.dbMock.ExpectCommit()
+
+		w := do(ts.server.HandleReports, "POST", "/v1/user/reports", "me@yale.edu",
+			`{"reported_email": "other@yale.edu", "reason": "harassment", "details": "sent threats", "block": true}`)
+		assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("report without block", func(t *testing.T) {
+		ts.dbMock.ExpectBegin()
+		ts.dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO reports")).
+			WithArgs("me@yale.edu", "other@yale.edu", "spam", nil).WillReturnResult(sqlmock.NewResult(1, 1))
+		ts.dbMock.ExpectCommit()
+
+		w := do(ts.server.HandleReports, "POST", "/v1/user/reports", "me@yale.edu",
+			`{"reported_email": "other@yale.edu", "reason": "spam"}`)
+		assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("failed block rolls back the report", func(t *testing.T) {
+		ts.dbMock.ExpectBegin()
+		ts.dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO reports")).WillReturnResult(sqlmock.NewResult(1, 1))
+		ts.dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO blocks")).WillReturnError(&pq.Error{Code: "23503"})
+		ts.dbMock.ExpectRollback()
+
+		w := do(ts.server.HandleReports, "POST", "/v1/user/reports", "me@yale.edu",
+			`{"reported_email": "nobody@yale.edu", "reason": "spam", "block": true}`)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("invalid reports", func(t *testing.T) {
+		for _, body := range []string{
+			`{"reported_email": "other@yale.edu", "reason": "rude"}`,
+			`{"reported_email": "me@yale.edu", "reason": "spam"}`,
+			`{"reason": "spam"}`,
+			`{"reported_email": "other@yale.edu", "reason": "other", "details": "` + strings.Repeat("x", 1001) + `"}`,
+		} {
+			w := do(ts.server.HandleReports, "POST", "/v1/user/reports", "me@yale.edu", body)
+			assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		}
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+}
+
+func TestBlockedUsersAreHiddenFromSearch(t *testing.T) {
+	requests := map[string]string{
+		"search":  "/v1/user/search/?name=Bry",
+		"suggest": "/v1/user/suggest?q=Bry",
+	}
+	for name, target := range requests {
+		t.Run(name, func(t *testing.T) {
+			ts := setupTestServer(t)
+			defer ts.db.Close()
+			authorize(ts)
+
+			var query map[string]any
+			cluster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				json.Unmarshal(body, &query)
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"hits": {"total": {"value": 0}, "hits": []}}`))
+			}))
+			defer cluster.Close()
+			client, err := opensearch.NewClient(opensearch.Config{Addresses: []string{cluster.URL}})
+			assert.NoError(t, err)
+			ts.server.OpenSearchClient = client
+
+			// blocks either way
+			ts.dbMock.ExpectQuery(regexp.QuoteMeta("SELECT blocked_email FROM blocks WHERE blocker_email = $1")).
+				WithArgs("me@yale.edu").
+				WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("blocked@yale.edu").AddRow("blocker@yale.edu"))
+
+			handler := ts.server.HandleSearch
+			if name == "suggest" {
+				handler = ts.server.HandleSuggest
+			}
+			w := do(handler, "GET", target, "me@yale.edu", "")
+			assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			mustNot := query["query"].(map[string]any)["bool"].(map[string]any)["must_not"]
+			ids := mustNot.([]any)[0].(map[string]any)["ids"].(map[string]any)["values"]
+			assert.ElementsMatch(t, []any{"me@yale.edu", "blocked@yale.edu", "blocker@yale.edu"}, ids)
+			assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+		})
+	}
+}
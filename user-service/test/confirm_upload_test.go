@@ -0,0 +1,221 @@
+/***************************************************************************
+ * File Name: user-service/test/confirm_upload_test.go
+ * Author: Bryan SebaRaj
+ * Description: Unit tests for confirming picture uploads
+ * Date Created: 01-01-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sebaraj/crush/user-service/pictures"
+	"github.com/sebaraj/crush/user-service/server"
+)
+
+const uploadID = "0123456789abcdef0123456789abcdef"
+
+// fakeS3 holds a single upload and records what the service writes and
+// deletes in test-bucket
+type fakeS3 struct {
+	mu          sync.Mutex
+	upload      []byte
+	contentType string
+	// Cache-Control of each object put, by key
+	puts    map[string]string
+	deletes []string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/test-bucket/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		if key != "uploads/me@yale.edu/"+uploadID {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		w.Header().Set("Content-Type", f.contentType)
+		w.Write(f.upload)
+	case http.MethodPut:
+		io.Copy(io.Discard, r.Body)
+		f.puts[key] = r.Header.Get("Cache-Control")
+	case http.MethodDelete:
+		f.deletes = append(f.deletes, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// useFakeS3 points ts at a fake bucket holding upload as contentType
+func useFakeS3(t *testing.T, ts *testServer, upload []byte, contentType string) *fakeS3 {
+	bucket := &fakeS3{upload: upload, contentType: contentType, puts: map[string]string{}}
+	endpoint := httptest.NewServer(bucket)
+	t.Cleanup(endpoint.Close)
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(endpoint.URL),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	assert.NoError(t, err)
+	ts.server.S3Client = s3.New(sess)
+	return bucket
+}
+
+type moderator struct {
+	verdict pictures.Verdict
+	err     error
+}
+
+func (m moderator) Moderate(context.Context, string, []byte) (pictures.Verdict, error) {
+	return m.verdict, m.err
+}
+
+// expectConfirmed answers whether the upload is already a photo
+func expectConfirmed(mock sqlmock.Sqlmock, confirmed bool) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS (SELECT 1 FROM user_photos WHERE id = $1)")).WithArgs(uploadID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(confirmed))
+}
+
+func TestConfirmUpload(t *testing.T) {
+	upload := "uploads/me@yale.edu/" + uploadID
+	full := "user-images/me@yale.edu/" + uploadID + ".jpg"
+	thumbnail := "user-images/me@yale.edu/" + uploadID + "_thumb.jpg"
+
+	t.Run("stores an oriented, private picture", func(t *testing.T) {
+		ts := setupTestServer(t)
+		defer ts.db.Close()
+		authorize(ts)
+		bucket := useFakeS3(t, ts, withOrientation(encodeJPEG(t, halves(1600, 1200)), 6), "image/jpeg")
+
+		ts.dbMock.ExpectBegin()
+		ts.dbMock.ExpectQuery(regexp.QuoteMeta("SELECT email FROM users WHERE email = $1 FOR UPDATE")).
+			WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("me@yale.edu"))
+		expectConfirmed(ts.dbMock, false)
+		ts.dbMock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM user_photos")).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		ts.dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_photos")).
+			WithArgs(uploadID, "me@yale.edu", full, thumbnail, 0, 810, 1080).WillReturnResult(sqlmock.NewResult(1, 1))
+		ts.dbMock.ExpectCommit()
+
+		w := do(ts.server.HandlePicture, "POST", "/v1/user/picture/me@yale.edu/"+uploadID, "me@yale.edu", "")
+		assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var photo server.Photo
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &photo))
+		assert.Equal(t, 810, photo.Width)
+		assert.Equal(t, 1080, photo.Height)
+		assert.True(t, photo.Primary)
+
+		// only browsers may cache photos, for as long as a signed URL lasts
+		assert.Equal(t, map[string]string{full: "private, max-age=600", thumbnail: "private, max-age=600"}, bucket.puts)
+		assert.Equal(t, []string{upload}, bucket.deletes)
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+
+	rejected := map[string]struct {
+		upload      func(t *testing.T) []byte
+		contentType string
+		moderator   pictures.Moderator
+		status      int
+		// the upload is deleted unless confirming again could succeed
+		deleted bool
+	}{
+		"too many pixels": {
+			func(t *testing.T) []byte { return encodePNG(t, image.NewGray(image.Rect(0, 0, 5000, 5000))) },
+			"image/png", nil, http.StatusUnprocessableEntity, true,
+		},
+		"uploaded as another type": {
+			func(t *testing.T) []byte { return encodeJPEG(t, halves(400, 300)) },
+			"image/png", nil, http.StatusUnprocessableEntity, true,
+		},
+		"unsupported type": {
+			func(t *testing.T) []byte { return encodeJPEG(t, halves(400, 300)) },
+			"image/gif", nil, http.StatusUnprocessableEntity, true,
+		},
+		"rejected by moderation": {
+			func(t *testing.T) []byte { return encodeJPEG(t, halves(400, 300)) },
+			"image/jpeg", moderator{verdict: pictures.Verdict{Reason: "nudity"}}, http.StatusUnprocessableEntity, true,
+		},
+		"moderation unavailable": {
+			func(t *testing.T) []byte { return encodeJPEG(t, halves(400, 300)) },
+			"image/jpeg", moderator{err: errors.New("timeout")}, http.StatusServiceUnavailable, false,
+		},
+	}
+	for name, c := range rejected {
+		t.Run(name, func(t *testing.T) {
+			ts := setupTestServer(t)
+			defer ts.db.Close()
+			authorize(ts)
+			if c.moderator != nil {
+				ts.server.Moderator = c.moderator
+			}
+			bucket := useFakeS3(t, ts, c.upload(t), c.contentType)
+
+			w := do(ts.server.HandlePicture, "POST", "/v1/user/picture/me@yale.edu/"+uploadID, "me@yale.edu", "")
+			assert.Equal(t, c.status, w.Code, w.Body.String())
+			assert.Empty(t, bucket.puts)
+			if c.deleted {
+				assert.Equal(t, []string{upload}, bucket.deletes)
+			} else {
+				assert.Empty(t, bucket.deletes)
+			}
+			assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+		})
+	}
+
+	t.Run("confirmed concurrently", func(t *testing.T) {
+		ts := setupTestServer(t)
+		defer ts.db.Close()
+		authorize(ts)
+		bucket := useFakeS3(t, ts, encodeJPEG(t, halves(400, 300)), "image/jpeg")
+
+		// both confirms read the upload; the other one added the photo first
+		ts.dbMock.ExpectBegin()
+		ts.dbMock.ExpectQuery(regexp.QuoteMeta("SELECT email FROM users WHERE email = $1 FOR UPDATE")).
+			WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("me@yale.edu"))
+		expectConfirmed(ts.dbMock, true)
+		ts.dbMock.ExpectRollback()
+
+		w := do(ts.server.HandlePicture, "POST", "/v1/user/picture/me@yale.edu/"+uploadID, "me@yale.edu", "")
+		assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+		// the stored picture is the other confirm's photo now, so it stays
+		assert.NotContains(t, bucket.deletes, full)
+		assert.NotContains(t, bucket.deletes, thumbnail)
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("unknown upload", func(t *testing.T) {
+		ts := setupTestServer(t)
+		defer ts.db.Close()
+		authorize(ts)
+		useFakeS3(t, ts, nil, "image/jpeg")
+
+		w := do(ts.server.HandlePicture, "POST", "/v1/user/picture/me@yale.edu/ffffffffffffffffffffffffffffffff", "me@yale.edu", "")
+		assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	})
+}
@@ -0,0 +1,151 @@
+/***************************************************************************
+ * File Name: user-service/test/photo_access_test.go
+ * Author: Bryan SebaRaj
+ * Description: Unit tests for who may view a user's photos
+ * Date Created: 01-01-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/opensearch-project/opensearch-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sebaraj/crush/user-service/server"
+)
+
+// expectPhotos answers loadPhotos with one photo of email
+func expectPhotos(mock sqlmock.Sqlmock, email string) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, s3_key, thumbnail_s3_key, position, width, height")).WithArgs(email).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "s3_key", "thumbnail_s3_key", "position", "width", "height"}).
+			AddRow(uploadID, "user-images/"+email+"/"+uploadID+".jpg", "user-images/"+email+"/"+uploadID+"_thumb.jpg", 0, 1080, 810))
+}
+
+func TestViewPhotos(t *testing.T) {
+	// the only rule: a match the viewer can see, and no block either way
+	access := regexp.QuoteMeta("AND (m.server_generated OR m.user1_email = $1 OR (m.user1_interested AND m.user2_interested))") +
+		`[\s\S]*` + regexp.QuoteMeta("AND NOT EXISTS ( SELECT 1 FROM blocks b")
+
+	t.Run("self needs no match", func(t *testing.T) {
+		ts := setupTestServer(t)
+		defer ts.db.Close()
+		authorize(ts)
+		useFakeS3(t, ts, nil, "")
+		expectPhotos(ts.dbMock, "me@yale.edu")
+
+		w := do(ts.server.HandlePhotos, "GET", "/v1/user/photos/me@yale.edu", "me@yale.edu", "")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("viewer with a visible match", func(t *testing.T) {
+		ts := setupTestServer(t)
+		defer ts.db.Close()
+		authorize(ts)
+		useFakeS3(t, ts, nil, "")
+		ts.dbMock.ExpectQuery(access).WithArgs("viewer@yale.edu", "me@yale.edu").
+			WillReturnRows(sqlmock.NewRows([]string{"allowed"}).AddRow(true))
+		expectPhotos(ts.dbMock, "me@yale.edu")
+
+		w := do(ts.server.HandlePhotos, "GET", "/v1/user/photos/me@yale.edu", "viewer@yale.edu", "")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var photos []server.Photo
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &photos))
+		assert.Len(t, photos, 1)
+		assert.Contains(t, photos[0].URL, uploadID+".jpg")
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("viewer without one", func(t *testing.T) {
+		ts := setupTestServer(t)
+		defer ts.db.Close()
+		authorize(ts)
+		// an active user found in search, but with no match, or a block
+		ts.dbMock.ExpectQuery(access).WithArgs("stranger@yale.edu", "me@yale.edu").
+			WillReturnRows(sqlmock.NewRows([]string{"allowed"}).AddRow(false))
+
+		w := do(ts.server.HandlePhotos, "GET", "/v1/user/photos/me@yale.edu", "stranger@yale.edu", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Equal(t, "User not found\n", w.Body.String())
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("other users can't change photos", func(t *testing.T) {
+		ts := setupTestServer(t)
+		defer ts.db.Close()
+		authorize(ts)
+
+		w := do(ts.server.HandlePhotos, "DELETE", "/v1/user/photos/me@yale.edu/"+uploadID, "viewer@yale.edu", "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+}
+
+func TestSearchThumbnailsFollowPhotoAccess(t *testing.T) {
+	for name, target := range map[string]string{
+		"search":  "/v1/user/search/?name=Bry",
+		"suggest": "/v1/user/suggest?q=Bry",
+	} {
+		t.Run(name, func(t *testing.T) {
+			ts := setupTestServer(t)
+			defer ts.db.Close()
+			authorize(ts)
+			useFakeS3(t, ts, nil, "")
+			cluster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"hits": {"total": {"value": 2}, "hits": [
+					{"_source": {"email": "match@yale.edu", "name": "Bryan"}},
+					{"_source": {"email": "stranger@yale.edu", "name": "Bryce"}}
+				]}}`))
+			}))
+			defer cluster.Close()
+			client, err := opensearch.NewClient(opensearch.Config{Addresses: []string{cluster.URL}})
+			assert.NoError(t, err)
+			ts.server.OpenSearchClient = client
+
+			ts.dbMock.ExpectQuery(regexp.QuoteMeta("SELECT blocked_email FROM blocks")).
+				WillReturnRows(sqlmock.NewRows([]string{"email"}))
+			// the same rule as the photo list; only the match passes it
+			ts.dbMock.ExpectQuery(regexp.QuoteMeta("WHERE p.email = ANY($2) AND p.position = 0 AND (p.email = $1 OR")+
+				`[\s\S]*`+regexp.QuoteMeta("AND (m.server_generated OR m.user1_email = $1 OR (m.user1_interested AND m.user2_interested))")+
+				`[\s\S]*`+regexp.QuoteMeta("AND NOT EXISTS ( SELECT 1 FROM blocks b")).
+				WithArgs("me@yale.edu", sqlmock.AnyArg()).
+				WillReturnRows(sqlmock.NewRows([]string{"email", "thumbnail_s3_key"}).
+					AddRow("match@yale.edu", "user-images/match@yale.edu/"+uploadID+"_thumb.jpg"))
+
+			handler := ts.server.HandleSearch
+			if name == "suggest" {
+				handler = ts.server.HandleSuggest
+			}
+			w := do(handler, "GET", target, "me@yale.edu", "")
+			assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			var cards []server.UserCard
+			if name == "search" {
+				var results server.SearchResults
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &results))
+				cards = results.Results
+			} else {
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &cards))
+			}
+			thumbnails := map[string]string{}
+			for _, card := range cards {
+				thumbnails[card.Email] = card.ThumbnailURL
+			}
+			assert.Contains(t, thumbnails["match@yale.edu"], uploadID+"_thumb.jpg")
+			assert.Empty(t, thumbnails["stranger@yale.edu"])
+			assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,196 @@
+/***************************************************************************
+ * File Name: user-service/test/pictures_test.go
+ * Author: Bryan SebaRaj
+ * Description: Unit tests for picture processing and moderation
+ * Date Created: 01-01-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sebaraj/crush/user-service/pictures"
+)
+
+var (
+	red  = color.RGBA{R: 255, A: 255}
+	blue = color.RGBA{B: 255, A: 255}
+)
+
+// halves is a w x h image, red on the left half and blue on the right
+func halves(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x < w/2 {
+				img.Set(x, y, red)
+			} else {
+				img.Set(x, y, blue)
+			}
+		}
+	}
+	return img
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}))
+	return buf.Bytes()
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+// withOrientation inserts an APP1 segment holding only an EXIF orientation
+// right after the JPEG's SOI marker
+func withOrientation(data []byte, orientation uint16) []byte {
+	tiff := []byte("II*\x00")
+	tiff = binary.LittleEndian.AppendUint32(tiff, 8)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 0x0112)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 3)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	segment = append(segment, payload...)
+	return append(append(append([]byte{}, data[:2]...), segment...), data[2:]...)
+}
+
+func decodeJPEG(t *testing.T, data []byte) image.Image {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	return img
+}
+
+func isRed(c color.Color) bool {
+	r, _, b, _ := c.RGBA()
+	return r > 0xC000 && b < 0x4000
+}
+
+func TestProcessPicture(t *testing.T) {
+	t.Run("resizes to the display size and a square thumbnail", func(t *testing.T) {
+		processed, err := pictures.Process(encodePNG(t, halves(2160, 1080)), "image/png")
+		assert.NoError(t, err)
+		assert.Equal(t, 1080, processed.Width)
+		assert.Equal(t, 540, processed.Height)
+		assert.Equal(t, image.Rect(0, 0, 1080, 540), decodeJPEG(t, processed.Full).Bounds())
+
+		thumbnail := decodeJPEG(t, processed.Thumbnail)
+		assert.Equal(t, image.Rect(0, 0, pictures.ThumbnailSide, pictures.ThumbnailSide), thumbnail.Bounds())
+		// cropped from the center, so still half red and half blue
+		assert.True(t, isRed(thumbnail.At(10, 128)))
+		assert.False(t, isRed(thumbnail.At(245, 128)))
+	})
+
+	t.Run("small pictures keep their size", func(t *testing.T) {
+		processed, err := pictures.Process(encodeJPEG(t, halves(400, 300)), "image/jpeg")
+		assert.NoError(t, err)
+		assert.Equal(t, 400, processed.Width)
+		assert.Equal(t, 300, processed.Height)
+	})
+
+	t.Run("applies and strips the EXIF orientation", func(t *testing.T) {
+		// 6 means the camera was rotated, so the picture displays turned 90 degrees clockwise
+		upload := withOrientation(encodeJPEG(t, halves(400, 300)), 6)
+		processed, err := pictures.Process(upload, "image/jpeg")
+		assert.NoError(t, err)
+		assert.Equal(t, 300, processed.Width)
+		assert.Equal(t, 400, processed.Height)
+
+		full := decodeJPEG(t, processed.Full)
+		assert.True(t, isRed(full.At(150, 10)))
+		assert.False(t, isRed(full.At(150, 390)))
+		assert.NotContains(t, string(processed.Full), "Exif")
+	})
+
+	t.Run("orients large pictures after scaling them down", func(t *testing.T) {
+		upload := withOrientation(encodeJPEG(t, halves(1600, 1200)), 6)
+		processed, err := pictures.Process(upload, "image/jpeg")
+		assert.NoError(t, err)
+		assert.Equal(t, 810, processed.Width)
+		assert.Equal(t, 1080, processed.Height)
+
+		full := decodeJPEG(t, processed.Full)
+		assert.True(t, isRed(full.At(405, 10)))
+		assert.False(t, isRed(full.At(405, 1070)))
+		thumbnail := decodeJPEG(t, processed.Thumbnail)
+		assert.True(t, isRed(thumbnail.At(128, 10)))
+		assert.False(t, isRed(thumbnail.At(128, 245)))
+	})
+
+	t.Run("rejects invalid uploads", func(t *testing.T) {
+		cases := map[string]struct {
+			data        []byte
+			contentType string
+		}{
+			"unsupported type": {encodePNG(t, halves(400, 400)), "image/gif"},
+			"not an image":     {[]byte("GIF89a, or anything else"), "image/png"},
+			"mismatched type":  {encodePNG(t, halves(400, 400)), "image/jpeg"},
+			"too small":        {encodeJPEG(t, halves(400, 100)), "image/jpeg"},
+			"too large":        {make([]byte, pictures.MaxUploadBytes+1), "image/jpeg"},
+			"too many pixels":  {encodePNG(t, image.NewGray(image.Rect(0, 0, 8000, 6000))), "image/png"},
+			"truncated jpeg":   {encodeJPEG(t, halves(400, 400))[:200], "image/jpeg"},
+			"empty":            {nil, "image/jpeg"},
+			"no content type":  {encodePNG(t, halves(400, 400)), ""},
+		}
+		for name, c := range cases {
+			_, err := pictures.Process(c.data, c.contentType)
+			assert.ErrorIs(t, err, pictures.ErrInvalidPicture, name)
+		}
+	})
+}
+
+func TestWebhookModerator(t *testing.T) {
+	var gotEmail string
+	var gotBody []byte
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotEmail = r.Header.Get("X-User-Email")
+		gotBody, _ = io.ReadAll(r.Body)
+		if len(gotBody) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"allowed": false, "reason": "nudity"}`))
+	}))
+	defer service.Close()
+
+	moderator := pictures.NewWebhook(service.URL)
+	verdict, err := moderator.Moderate(context.Background(), "a@yale.edu", []byte("jpeg"))
+	assert.NoError(t, err)
+	assert.Equal(t, pictures.Verdict{Allowed: false, Reason: "nudity"}, verdict)
+	assert.Equal(t, "a@yale.edu", gotEmail)
+	assert.Equal(t, "jpeg", string(gotBody))
+
+	// no verdict when the service fails
+	_, err = moderator.Moderate(context.Background(), "a@yale.edu", nil)
+	assert.Error(t, err)
+
+	verdict, err = pictures.AllowAll{}.Moderate(context.Background(), "a@yale.edu", nil)
+	assert.NoError(t, err)
+	assert.True(t, verdict.Allowed)
+}
@@ -0,0 +1,156 @@
+/***************************************************************************
+ * File Name: user-service/test/searchindex_test.go
+ * Author: Bryan SebaRaj
+ * Description: Unit tests for users index management
+ * Date Created: 01-01-2025
+ *
+ * Copyright (c) 2025 Bryan SebaRaj. All rights reserved.
+ *
+ * License:
+ * This file is part of Crush. See the LICENSE file for details.
+ ***************************************************************************/
+
+package test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/opensearch-project/opensearch-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sebaraj/crush/user-service/searchindex"
+)
+
+// fakeOpenSearch records requests and answers them like a cluster holding an
+// unversioned users index
+type fakeOpenSearch struct {
+	mu       sync.Mutex
+	requests []string
+	bodies   map[string]string
+}
+
+func (f *fakeOpenSearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	key := r.Method + " " + r.URL.Path
+	f.mu.Lock()
+	f.requests = append(f.requests, key)
+	f.bodies[key] = string(body)
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch key {
+	case "GET /":
+		w.Write([]byte(`{}`))
+	case "HEAD /users_v1", "GET /_alias/users":
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{}`))
+	case "POST /users_v1/_bulk", "POST /users/_bulk":
+		w.Write([]byte(`{"errors": false, "items": []}`))
+	default:
+		w.Write([]byte(`{"acknowledged": true}`))
+	}
+}
+
+func TestReindex(t *testing.T) {
+	fake := &fakeOpenSearch{bodies: map[string]string{}}
+	cluster := httptest.NewServer(fake)
+	defer cluster.Close()
+	client, err := opensearch.NewClient(opensearch.Config{Addresses: []string{cluster.URL}})
+	assert.NoError(t, err)
+
+	db, dbMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	dbMock.ExpectQuery("SELECT LOCALTIMESTAMP").WillReturnRows(sqlmock.NewRows([]string{"localtimestamp"}).AddRow(time.Now()))
+	dbMock.ExpectQuery("SELECT (.+) FROM users ORDER BY email").WillReturnRows(sqlmock.NewRows([]string{
+		"email", "is_active", "name", "residential_college", "graduating_year",
+		"interest_1", "interest_2", "interest_3", "interest_4", "interest_5",
+	}).
+		AddRow("a@yale.edu", true, "Ada", "Berkeley", 2026, "Music", nil, nil, nil, nil).
+		AddRow("b@yale.edu", false, "Bo", nil, nil, nil, nil, nil, nil, nil))
+	dbMock.ExpectExec("INSERT INTO search_changes").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	manager := &searchindex.Manager{Client: client}
+	count, err := manager.Reindex(context.Background(), db, 1, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.NoError(t, dbMock.ExpectationsWereMet())
+
+	assert.Equal(t, []string{
+		"GET /",
+		"HEAD /users_v1",
+		"PUT /users_v1",
+		"POST /users_v1/_bulk",
+		"POST /users_v1/_bulk",
+		"POST /users_v1/_refresh",
+		"GET /_alias/users",
+		"HEAD /users",
+		"POST /_aliases",
+	}, fake.requests)
+	assert.Contains(t, fake.bodies["PUT /users_v1"], `"name_prefix"`)
+	// the second batch holds the last user; nothing private is indexed
+	assert.True(t, strings.HasPrefix(fake.bodies["POST /users_v1/_bulk"], `{"index":{"_id":"b@yale.edu"}}`))
+	assert.NotContains(t, fake.bodies["POST /users_v1/_bulk"], "phone_number")
+	assert.Contains(t, fake.bodies["POST /_aliases"], `{"remove_index":{"index":"users"}}`)
+	assert.Contains(t, fake.bodies["POST /_aliases"], `{"add":{"alias":"users","index":"users_v1","is_write_index":true}}`)
+}
+
+func TestIndexOnce(t *testing.T) {
+	fake := &fakeOpenSearch{bodies: map[string]string{}}
+	cluster := httptest.NewServer(fake)
+	defer cluster.Close()
+	client, err := opensearch.NewClient(opensearch.Config{Addresses: []string{cluster.URL}})
+	assert.NoError(t, err)
+
+	db, dbMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	dbMock.ExpectBegin()
+	dbMock.ExpectQuery("SELECT pg_try_advisory_xact_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	dbMock.ExpectQuery("SELECT id, email FROM search_changes").WithArgs(10).WillReturnRows(sqlmock.NewRows([]string{"id", "email"}).
+		AddRow(4, "a@yale.edu").
+		AddRow(5, "gone@yale.edu").
+		AddRow(6, "a@yale.edu"))
+	// a@yale.edu changed twice but is loaded once; gone@yale.edu was deleted
+	dbMock.ExpectQuery("SELECT (.+) FROM users WHERE email = ANY").WillReturnRows(sqlmock.NewRows([]string{
+		"email", "is_active", "name", "residential_college", "graduating_year",
+		"interest_1", "interest_2", "interest_3", "interest_4", "interest_5",
+	}).AddRow("a@yale.edu", true, "Ada", "Berkeley", 2026, "Music", nil, nil, nil, nil))
+	dbMock.ExpectExec("DELETE FROM search_changes").WillReturnResult(sqlmock.NewResult(0, 3))
+	dbMock.ExpectExec("INSERT INTO search_checkpoints").WithArgs("indexer", int64(6), 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectCommit()
+
+	indexer := searchindex.NewIndexer(db, &searchindex.Manager{Client: client})
+	indexer.BatchSize = 10
+	applied, err := indexer.IndexOnce(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 3, applied)
+	assert.NoError(t, dbMock.ExpectationsWereMet())
+
+	bulk := fake.bodies["POST /users/_bulk"]
+	assert.Equal(t, 1, strings.Count(bulk, `{"index":{"_id":"a@yale.edu"}}`))
+	assert.Contains(t, bulk, `{"delete":{"_id":"gone@yale.edu"}}`)
+}
+
+func TestIndexOnceLocked(t *testing.T) {
+	db, dbMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	dbMock.ExpectBegin()
+	dbMock.ExpectQuery("SELECT pg_try_advisory_xact_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(false))
+	dbMock.ExpectCommit()
+
+	// another replica holds the lock, so nothing is read or indexed
+	applied, err := searchindex.NewIndexer(db, &searchindex.Manager{}).IndexOnce(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, applied)
+	assert.NoError(t, dbMock.ExpectationsWereMet())
+}
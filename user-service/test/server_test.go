@@ -17,10 +17,17 @@ import (
 	// "context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	// "github.com/aws/aws-sdk-go/service/s3"
@@ -214,3 +221,292 @@ func TestUserAnswers(t *testing.T) {
 // 		assert.Equal(t, "test@yale.edu", response["email"])
 // 	})
 // }
+
+func TestBlocksAndReports(t *testing.T) {
+	ts := setupTestServer(t)
+	defer ts.db.Close()
+
+	t.Run("block unauthorized", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/v1/user/blocks/other@yale.edu", nil)
+		req.Header.Set("Authorization", "valid-token")
+		w := httptest.NewRecorder()
+
+		ts.server.HandleBlocks(w, req)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("report unauthorized", func(t *testing.T) {
+		body, _ := json.Marshal(map[string]interface{}{
+			"reported_email": "other@yale.edu",
+			"reason":         "spam",
+		})
+		req := httptest.NewRequest("POST", "/v1/user/reports", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+
+		ts.server.HandleReports(w, req)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+	})
+}
+
+func TestPhotos(t *testing.T) {
+	ts := setupTestServer(t)
+	defer ts.db.Close()
+
+	requests := map[string]string{
+		"list":        "GET /v1/user/photos/test@yale.edu",
+		"reorder":     "PUT /v1/user/photos/test@yale.edu",
+		"set primary": "PUT /v1/user/photos/test@yale.edu/0123456789abcdef0123456789abcdef/primary",
+		"delete":      "DELETE /v1/user/photos/test@yale.edu/0123456789abcdef0123456789abcdef",
+	}
+	for name, request := range requests {
+		t.Run(name+" unauthorized", func(t *testing.T) {
+			method, path, _ := strings.Cut(request, " ")
+			req := httptest.NewRequest(method, path, strings.NewReader(`{"order": []}`))
+			req.Header.Set("Authorization", "valid-token")
+			w := httptest.NewRecorder()
+
+			ts.server.HandlePhotos(w, req)
+
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+			assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSearchParams(t *testing.T) {
+	t.Run("builds an allow-listed query", func(t *testing.T) {
+		params, err := server.ParseSearchParams(url.Values{
+			"name":            {"Bry"},
+			"graduating_year": {"2026"},
+			"interest":        {"Music", "Art"},
+			"limit":           {"10"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, server.SearchParams{Name: "Bry", GraduatingYear: 2026, Interests: []string{"Music", "Art"}, Limit: 10}, params)
+
+		body, err := json.Marshal(params.Query([]string{"me@yale.edu"}))
+		assert.NoError(t, err)
+		var query map[string]interface{}
+		assert.NoError(t, json.Unmarshal(body, &query))
+		assert.NotContains(t, query["_source"], "phone_number")
+		assert.Contains(t, string(body), `"must_not":[{"ids":{"values":["me@yale.edu"]}}]`)
+		assert.Contains(t, string(body), `{"term":{"is_active":true}}`)
+	})
+
+	t.Run("rejects unknown and invalid parameters", func(t *testing.T) {
+		for _, query := range []url.Values{
+			{"aggs": {"x"}},
+			{"limit": {"500"}},
+			{"graduating_year": {"soon"}},
+			{"offset": {"9999"}},
+		} {
+			_, err := server.ParseSearchParams(query)
+			assert.Error(t, err, "expected %v to be rejected", query)
+		}
+	})
+}
+
+func TestSuggest(t *testing.T) {
+	t.Run("rate limits per user", func(t *testing.T) {
+		limiter := server.NewRateLimiter(1, 2)
+		for i := 0; i < 2; i++ {
+			ok, _ := limiter.Allow("a@yale.edu")
+			assert.True(t, ok)
+		}
+		ok, wait := limiter.Allow("a@yale.edu")
+		assert.False(t, ok)
+		assert.Greater(t, wait, time.Duration(0))
+		ok, _ = limiter.Allow("b@yale.edu")
+		assert.True(t, ok)
+	})
+
+	t.Run("queries name prefixes of other active users", func(t *testing.T) {
+		body, err := json.Marshal(server.SuggestQuery("bry seb", 5, []string{"me@yale.edu"}))
+		assert.NoError(t, err)
+		assert.Contains(t, string(body), `"name.suggest":{"operator":"and","query":"bry seb"}`)
+		assert.Contains(t, string(body), `{"ids":{"values":["me@yale.edu"]}}`)
+		assert.Contains(t, string(body), `{"term":{"is_active":true}}`)
+		assert.NotContains(t, string(body), "interest_1")
+	})
+}
+
+func TestSignedURLCache(t *testing.T) {
+	signed := 0
+	cache := server.NewSignedURLCache(time.Hour, 10*time.Minute, func(key string, expiry time.Duration) (string, error) {
+		signed++
+		return fmt.Sprintf("https://bucket/%s?n=%d&expires=%s", key, signed, expiry), nil
+	})
+
+	first, err := cache.Get("a.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://bucket/a.jpg?n=1&expires=1h0m0s", first)
+	again, _ := cache.Get("a.jpg")
+	assert.Equal(t, first, again)
+	other, _ := cache.Get("b.jpg")
+	assert.NotEqual(t, first, other)
+	assert.Equal(t, 2, signed)
+
+	// a URL too close to expiring is signed again
+	cache.MinRemaining = 2 * time.Hour
+	resigned, _ := cache.Get("a.jpg")
+	assert.NotEqual(t, first, resigned)
+	cache.MinRemaining = 10 * time.Minute
+
+	cache.Forget("b.jpg")
+	_, _ = cache.Get("b.jpg")
+	assert.Equal(t, 4, signed)
+
+	cache.Sign = func(string, time.Duration) (string, error) { return "", errors.New("no credentials") }
+	_, err = cache.Get("c.jpg")
+	assert.Error(t, err)
+}
+
+func TestParseUserUpdate(t *testing.T) {
+	now := time.Date(2025, time.March, 1, 0, 0, 0, 0, time.UTC)
+	parse := func(body string) (server.UserUpdate, server.FieldErrors) {
+		var raw map[string]json.RawMessage
+		assert.NoError(t, json.Unmarshal([]byte(body), &raw))
+		return server.ParseUserUpdate(raw, now)
+	}
+
+	t.Run("valid fields are normalized", func(t *testing.T) {
+		update, errs := parse(`{
+			"name": "  Ada Lovelace ",
+			"graduating_year": 2027,
+			"gender": 4,
+			"partner_genders": 31,
+			"notif_pref": true,
+			"instagram": "@ada.l",
+			"snapchat": "ada_l",
+			"phone_number": "+1 (203) 555-0123",
+			"interest_1": "Music"
+		}`)
+		assert.Empty(t, errs)
+		assert.Equal(t, server.UserUpdate{
+			"name":            "Ada Lovelace",
+			"graduating_year": 2027,
+			"gender":          4,
+			"partner_genders": 31,
+			"notif_pref":      true,
+			"instagram":       "ada.l",
+			"snapchat":        "ada_l",
+			"phone_number":    "+12035550123",
+			"interest_1":      "Music",
+		}, update)
+	})
+
+	t.Run("null and blank clear optional fields", func(t *testing.T) {
+		update, errs := parse(`{"instagram": null, "interest_2": " ", "graduating_year": null, "residential_college": null}`)
+		assert.Empty(t, errs)
+		assert.Equal(t, server.UserUpdate{
+			"instagram":           nil,
+			"interest_2":          nil,
+			"graduating_year":     nil,
+			"residential_college": nil,
+		}, update)
+	})
+
+	t.Run("every invalid field is reported", func(t *testing.T) {
+		update, errs := parse(`{
+			"email": "other@yale.edu",
+			"is_active": true,
+			"name": null,
+			"graduating_year": 2024,
+			"gender": "4",
+			"partner_genders": 32,
+			"notif_pref": "yes",
+			"instagram": "ada lovelace",
+			"snapchat": "1ada",
+			"phone_number": "203-555-0123",
+			"interest_3": "a very long interest indeed",
+			"picture_s3_url": "https://example.com/a.jpg"
+		}`)
+		assert.Empty(t, update)
+		assert.Equal(t, []string{
+			"email", "gender", "graduating_year", "instagram", "interest_3", "is_active", "name",
+			"notif_pref", "partner_genders", "phone_number", "picture_s3_url", "snapchat",
+		}, sortedKeys(errs))
+		assert.Equal(t, "unknown field", errs["picture_s3_url"])
+		assert.Equal(t, "must be an integer from 2025 to 2030", errs["graduating_year"])
+	})
+
+	t.Run("interests fill the interest columns in order", func(t *testing.T) {
+		update, errs := parse(`{"interests": ["Music", " ", "Art "]}`)
+		assert.Empty(t, errs)
+		assert.Equal(t, server.UserUpdate{
+			"interest_1": "Music",
+			"interest_2": "Art",
+			"interest_3": nil,
+			"interest_4": nil,
+			"interest_5": nil,
+		}, update)
+
+		update, errs = parse(`{"interests": null}`)
+		assert.Empty(t, errs)
+		assert.Len(t, update, server.NumInterests)
+		for _, interest := range update {
+			assert.Nil(t, interest)
+		}
+	})
+
+	t.Run("invalid interests", func(t *testing.T) {
+		for body, problem := range map[string]string{
+			`{"interests": "Music"}`:                                  "must be an array of strings",
+			`{"interests": ["a", "b", "c", "d", "e", "f"]}`:           "must have at most 5 interests",
+			`{"interests": ["Music", "a very long interest indeed"]}`: "interest 2 must be at most 20 characters",
+			`{"interests": ["Music"], "interest_1": "Art"}`:           "can't be combined with interest_1 to interest_5",
+		} {
+			_, errs := parse(body)
+			assert.Equal(t, problem, errs["interests"], body)
+		}
+	})
+}
+
+func TestPatchUserUnauthorized(t *testing.T) {
+	ts := setupTestServer(t)
+	defer ts.db.Close()
+
+	req := httptest.NewRequest("PATCH", "/v1/user/info/test@yale.edu", strings.NewReader(`{"name": "Ada"}`))
+	w := httptest.NewRecorder()
+
+	ts.server.HandleUser(w, req)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+}
+
+func TestPatchUserRereadUsesErrorEnvelope(t *testing.T) {
+	ts := setupTestServer(t)
+	defer ts.db.Close()
+	authorize(ts)
+	ts.dbMock.ExpectBegin()
+	ts.dbMock.ExpectExec(regexp.QuoteMeta("UPDATE users SET interest_1 = $1, interest_2 = $2, interest_3 = $3, interest_4 = $4, interest_5 = $5 WHERE email = $6")).
+		WithArgs("Music", "Art", nil, nil, nil, "me@yale.edu").WillReturnResult(sqlmock.NewResult(0, 1))
+	ts.dbMock.ExpectCommit()
+	ts.dbMock.ExpectBegin()
+	ts.dbMock.ExpectQuery(regexp.QuoteMeta("FROM users u")).WillReturnError(errors.New("connection reset"))
+	ts.dbMock.ExpectRollback()
+
+	w := do(ts.server.HandleUser, "PATCH", "/v1/user/info/me@yale.edu", "me@yale.edu", `{"interests": ["Music", "Art"]}`)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var body struct {
+		Error server.APIError `json:"error"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body), w.Body.String())
+	assert.Equal(t, "internal_error", body.Error.Code)
+	assert.NoError(t, ts.dbMock.ExpectationsWereMet())
+}
+
+func sortedKeys(errs server.FieldErrors) []string {
+	keys := make([]string, 0, len(errs))
+	for key := range errs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}